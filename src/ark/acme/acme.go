@@ -0,0 +1,415 @@
+// Package acme obtains and renews certificates for routes with automatic tls
+// using the ACME protocol and HTTP-01 challenges. Challenges are answered by
+// arkd, to which nginx proxies every request for /.well-known/acme-challenge/.
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+
+	"ark/store"
+)
+
+// LetsEncryptURL is the directory of the Let's Encrypt production ACME
+// service.
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// DefaultRenewBefore is how long before a certificate expires that it is
+// renewed when a Manager does not specify otherwise.
+const DefaultRenewBefore = 30 * 24 * time.Hour
+
+// accountKey is the setting that holds the PEM encoded key of the ACME
+// account.
+const accountKey = "acme/account-key"
+
+const challengePath = "/.well-known/acme-challenge/"
+
+// Manager obtains and renews the certificates of routes with automatic tls
+// and keeps them in the store.
+type Manager struct {
+	Store store.Store
+
+	// DirectoryURL is the directory of the ACME service.
+	DirectoryURL string
+
+	// Email is given to the ACME service as the contact for the account.
+	Email string
+
+	// HTTPClient is used to talk to the ACME service, http.DefaultClient if
+	// nil.
+	HTTPClient *http.Client
+
+	// RenewBefore is how long before expiry that certificates are renewed,
+	// DefaultRenewBefore if zero.
+	RenewBefore time.Duration
+
+	// Update is called after certificates change so that they can be given
+	// to the load balancer. It is also called before a certificate is
+	// ordered so that the load balancer passes the challenges for hosts it
+	// has not seen yet to the Manager.
+	Update func() error
+
+	lck    sync.Mutex
+	tokens map[string]string
+	client *acme.Client
+}
+
+// ServeHTTP answers HTTP-01 challenges for orders that are in progress.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, challengePath)
+
+	m.lck.Lock()
+	resp, ok := m.tokens[token]
+	m.lck.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(resp))
+}
+
+func (m *Manager) setToken(token, resp string) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = map[string]string{}
+	}
+	m.tokens[token] = resp
+}
+
+func (m *Manager) clearToken(token string) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	delete(m.tokens, token)
+}
+
+func (m *Manager) renewBefore() time.Duration {
+	if m.RenewBefore == 0 {
+		return DefaultRenewBefore
+	}
+	return m.RenewBefore
+}
+
+// loadKey returns the key of the ACME account, creating it if needed.
+func (m *Manager) loadKey() (*ecdsa.PrivateKey, error) {
+	b, err := m.Store.LoadSetting(accountKey)
+	if err == nil {
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, errors.New("invalid acme account key")
+		}
+		return x509.ParseECPrivateKey(blk.Bytes)
+	} else if err != store.ErrNotFound {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.Store.SaveSetting(accountKey, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	})); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// acmeClient returns a client for an account that is registered with the
+// ACME service.
+func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	key, err := m.loadKey()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.DirectoryURL,
+		HTTPClient:   m.HTTPClient,
+		UserAgent:    "Ark",
+	}
+
+	var acct acme.Account
+	if m.Email != "" {
+		acct.Contact = []string{"mailto:" + m.Email}
+	}
+
+	if _, err := c.Register(ctx, &acct, acme.AcceptTOS); err != nil &&
+		err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+
+	m.client = c
+	return c, nil
+}
+
+// needsCert indicates whether a route with automatic tls needs a new
+// certificate because it has none, the one it has does not cover all of its
+// hosts or it is due for renewal.
+func needsCert(
+	rt *store.Route,
+	c *store.Certificate,
+	now time.Time,
+	renewBefore time.Duration) bool {
+	if c == nil {
+		return true
+	}
+
+	covered := map[string]bool{}
+	for _, host := range c.Hosts {
+		covered[host] = true
+	}
+
+	for _, host := range rt.Hosts {
+		if !covered[host] {
+			return true
+		}
+	}
+
+	return time.Unix(c.NotAfter, 0).Add(-renewBefore).Before(now)
+}
+
+// authorize proves control of the identifier of the authorization with an
+// HTTP-01 challenge.
+func (m *Manager) authorize(ctx context.Context, c *acme.Client, url string) error {
+	z, err := c.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, ch := range z.Challenges {
+		if ch.Type == "http-01" {
+			chal = ch
+			break
+		}
+	}
+
+	if chal == nil {
+		return fmt.Errorf("no http-01 challenge for %s", z.Identifier.Value)
+	}
+
+	resp, err := c.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+
+	m.setToken(chal.Token, resp)
+	defer m.clearToken(chal.Token)
+
+	if _, err := c.Accept(ctx, chal); err != nil {
+		return err
+	}
+
+	_, err = c.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// obtain orders a certificate for the hosts.
+func (m *Manager) obtain(
+	ctx context.Context,
+	name string,
+	hosts []string) (*store.Certificate, error) {
+	c, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := c.AuthorizeOrder(ctx, acme.DomainIDs(hosts...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, c, url); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = c.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: hosts,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := c.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []byte
+	for _, b := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: b,
+		})...)
+	}
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &store.Certificate{
+		Name: name,
+		Cert: chain,
+		Key: pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: kder,
+		}),
+		Hosts:     leaf.DNSNames,
+		NotBefore: leaf.NotBefore.Unix(),
+		NotAfter:  leaf.NotAfter.Unix(),
+	}, nil
+}
+
+// Check obtains a certificate for every route with automatic tls that needs
+// one. A failure for one route is logged and does not stop the others, which
+// are retried the next time Check is called.
+func (m *Manager) Check(ctx context.Context) error {
+	rts, err := m.Store.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	changed, routed := false, false
+	for _, rt := range rts {
+		// nginx does not serve challenges for the hosts of disabled routes.
+		if rt.Tls != store.TLSAuto || len(rt.Hosts) == 0 || rt.Disabled {
+			continue
+		}
+
+		name := rt.CertName()
+
+		var cur *store.Certificate
+		var c store.Certificate
+		if err := m.Store.LoadCert(name, &c); err == nil {
+			cur = &c
+		} else if err != store.ErrNotFound {
+			return err
+		}
+
+		if !needsCert(rt, cur, now, m.renewBefore()) {
+			continue
+		}
+
+		// the route may have been saved moments ago, before the load
+		// balancer knew to pass its challenges to us.
+		if !routed && m.Update != nil {
+			if err := m.Update(); err != nil {
+				return err
+			}
+			routed = true
+		}
+
+		crt, err := m.obtain(ctx, name, rt.Hosts)
+		if err != nil {
+			log.Printf("unable to obtain certificate for route '%s': %s", rt.Name, err)
+			continue
+		}
+
+		if err := m.Store.SaveCert(crt); err != nil {
+			return err
+		}
+
+		log.Printf("obtained certificate for route '%s', expires %s",
+			rt.Name,
+			time.Unix(crt.NotAfter, 0).Format("2006-01-02"))
+		changed = true
+	}
+
+	if changed && m.Update != nil {
+		return m.Update()
+	}
+
+	return nil
+}
+
+// Run calls Check every interval and whenever a route with automatic tls is
+// saved, until ctx is done.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) error {
+	w, err := m.Store.Watch(store.Latest)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	check := func() {
+		if err := m.Check(ctx); err != nil {
+			log.Printf("acme: %s", err)
+		}
+	}
+
+	check()
+
+	for {
+		select {
+		case rev, ok := <-w.C:
+			if !ok {
+				return nil
+			}
+
+			if rev.Op == store.Revision_PUT && rev.Route.Tls == store.TLSAuto {
+				check()
+			}
+		case <-t.C:
+			check()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
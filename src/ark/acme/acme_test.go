@@ -0,0 +1,586 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+
+	"ark/store"
+)
+
+// fakeCA is a minimal ACME service. It does not check the signatures of
+// requests and validates HTTP-01 challenges by asking the manager for the
+// response, as nginx would when it proxies the challenge to arkd.
+type fakeCA struct {
+	*httptest.Server
+
+	// thumbprint of the account key, which the challenge responses must
+	// include.
+	thumbprint string
+
+	m   *Manager
+	key *ecdsa.PrivateKey
+	ca  *x509.Certificate
+
+	lck      sync.Mutex
+	validity time.Duration
+	issued   int
+	orders   []*fakeOrder
+
+	// routed indicates whether challenges reach the manager, as they do once
+	// nginx has been updated.
+	routed bool
+}
+
+func (f *fakeCA) setRouted(routed bool) {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	f.routed = routed
+}
+
+// fakeOrder has an authorization with the given status for each host.
+type fakeOrder struct {
+	hosts  []string
+	status []string
+	chain  []byte
+}
+
+func newFakeCA(t *testing.T, m *Manager) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	akey, err := m.loadKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumbprint, err := acme.JWKThumbprint(akey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeCA{
+		thumbprint: thumbprint,
+		m:          m,
+		key:        key,
+		ca:         ca,
+		validity:   90 * 24 * time.Hour,
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeCA) directory() string {
+	return f.URL + "/directory"
+}
+
+// payload decodes the payload of a JWS request into v, if it has one.
+func payload(r *http.Request, v interface{}) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+
+	if jws.Payload == "" {
+		return nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (f *fakeCA) order(id int) (*fakeOrder, error) {
+	if id < 0 || id >= len(f.orders) {
+		return nil, fmt.Errorf("no order %d", id)
+	}
+	return f.orders[id], nil
+}
+
+// emitOrder writes the state of order id in the form of RFC 8555.
+func (f *fakeCA) emitOrder(w http.ResponseWriter, id int, code int) {
+	o := f.orders[id]
+
+	status := "ready"
+	for _, st := range o.status {
+		if st != "valid" {
+			status = st
+		}
+	}
+
+	res := map[string]interface{}{
+		"finalize": fmt.Sprintf("%s/finalize/%d", f.URL, id),
+	}
+
+	if o.chain != nil {
+		status = "valid"
+		res["certificate"] = fmt.Sprintf("%s/cert/%d", f.URL, id)
+	}
+
+	var authz []string
+	for i := range o.hosts {
+		authz = append(authz, fmt.Sprintf("%s/authz/%d/%d", f.URL, id, i))
+	}
+
+	res["status"] = status
+	res["authorizations"] = authz
+
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", f.URL, id))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+// issue signs the CSR for the order.
+func (f *fakeCA) issue(o *fakeOrder, der []byte) error {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+
+	f.issued++
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(f.issued + 1)),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(f.validity),
+	}
+
+	crt, err := x509.CreateCertificate(rand.Reader, tpl, f.ca, csr.PublicKey, f.key)
+	if err != nil {
+		return err
+	}
+
+	o.chain = append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+	return nil
+}
+
+func (f *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", time.Now().UnixNano()))
+
+	var id, ix int
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) > 1 {
+		fmt.Sscan(parts[1], &id)
+	}
+	if len(parts) > 2 {
+		fmt.Sscan(parts[2], &ix)
+	}
+
+	fail := func(err error) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"type":   "urn:ietf:params:acme:error:malformed",
+			"detail": err.Error(),
+		})
+	}
+
+	switch parts[0] {
+	case "directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/account",
+			"newOrder":   f.URL + "/new-order",
+		})
+	case "nonce":
+		w.WriteHeader(http.StatusOK)
+	case "account":
+		w.Header().Set("Location", f.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "new-order":
+		var req struct {
+			Identifiers []struct {
+				Value string `json:"value"`
+			} `json:"identifiers"`
+		}
+		if err := payload(r, &req); err != nil {
+			fail(err)
+			return
+		}
+
+		o := &fakeOrder{}
+		for _, id := range req.Identifiers {
+			o.hosts = append(o.hosts, id.Value)
+			o.status = append(o.status, "pending")
+		}
+		f.orders = append(f.orders, o)
+		f.emitOrder(w, len(f.orders)-1, http.StatusCreated)
+	case "order":
+		if _, err := f.order(id); err != nil {
+			fail(err)
+			return
+		}
+		f.emitOrder(w, id, http.StatusOK)
+	case "authz", "challenge":
+		o, err := f.order(id)
+		if err != nil || ix >= len(o.hosts) {
+			fail(fmt.Errorf("no authorization %d/%d", id, ix))
+			return
+		}
+
+		token := fmt.Sprintf("token-%d-%d", id, ix)
+		if parts[0] == "challenge" {
+			// answer the challenge the way nginx would, by asking arkd.
+			req, err := http.NewRequest("GET", challengePath+token, nil)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			rec := httptest.NewRecorder()
+			if f.routed {
+				f.m.ServeHTTP(rec, req)
+			}
+			if rec.Body.String() == token+"."+f.thumbprint {
+				o.status[ix] = "valid"
+			} else {
+				o.status[ix] = "invalid"
+			}
+		}
+
+		status := o.status[ix]
+
+		chal := map[string]string{
+			"type":   "http-01",
+			"url":    fmt.Sprintf("%s/challenge/%d/%d", f.URL, id, ix),
+			"token":  token,
+			"status": status,
+		}
+
+		if parts[0] == "challenge" {
+			json.NewEncoder(w).Encode(chal)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": o.hosts[ix]},
+			"challenges": []interface{}{chal},
+		})
+	case "finalize":
+		o, err := f.order(id)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		if err := payload(r, &req); err != nil {
+			fail(err)
+			return
+		}
+
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		if err := f.issue(o, der); err != nil {
+			fail(err)
+			return
+		}
+		f.emitOrder(w, id, http.StatusOK)
+	case "cert":
+		o, err := f.order(id)
+		if err != nil || o.chain == nil {
+			fail(fmt.Errorf("no certificate %d", id))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(o.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestNeedsCert(t *testing.T) {
+	now := time.Now()
+	rt := &store.Route{
+		Name:  "a",
+		Hosts: []string{"a.com", "www.a.com"},
+		Tls:   store.TLSAuto,
+	}
+
+	cert := func(notAfter time.Time, hosts ...string) *store.Certificate {
+		return &store.Certificate{
+			Hosts:    hosts,
+			NotAfter: notAfter.Unix(),
+		}
+	}
+
+	month := 30 * 24 * time.Hour
+
+	tests := []struct {
+		c     *store.Certificate
+		needs bool
+	}{
+		{nil, true},
+		{cert(now.Add(2*month), "a.com", "www.a.com"), false},
+		{cert(now.Add(2*month), "www.a.com", "a.com", "b.com"), false},
+		{cert(now.Add(2*month), "a.com"), true},
+		{cert(now.Add(month/2), "a.com", "www.a.com"), true},
+		{cert(now.Add(-time.Hour), "a.com", "www.a.com"), true},
+	}
+
+	for i, test := range tests {
+		if needsCert(rt, test.c, now, DefaultRenewBefore) != test.needs {
+			t.Fatalf("%d: expected needsCert to be %t", i, test.needs)
+		}
+	}
+}
+
+func TestServeChallenge(t *testing.T) {
+	var m Manager
+	m.setToken("abc", "abc.xyz")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/.well-known/acme-challenge/abc")
+	if w.Code != http.StatusOK || w.Body.String() != "abc.xyz" {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := get("/.well-known/acme-challenge/nope"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 got %d", w.Code)
+	}
+
+	m.clearToken("abc")
+	if w := get("/.well-known/acme-challenge/abc"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 after the order got %d", w.Code)
+	}
+}
+
+func TestObtainAndRenew(t *testing.T) {
+	s, err := store.Open("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var ca *fakeCA
+	updates := 0
+	m := &Manager{
+		Store: s,
+		Update: func() error {
+			updates++
+			ca.setRouted(true)
+			return nil
+		},
+	}
+
+	ca = newFakeCA(t, m)
+	defer ca.Close()
+	m.DirectoryURL = ca.directory()
+
+	rt := &store.Route{
+		Name:  "a",
+		Port:  443,
+		Hosts: []string{"a.com"},
+		Tls:   store.TLSAuto,
+	}
+	if err := s.Save(rt, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// each check starts as if the route was just saved, before nginx knows
+	// to pass the challenges for its hosts to arkd.
+	check := func(issued int) *store.Certificate {
+		ca.setRouted(false)
+		if err := m.Check(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// nginx is updated before each order and after each certificate.
+		if ca.issued != issued || updates != 2*issued {
+			t.Fatalf("expected %d certificates and %d updates, got %d and %d",
+				issued, 2*issued, ca.issued, updates)
+		}
+
+		var c store.Certificate
+		if err := s.LoadCert(rt.CertName(), &c); err != nil {
+			t.Fatal(err)
+		}
+		return &c
+	}
+
+	// a certificate that expires within RenewBefore is renewed on the next
+	// check.
+	ca.validity = 10 * 24 * time.Hour
+	c := check(1)
+	if c.Name != "acme-a" || len(c.Hosts) != 1 || c.Hosts[0] != "a.com" {
+		t.Fatalf("unexpected certificate %s for %v", c.Name, c.Hosts)
+	}
+
+	if _, err := tls.X509KeyPair(c.Cert, c.Key); err != nil {
+		t.Fatalf("certificate does not match its key: %s", err)
+	}
+
+	ca.validity = 90 * 24 * time.Hour
+	c = check(2)
+	if time.Unix(c.NotAfter, 0).Before(time.Now().Add(80 * 24 * time.Hour)) {
+		t.Fatal("expected the certificate to be renewed")
+	}
+
+	check(2)
+
+	// a new host needs a new certificate.
+	rt.Hosts = append(rt.Hosts, "www.a.com")
+	if err := s.Save(rt, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := check(3); len(c.Hosts) != 2 {
+		t.Fatalf("expected a certificate for both hosts, got %v", c.Hosts)
+	}
+
+	// a failed challenge is retried on the next check.
+	m.Store.DeleteCert(rt.CertName())
+	ca.thumbprint = "wrong"
+	if err := m.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.issued != 3 {
+		t.Fatal("expected no certificate for a failed challenge")
+	}
+}
+
+// TestPebble obtains a certificate from a local pebble server, whose
+// directory is given in ARK_TEST_ACME_DIRECTORY. Pebble validates HTTP-01
+// challenges by connecting to port 5002, where the test answers them.
+func TestPebble(t *testing.T) {
+	dir := os.Getenv("ARK_TEST_ACME_DIRECTORY")
+	if dir == "" {
+		t.Skip("ARK_TEST_ACME_DIRECTORY is not set")
+	}
+
+	s, err := store.Open("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	updates := 0
+	m := &Manager{
+		Store:        s,
+		DirectoryURL: dir,
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+		Update: func() error {
+			updates++
+			return nil
+		},
+	}
+
+	l, err := net.Listen("tcp", ":5002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, m)
+
+	if err := s.Save(&store.Route{
+		Name:  "a",
+		Port:  443,
+		Hosts: []string{"localhost"},
+		Tls:   store.TLSAuto,
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := m.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var c store.Certificate
+	if err := s.LoadCert("acme-a", &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if updates != 2 {
+		t.Fatalf("expected 2 updates, got %d", updates)
+	}
+
+	// the new certificate is good for a while.
+	if err := m.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if updates != 2 {
+		t.Fatal("expected the certificate not to be renewed")
+	}
+}
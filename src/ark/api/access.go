@@ -0,0 +1,254 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"ark/store"
+)
+
+// userRequest is the body of a PUT to /api/v1/routes/{name}/users/{user}.
+type userRequest struct {
+	Password string `json:"password"`
+}
+
+// validateAccess checks the users and access rules of a route.
+func validateAccess(r *store.Route) error {
+	a := r.Access
+	if a == nil {
+		return nil
+	}
+
+	if len(a.Users) > 0 && r.IsStream() {
+		return errors.New("a stream route cannot use basic auth")
+	}
+
+	seen := map[string]bool{}
+	for _, u := range a.Users {
+		// users are written one per line as name:hash to the htpasswd file.
+		if u.Name == "" || strings.ContainsAny(u.Name, ": \t\r\n") {
+			return fmt.Errorf("invalid user name: '%s'", u.Name)
+		}
+
+		if u.Hash == "" || strings.ContainsAny(u.Hash, " \t\r\n") {
+			return fmt.Errorf("%s: invalid password hash", u.Name)
+		}
+
+		if seen[u.Name] {
+			return fmt.Errorf("duplicate user: '%s'", u.Name)
+		}
+		seen[u.Name] = true
+	}
+
+	for _, ar := range a.Rules {
+		switch ar.Action {
+		case store.AccessAllow, store.AccessDeny:
+		default:
+			return fmt.Errorf("invalid access action: '%s'", ar.Action)
+		}
+
+		if ar.Source == store.AccessAll || net.ParseIP(ar.Source) != nil {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(ar.Source); err != nil {
+			return fmt.Errorf("access source must be an address, a CIDR block or all: '%s'",
+				ar.Source)
+		}
+	}
+
+	return nil
+}
+
+// pruneAccess clears the access of a route that no longer restricts anyone.
+func pruneAccess(rt *store.Route) {
+	if a := rt.Access; a != nil && len(a.Users) == 0 && len(a.Rules) == 0 {
+		rt.Access = nil
+	}
+}
+
+// userNames returns the names of the users of a route.
+func userNames(rt *store.Route) []string {
+	names := []string{}
+	if rt.Access != nil {
+		for _, u := range rt.Access.Users {
+			names = append(names, u.Name)
+		}
+	}
+	return names
+}
+
+// redactRoute returns a copy of the route without the password hashes of its
+// users. Hashes are only ever returned in backups.
+func redactRoute(rt *store.Route) *store.Route {
+	if rt == nil || rt.Access == nil || len(rt.Access.Users) == 0 {
+		return rt
+	}
+
+	rt = proto.Clone(rt).(*store.Route)
+	for _, u := range rt.Access.Users {
+		u.Hash = ""
+	}
+	return rt
+}
+
+// redactRoutes applies redactRoute to each route.
+func redactRoutes(rts []*store.Route) []*store.Route {
+	res := make([]*store.Route, 0, len(rts))
+	for _, rt := range rts {
+		res = append(res, redactRoute(rt))
+	}
+	return res
+}
+
+// keepHashes gives each user of rt that has no password hash the hash that
+// the user has in cur, the stored version of the route. This lets a route
+// that was read from the API, which redacts hashes, be sent back as it is.
+func keepHashes(rt, cur *store.Route) {
+	if rt.Access == nil || cur == nil || cur.Access == nil {
+		return
+	}
+
+	for _, u := range rt.Access.Users {
+		if u.Hash != "" {
+			continue
+		}
+
+		if cu := cur.Access.User(u.Name); cu != nil {
+			u.Hash = cu.Hash
+		}
+	}
+}
+
+// getUsers emits the names of the users of a route, without their hashes.
+func getUsers(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var rt store.Route
+	if err := ctx.Store.Load(names[0], &rt); err == store.ErrNotFound {
+		emitJSONError(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, &rt)
+	emitJSON(w, userNames(&rt))
+}
+
+// putUser adds a basic auth user to a route or changes their password.
+func putUser(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if req.Password == "" {
+		emitJSONError(w, errors.New("password is required"), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := store.HashPassword(req.Password)
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		if rt.Access == nil {
+			rt.Access = &store.Access{}
+		}
+
+		if u := rt.Access.User(names[1]); u != nil {
+			u.Hash = hash
+		} else {
+			rt.Access.Users = append(rt.Access.Users, &store.BasicUser{
+				Name: names[1],
+				Hash: hash,
+			})
+		}
+
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, userNames(rt))
+}
+
+// delUser removes a basic auth user from a route.
+func delUser(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		if rt.Access == nil || rt.Access.User(names[1]) == nil {
+			return fmt.Errorf("user not found: '%s'", names[1])
+		}
+
+		var users []*store.BasicUser
+		for _, u := range rt.Access.Users {
+			if u.Name != names[1] {
+				users = append(users, u)
+			}
+		}
+		rt.Access.Users = users
+		pruneAccess(rt)
+
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, userNames(rt))
+}
+
+// postACL replaces the allow and deny rules of a route.
+func postACL(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var rules []*store.AccessRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		if rt.Access == nil {
+			rt.Access = &store.Access{}
+		}
+		rt.Access.Rules = rules
+		pruneAccess(rt)
+
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	rules = []*store.AccessRule{}
+	if rt.Access != nil && rt.Access.Rules != nil {
+		rules = rt.Access.Rules
+	}
+
+	emitJSON(w, rules)
+}
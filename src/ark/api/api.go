@@ -8,12 +8,15 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 
 	"ark/docker"
 	"ark/fe"
+	"ark/health"
 	"ark/store"
 	"ark/web/router"
 )
@@ -29,15 +32,49 @@ type Context struct {
 	Store        store.Store
 	LoadBalancer fe.Service
 	DockerDialer func() (net.Conn, error)
+
+	// ACME serves the responses to ACME HTTP-01 challenges, which nginx
+	// proxies to arkd. It is nil when automatic certificates are disabled.
+	ACME http.Handler
+
+	// Health reports the health of the backends of routes. It is nil when
+	// backends are not checked.
+	Health *health.Checker
+
+	// StaticDir is where the static content of routes is kept. Uploads are
+	// refused when it is empty.
+	StaticDir string
+}
+
+// UserHeader is the request header that carries the identity of the user on
+// whose behalf a request is being made. It is set by the ark client's proxy.
+const UserHeader = "X-Ark-User"
+
+func userFor(r *http.Request) string {
+	return r.Header.Get(UserHeader)
 }
 
-func (c *Context) update() error {
+// Update regenerates the load balancer's configuration from the store.
+func (c *Context) Update() error {
 	rts, err := c.Store.LoadAll()
 	if err != nil {
 		return err
 	}
 
-	return c.LoadBalancer.Update(rts)
+	certs, err := c.Store.LoadCerts()
+	if err != nil {
+		return err
+	}
+
+	// disabled routes stay in the store but are left out of the frontend.
+	var enabled []*store.Route
+	for _, rt := range rts {
+		if !rt.Disabled {
+			enabled = append(enabled, rt)
+		}
+	}
+
+	return c.LoadBalancer.Update(enabled, certs)
 }
 
 func emitJSONError(w http.ResponseWriter, err error, status int) {
@@ -66,31 +103,234 @@ func getRoutes(ctx *Context,
 	r *http.Request,
 	names []string) {
 
-	rts, err := ctx.Store.LoadAll()
+	q := r.URL.Query()
+
+	be := q.Get("backend")
+	if be != "" {
+		var err error
+		be, err = resolveBackend(context.Background(), be)
+		if docker.IsNotFound(err) {
+			emitJSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			emitJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	sel, err := store.ParseSelector(q.Get("selector"))
+	if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rts, err := ctx.Store.Find(&store.Query{
+		Host:     q.Get("host"),
+		Backend:  be,
+		Selector: sel,
+	})
 	if err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	emitJSON(w, rts)
+	emitJSON(w, redactRoutes(rts))
 }
 
-func validateRoute(r *store.Route) error {
+// resolveBackend translates a backend query that names a container, with or
+// without a port, into the container's ip address.
+func resolveBackend(ctx context.Context, be string) (string, error) {
+	addr, port := be, ""
+	if ix := strings.LastIndex(be, ":"); ix >= 0 {
+		addr, port = be[:ix], be[ix:]
+	}
+
+	if net.ParseIP(addr) != nil {
+		return be, nil
+	}
+
+	refs, err := docker.ToIPAddresses(ctx, []*docker.Ref{{Addr: addr}})
+	if err != nil {
+		return "", err
+	}
+
+	return refs[0].Addr + port, nil
+}
+
+// routeFinder finds the routes that match a query. It is satisfied by
+// store.Store as well as by views that overlay pending changes on a store.
+type routeFinder interface {
+	Find(q *store.Query) ([]*store.Route, error)
+}
+
+// routeList is a routeFinder over a fixed set of routes.
+type routeList []*store.Route
+
+func (l routeList) Find(q *store.Query) ([]*store.Route, error) {
+	var rts []*store.Route
+	for _, rt := range l {
+		if q.Matches(rt) {
+			rts = append(rts, rt)
+		}
+	}
+	return rts, nil
+}
+
+// validateRoute checks that the route is well-formed and that none of its
+// host and port pairs, or its port if it is a stream route, are claimed by
+// any other route in f.
+func validateRoute(f routeFinder, r *store.Route) error {
 	if r.Name == "" {
 		return errors.New("name is required")
 	}
 
+	if !store.ValidName(r.Name) {
+		return fmt.Errorf("invalid name: '%s', names may only contain letters, digits, '_', '.' and '-'", r.Name)
+	}
+
 	if r.Port == 0 {
 		return errors.New("port is required")
 	}
 
-	if len(r.Hosts) == 0 {
-		return errors.New("at least one host is required")
+	switch r.ProtocolType() {
+	case store.ProtocolHTTP:
+		if len(r.Hosts) == 0 {
+			return errors.New("at least one host is required")
+		}
+	case store.ProtocolTCP, store.ProtocolUDP:
+		if err := validateStream(r); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid protocol: '%s'", r.Protocol)
+	}
+
+	if err := validatePaths(r.Paths); err != nil {
+		return err
+	}
+
+	if err := validateHeaders(r.Headers); err != nil {
+		return err
+	}
+
+	if err := validateAccess(r); err != nil {
+		return err
+	}
+
+	if err := validateLimits(r); err != nil {
+		return err
+	}
+
+	if err := validateProxy(r); err != nil {
+		return err
+	}
+
+	if err := validateStatic(r); err != nil {
+		return err
+	}
+
+	if err := validateLabels(r); err != nil {
+		return err
+	}
+
+	if err := validateGroups(r); err != nil {
+		return err
+	}
+
+	if err := validateBalance(r); err != nil {
+		return err
+	}
+
+	if err := validateHealthCheck(r); err != nil {
+		return err
+	}
+
+	switch r.Tls {
+	case "":
+	case store.TLSAuto:
+		if r.Cert != "" {
+			return errors.New("a route with automatic tls cannot name a certificate")
+		}
+	default:
+		return fmt.Errorf("invalid tls: '%s'", r.Tls)
+	}
+
+	if err := validateRedirect(r); err != nil {
+		return err
+	}
+
+	for _, host := range r.Hosts {
+		rts, err := f.Find(&store.Query{Host: host})
+		if err != nil {
+			return err
+		}
+
+		for _, rt := range rts {
+			if port := rt.SharedPort(r); rt.Name != r.Name && port != 0 {
+				return fmt.Errorf("%s:%d is already claimed by route '%s'",
+					host, port, rt.Name)
+			}
+		}
+	}
+
+	return validatePort(f, r)
+}
+
+// validatePaths checks that each path rule is well-formed and that no two
+// rules match the same paths in the same way.
+func validatePaths(rules []*store.PathRule) error {
+	seen := map[string]bool{}
+	for _, p := range rules {
+		match := p.MatchType()
+		switch match {
+		case store.MatchPrefix, store.MatchExact:
+			if !strings.HasPrefix(p.Path, "/") {
+				return fmt.Errorf("path must begin with /: '%s'", p.Path)
+			}
+		case store.MatchRegex:
+			if p.Path == "" {
+				return errors.New("regex path is required")
+			}
+
+			// nginx fails to load a config with a bad regex, which would stop
+			// every route from updating. Go's syntax is close enough to PCRE.
+			if _, err := regexp.Compile(p.Path); err != nil {
+				return fmt.Errorf("invalid regex path: '%s': %s", p.Path, err)
+			}
+		default:
+			return fmt.Errorf("invalid path match: '%s'", p.Match)
+		}
+
+		// paths are written unquoted into the nginx config.
+		if strings.ContainsAny(p.Path, "\"';{} \t\r\n") {
+			return fmt.Errorf("path may not contain quotes, braces, ';' or spaces: '%s'", p.Path)
+		}
+
+		if match == store.MatchPrefix && p.Path == "/" {
+			return errors.New("a prefix rule for / is not allowed, use the route's backends")
+		}
+
+		if len(p.Backends) == 0 {
+			return fmt.Errorf("path %s has no backends", p.Path)
+		}
+
+		key := match + " " + p.Path
+		if seen[key] {
+			return fmt.Errorf("duplicate path rule: %s %s", match, p.Path)
+		}
+		seen[key] = true
 	}
 
 	return nil
 }
 
+// ValidateRoute checks that the route is well-formed and that none of its
+// host and port pairs, or its port if it is a stream route, are claimed by the
+// other routes.
+func ValidateRoute(r *store.Route, others []*store.Route) error {
+	return validateRoute(routeList(others), r)
+}
+
 func postRoutes(ctx *Context,
 	w http.ResponseWriter,
 	r *http.Request,
@@ -103,21 +343,63 @@ func postRoutes(ctx *Context,
 		return
 	}
 
-	if err := validateRoute(&rt); err != nil {
+	var cur store.Route
+	if err := ctx.Store.Load(rt.Name, &cur); err == nil {
+		keepHashes(&rt, &cur)
+	} else if err != store.ErrNotFound {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := validateRoute(ctx.Store, &rt); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateCert(ctx.Store, &rt); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the content must not be pruned before the route that refers to it is
+	// saved.
+	staticLck.Lock()
+	defer staticLck.Unlock()
+
+	if err := validateStaticContent(ctx.StaticDir, &rt); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	version, check, err := ifMatch(r)
+	if err != nil {
 		emitJSONError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	if err := ctx.Store.Save(&rt); err != nil {
+	var b store.Batch
+	if check {
+		b.SaveIf(&rt, version)
+	} else {
+		b.Save(&rt)
+	}
+
+	err = ctx.Store.Write(&b, userFor(r))
+	if err == store.ErrConflict {
+		emitConflict(ctx, w, rt.Name)
+		return
+	} else if err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	if err := ctx.update(); err != nil {
+	if err := ctx.Update(); err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	emitJSON(w, &rt)
+	setETag(w, &rt)
+	emitJSON(w, redactRoute(&rt))
 }
 
 func getRoute(ctx *Context,
@@ -130,7 +412,8 @@ func getRoute(ctx *Context,
 		emitJSONError(w, fmt.Errorf("%s not found", names[0]), http.StatusNotFound)
 		return
 	}
-	emitJSON(w, &rt)
+	setETag(w, &rt)
+	emitJSON(w, redactRoute(&rt))
 }
 
 func delRoute(ctx *Context,
@@ -138,16 +421,32 @@ func delRoute(ctx *Context,
 	r *http.Request,
 	names []string) {
 
-	err := ctx.Store.Delete(names[0])
+	version, check, err := ifMatch(r)
+	if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var b store.Batch
+	if check {
+		b.DeleteIf(names[0], version)
+	} else {
+		b.Delete(names[0])
+	}
+
+	err = ctx.Store.Write(&b, userFor(r))
 	if err == store.ErrNotFound {
 		emitJSONError(w, err, http.StatusNotFound)
 		return
+	} else if err == store.ErrConflict {
+		emitConflict(ctx, w, names[0])
+		return
 	} else if err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	if err := ctx.update(); err != nil {
+	if err := ctx.Update(); err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
@@ -155,6 +454,38 @@ func delRoute(ctx *Context,
 	emitNoContent(w)
 }
 
+// setDisabled disables or enables a route, keeping it in the store either way.
+func setDisabled(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	name string,
+	disabled bool) {
+
+	rt := modifyRoute(ctx, w, r, name, func(rt *store.Route) error {
+		rt.Disabled = disabled
+		return nil
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, redactRoute(rt))
+}
+
+func postDisable(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+	setDisabled(ctx, w, r, names[0], true)
+}
+
+func postEnable(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+	setDisabled(ctx, w, r, names[0], false)
+}
+
 func getBackends(ctx *Context,
 	w http.ResponseWriter,
 	r *http.Request,
@@ -167,6 +498,13 @@ func getBackends(ctx *Context,
 		return
 	}
 
+	setETag(w, &rt)
+
+	if r.URL.Query().Get("health") != "" {
+		getBackendHealth(ctx, w, &rt)
+		return
+	}
+
 	ips, err := docker.ParseRefs(rt.Backends)
 	if err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
@@ -183,12 +521,9 @@ func getBackends(ctx *Context,
 	emitJSON(w, cids)
 }
 
-func readContainerRefs(ctx context.Context, r io.Reader) ([]string, error) {
-	var bes []string
-	if err := json.NewDecoder(r).Decode(&bes); err != nil {
-		return nil, err
-	}
-
+// toIPAddresses translates backends that refer to containers into backends
+// that refer to the container's ip address.
+func toIPAddresses(ctx context.Context, bes []string) ([]string, error) {
 	cids, err := docker.ParseRefs(bes)
 	if err != nil {
 		return nil, err
@@ -199,11 +534,78 @@ func readContainerRefs(ctx context.Context, r io.Reader) ([]string, error) {
 		return nil, err
 	}
 
+	res := make([]string, len(ips))
 	for i, ip := range ips {
-		bes[i] = ip.String()
+		res[i] = ip.String()
 	}
 
-	return bes, nil
+	return res, nil
+}
+
+// modifyRoute loads the named route, applies fn to it and saves it. The save
+// is retried if the route changes in the meantime, unless the client made the
+// request conditional with If-Match. On failure, modifyRoute emits an error
+// response and returns nil. Errors from fn are treated as bad requests.
+func modifyRoute(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	name string,
+	fn func(rt *store.Route) error) *store.Route {
+
+	version, check, err := ifMatch(r)
+	if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return nil
+	}
+
+	var rt store.Route
+	for i := 0; ; i++ {
+		err = ctx.Store.Load(name, &rt)
+		if err == store.ErrNotFound {
+			emitJSONError(w, fmt.Errorf("route not found: '%s'", name), http.StatusNotFound)
+			return nil
+		} else if err != nil {
+			emitJSONError(w, err, http.StatusInternalServerError)
+			return nil
+		}
+
+		// Without a precondition from the client, the save must still not
+		// clobber a write that happens between the load and the save.
+		if !check {
+			version = rt.Version
+		}
+
+		if err := fn(&rt); err != nil {
+			emitJSONError(w, err, http.StatusBadRequest)
+			return nil
+		}
+
+		var b store.Batch
+		b.SaveIf(&rt, version)
+
+		err = ctx.Store.Write(&b, userFor(r))
+		if err != store.ErrConflict {
+			break
+		}
+
+		if check || i >= maxRetries {
+			emitConflict(ctx, w, name)
+			return nil
+		}
+	}
+
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return nil
+	}
+
+	if err := ctx.Update(); err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return nil
+	}
+
+	setETag(w, &rt)
+	return &rt
 }
 
 func postBackends(ctx *Context,
@@ -211,7 +613,7 @@ func postBackends(ctx *Context,
 	r *http.Request,
 	names []string) {
 
-	bes, err := readContainerRefs(
+	req, err := readBackends(
 		context.Background(),
 		r.Body)
 	if docker.IsNotFound(err) {
@@ -222,28 +624,239 @@ func postBackends(ctx *Context,
 		return
 	}
 
-	var rt store.Route
-	err = ctx.Store.Load(names[0], &rt)
-	if err == store.ErrNotFound {
-		emitJSONError(w, fmt.Errorf("route not found: '%s'", names[0]), http.StatusNotFound)
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		req.apply(rt)
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
 		return
-	} else if err != nil {
+	}
+
+	emitJSON(w, rt.Backends)
+}
+
+// resolveBackends translates backends that name containers into backends
+// that refer to the container's ip address. Backends that are already ip
+// addresses are left as they are.
+func resolveBackends(ctx context.Context, bes []string) ([]string, error) {
+	res := make([]string, len(bes))
+
+	var ixs []int
+	var refs []string
+	for i, be := range bes {
+		addr := be
+		if ix := strings.LastIndex(be, ":"); ix >= 0 {
+			addr = be[:ix]
+		}
+
+		if net.ParseIP(addr) != nil {
+			res[i] = be
+			continue
+		}
+
+		ixs = append(ixs, i)
+		refs = append(refs, be)
+	}
+
+	if len(refs) == 0 {
+		return res, nil
+	}
+
+	ips, err := toIPAddresses(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range ixs {
+		res[i] = ips[j]
+	}
+
+	return res, nil
+}
+
+// postPaths replaces the path rules of a route. The backends of each rule may
+// name containers, as with postBackends.
+func postPaths(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var rules []*store.PathRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	for _, p := range rules {
+		bes, err := resolveBackends(context.Background(), p.Backends)
+		if docker.IsNotFound(err) {
+			emitJSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			emitJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		p.Backends = bes
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Paths = rules
+		rt.PruneOptions()
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	rules = rt.Paths
+	if rules == nil {
+		rules = []*store.PathRule{}
+	}
+
+	emitJSON(w, rules)
+}
+
+func getHistory(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	revs, err := ctx.Store.History(names[0])
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(revs) == 0 {
+		emitJSONError(w, fmt.Errorf("%s not found", names[0]), http.StatusNotFound)
+		return
+	}
+
+	for _, rev := range revs {
+		rev.Route, rev.Previous = redactRoute(rev.Route), redactRoute(rev.Previous)
+	}
+
+	emitJSON(w, revs)
+}
+
+// rollbackTarget finds the revision to restore in a route's history. A rev of
+// 0 selects the revision immediately before the current one.
+func rollbackTarget(revs []*store.Revision, rev int64) (*store.Revision, error) {
+	if rev == 0 {
+		if len(revs) < 2 {
+			return nil, errors.New("no previous revision")
+		}
+		return revs[len(revs)-2], nil
+	}
+
+	for i, r := range revs {
+		if r.Revision != rev {
+			continue
+		}
+
+		if i == len(revs)-1 {
+			return nil, fmt.Errorf("revision %d is current", rev)
+		}
+
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("revision %d not found", rev)
+}
+
+func postRollback(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var req struct {
+		Revision int64 `json:"revision"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	revs, err := ctx.Store.History(names[0])
+	if err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	rt.Backends = bes
-	if err := ctx.Store.Save(&rt); err != nil {
+	if len(revs) == 0 {
+		emitJSONError(w, fmt.Errorf("%s not found", names[0]), http.StatusNotFound)
+		return
+	}
+
+	rev, err := rollbackTarget(revs, req.Revision)
+	if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	version, check, err := ifMatch(r)
+	if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// without a precondition from the client, the rollback applies to the
+	// version that the target was chosen against.
+	if !check {
+		version = 0
+		if cur := revs[len(revs)-1]; cur.Op != store.Revision_DELETE {
+			version = cur.Revision
+		}
+	}
+
+	var b store.Batch
+	var rt *store.Route
+	if rev.Op == store.Revision_DELETE {
+		b.DeleteIf(names[0], version)
+	} else {
+		// the hosts, ports, certificate or static content of the old route
+		// may have been claimed or removed since.
+		rt = proto.Clone(rev.Route).(*store.Route)
+		if err := validateRoute(ctx.Store, rt); err != nil {
+			emitJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := validateCert(ctx.Store, rt); err != nil {
+			emitJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := validateStaticContent(ctx.StaticDir, rt); err != nil {
+			emitJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		b.SaveIf(rt, version)
+	}
+
+	err = ctx.Store.Write(&b, userFor(r))
+	if err == store.ErrConflict {
+		emitConflict(ctx, w, names[0])
+		return
+	} else if err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	if err := ctx.update(); err != nil {
+	if err := ctx.Update(); err != nil {
 		emitJSONError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	emitJSON(w, rt.Backends)
+	if rt == nil {
+		emitNoContent(w)
+		return
+	}
+
+	setETag(w, rt)
+	emitJSON(w, redactRoute(rt))
 }
 
 func proxyToDocker(w http.ResponseWriter, r *http.Request, ctx *Context) error {
@@ -281,31 +894,95 @@ func Handler(ctx *Context) http.Handler {
 			getRoutes(ctx, w, r, names)
 		})
 
-	r.Handle(router.Post, "/api/v1/routes",
-		func(w http.ResponseWriter, r *http.Request, names []string) {
-			postRoutes(ctx, w, r, names)
-		})
+	r.Handle(router.Post, "/api/v1/routes", audited(ctx, postRoutes))
 
 	r.Handle(router.Get, "/api/v1/routes/*",
 		func(w http.ResponseWriter, r *http.Request, names []string) {
 			getRoute(ctx, w, r, names)
 		})
 
-	r.Handle(router.Delete, "/api/v1/routes/*",
-		func(w http.ResponseWriter, r *http.Request, names []string) {
-			delRoute(ctx, w, r, names)
-		})
+	r.Handle(router.Delete, "/api/v1/routes/*", audited(ctx, delRoute))
+
+	r.Handle(router.Post, "/api/v1/routes/*/disable", audited(ctx, postDisable))
+
+	r.Handle(router.Post, "/api/v1/routes/*/enable", audited(ctx, postEnable))
 
 	r.Handle(router.Get, "/api/v1/routes/*/backends",
 		func(w http.ResponseWriter, r *http.Request, names []string) {
 			getBackends(ctx, w, r, names)
 		})
 
-	r.Handle(router.Post, "/api/v1/routes/*/backends",
+	r.Handle(router.Post, "/api/v1/routes/*/backends", audited(ctx, postBackends))
+
+	r.Handle(router.Post, "/api/v1/routes/*/paths", audited(ctx, postPaths))
+
+	r.Handle(router.Post, "/api/v1/routes/*/health", audited(ctx, postHealth))
+
+	r.Handle(router.Post, "/api/v1/routes/*/headers", audited(ctx, postHeaders))
+
+	r.Handle(router.Get, "/api/v1/routes/*/users",
 		func(w http.ResponseWriter, r *http.Request, names []string) {
-			postBackends(ctx, w, r, names)
+			getUsers(ctx, w, r, names)
 		})
 
+	r.Handle(router.Put, "/api/v1/routes/*/users/*", audited(ctx, putUser))
+
+	r.Handle(router.Delete, "/api/v1/routes/*/users/*", audited(ctx, delUser))
+
+	r.Handle(router.Post, "/api/v1/routes/*/acl", audited(ctx, postACL))
+
+	r.Handle(router.Post, "/api/v1/routes/*/limits", audited(ctx, postLimits))
+
+	r.Handle(router.Post, "/api/v1/routes/*/proxy", audited(ctx, postProxy))
+
+	r.Handle(router.Put, "/api/v1/routes/*/static", audited(ctx, putStatic))
+
+	r.Handle(router.Delete, "/api/v1/routes/*/static", audited(ctx, delStatic))
+
+	r.Handle(router.Post, "/api/v1/routes/*/maintenance", audited(ctx, postMaintenance))
+
+	r.Handle(router.Put, "/api/v1/routes/*/groups/*", audited(ctx, putGroup))
+
+	r.Handle(router.Delete, "/api/v1/routes/*/groups/*", audited(ctx, delGroup))
+
+	r.Handle(router.Post, "/api/v1/routes/*/groups/*/promote", audited(ctx, postPromote))
+
+	r.Handle(router.Post, "/api/v1/routes/*/weights", audited(ctx, postWeights))
+
+	r.Handle(router.Post, "/api/v1/routes/*/labels", audited(ctx, postLabels))
+
+	r.Handle(router.Post, "/api/v1/routes/*/annotations", audited(ctx, postAnnotations))
+
+	r.Handle(router.Post, "/api/v1/batch", audited(ctx, postBatch))
+
+	r.Handle(router.Get, "/api/v1/snapshot",
+		func(w http.ResponseWriter, r *http.Request, names []string) {
+			getSnapshot(ctx, w, r, names)
+		})
+
+	r.Handle(router.Put, "/api/v1/snapshot", audited(ctx, putSnapshot))
+
+	r.Handle(router.Get, "/api/v1/routes/*/history",
+		func(w http.ResponseWriter, r *http.Request, names []string) {
+			getHistory(ctx, w, r, names)
+		})
+
+	r.Handle(router.Post, "/api/v1/routes/*/rollback", audited(ctx, postRollback))
+
+	r.Handle(router.Get, "/api/v1/audit",
+		func(w http.ResponseWriter, r *http.Request, names []string) {
+			getAudit(ctx, w, r, names)
+		})
+
+	r.Handle(router.Get, "/api/v1/certs",
+		func(w http.ResponseWriter, r *http.Request, names []string) {
+			getCerts(ctx, w, r, names)
+		})
+
+	r.Handle(router.Put, "/api/v1/certs/*", audited(ctx, putCert))
+
+	r.Handle(router.Delete, "/api/v1/certs/*", audited(ctx, delCert))
+
 	return r.Build()
 }
 
@@ -321,6 +998,14 @@ func ListenAndServe(addr string, ctx *Context) error {
 				return
 			}
 
+			if ctx.ACME != nil &&
+				strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+				ctx.ACME.ServeHTTP(w, r)
+				return
+			}
+
+			auditDocker(ctx, r)
+
 			if err := proxyToDocker(w, r, ctx); err != nil {
 				log.Panic(err)
 			}
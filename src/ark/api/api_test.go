@@ -1,64 +1,2010 @@
 package api
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"golang.org/x/net/context"
+
 	"ark/store"
+	"ark/store/storetest"
 )
 
 type mockLoadBalancer struct {
 	count int
+	rts   []*store.Route
+	err   error
 }
 
-type mockStore struct {
-	rts map[string]*store.Route
+func (l *mockLoadBalancer) Update(rts []*store.Route, certs []*store.Certificate) error {
+	l.count++
+	l.rts = rts
+	return l.err
 }
 
-func (l *mockLoadBalancer) Update([]*store.Route) error {
-	l.count++
-	return nil
+// mockStore is an in-memory store that can be made to fail every write.
+type mockStore struct {
+	store.Store
+	err error
 }
 
 func newStore() store.Store {
+	s, err := store.Open("mem://")
+	if err != nil {
+		panic(err)
+	}
+
 	return &mockStore{
-		rts: map[string]*store.Route{},
+		Store: s,
 	}
 }
 
-func (s *mockStore) Save(r *store.Route) error {
-	s.rts[r.Name] = r
-	return nil
+func (s *mockStore) Save(r *store.Route, user string) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Store.Save(r, user)
 }
 
-func (s *mockStore) Load(name string, r *store.Route) error {
-	rt := s.rts[name]
-	if rt == nil {
-		return store.ErrNotFound
+func (s *mockStore) Delete(name, user string) error {
+	if s.err != nil {
+		return s.err
 	}
-	*r = *rt
-	return nil
+	return s.Store.Delete(name, user)
 }
 
-func (s *mockStore) LoadAll() ([]*store.Route, error) {
-	var rts []*store.Route
-	for _, rt := range s.rts {
-		rts = append(rts, rt)
+func (s *mockStore) Write(b *store.Batch, user string) error {
+	if s.err != nil {
+		return s.err
 	}
-	return rts, nil
+	return s.Store.Write(b, user)
 }
 
-func (s *mockStore) Delete(name string) error {
-	if s.rts[name] == nil {
-		return store.ErrNotFound
+func TestMockStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return newStore()
+	})
+}
+
+func TestPostRoutes(t *testing.T) {
+	lb := &mockLoadBalancer{err: errors.New("reload failed")}
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: lb,
+	}
+
+	req, err := http.NewRequest("POST", "/api/v1/routes",
+		strings.NewReader(`{"name":"foo","port":80,"hosts":["a.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed update is reported on its own, not followed by the route.
+	w := httptest.NewRecorder()
+	Handler(ctx).ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 got %d", w.Code)
+	}
+
+	if w.Header().Get("ETag") != "" || strings.Contains(w.Body.String(), `"hosts"`) {
+		t.Fatalf("expected only the error, got %s", w.Body.String())
 	}
-	delete(s.rts, name)
-	return nil
 }
 
-func (s *mockStore) Close() error {
-	return nil
+func TestRollbackTarget(t *testing.T) {
+	revs := []*store.Revision{
+		{Revision: 2},
+		{Revision: 5},
+		{Revision: 9},
+	}
+
+	if r, err := rollbackTarget(revs, 0); err != nil || r.Revision != 5 {
+		t.Fatalf("expected revision 5 got %v, %v", r, err)
+	}
+
+	if r, err := rollbackTarget(revs, 2); err != nil || r.Revision != 2 {
+		t.Fatalf("expected revision 2 got %v, %v", r, err)
+	}
+
+	if _, err := rollbackTarget(revs, 9); err == nil {
+		t.Fatal("expected error rolling back to current revision")
+	}
+
+	if _, err := rollbackTarget(revs, 7); err == nil {
+		t.Fatal("expected error rolling back to missing revision")
+	}
+
+	if _, err := rollbackTarget(revs[:1], 0); err == nil {
+		t.Fatal("expected error with no previous revision")
+	}
 }
 
-func TestPostRoutes(t *testing.T) {
-	// TODO(knorton): Test this.
+func TestRollback(t *testing.T) {
+	lb := &mockLoadBalancer{}
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: lb,
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a"},
+	}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "foo",
+		Port:  8080,
+		Hosts: []string{"b"},
+	}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(ctx)
+
+	req, err := http.NewRequest("POST", "/api/v1/routes/foo/rollback", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(UserHeader, "bob")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Port != 80 {
+		t.Fatalf("expected port 80 got %d", rt.Port)
+	}
+
+	if lb.count != 1 {
+		t.Fatalf("expected 1 update got %d", lb.count)
+	}
+
+	revs, err := ctx.Store.History("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revs) != 3 || revs[2].User != "bob" {
+		t.Fatalf("expected rollback recorded as bob, got %v", revs)
+	}
+}
+
+func TestRollbackValidates(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "foo", Port: 80, Hosts: []string{"a"}},
+		{Name: "foo", Port: 80, Hosts: []string{"b"}},
+		{Name: "bar", Port: 80, Hosts: []string{"a"}},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	rollback := func(etag string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/api/v1/routes/foo/rollback", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// bar has claimed a since foo gave it up.
+	if w := rollback(""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	if err := ctx.Store.Delete("bar", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := rollback(`"1"`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status 412 got %d", w.Code)
+	}
+
+	if w := rollback(`"2"`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.Hosts) != 1 || rt.Hosts[0] != "a" {
+		t.Fatalf("expected foo to be rolled back to a, got %v", &rt)
+	}
+}
+
+func postBatchOps(t *testing.T, h http.Handler, ops []*batchOp) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(ops); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/v1/batch", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestBatch(t *testing.T) {
+	lb := &mockLoadBalancer{}
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: lb,
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(ctx)
+
+	w := postBatchOps(t, h, []*batchOp{
+		{Op: batchCreate, Route: &store.Route{Name: "bar", Port: 80, Hosts: []string{"b"}}},
+		{Op: batchCreate, Route: &store.Route{Name: "baz", Port: 80, Hosts: []string{"c"}}},
+		{Op: batchDelete, Name: "foo"},
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if lb.count != 1 {
+		t.Fatalf("expected 1 update got %d", lb.count)
+	}
+
+	rts, err := ctx.Store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 2 {
+		t.Fatalf("expected 2 routes got %d", len(rts))
+	}
+
+	// an invalid op rejects the whole batch without touching the store.
+	w = postBatchOps(t, h, []*batchOp{
+		{Op: batchDelete, Name: "bar"},
+		{Op: batchDelete, Name: "foo"},
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if lb.count != 1 {
+		t.Fatalf("expected 1 update got %d", lb.count)
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("bar", &rt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	lb := &mockLoadBalancer{}
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: lb,
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	lb.err = errors.New("nginx is unhappy")
+
+	w := postBatchOps(t, Handler(ctx), []*batchOp{
+		{Op: batchCreate, Route: &store.Route{Name: "foo", Port: 8080, Hosts: []string{"a"}}},
+		{Op: batchCreate, Route: &store.Route{Name: "bar", Port: 80, Hosts: []string{"b"}}},
+	})
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Port != 80 {
+		t.Fatalf("expected port 80 got %d", rt.Port)
+	}
+
+	if err := ctx.Store.Load("bar", &rt); err != store.ErrNotFound {
+		t.Fatalf("expected bar to be rolled back, got %v", err)
+	}
+}
+
+func putSnapshotJSON(t *testing.T, h http.Handler, uri string, sn *store.Snapshot) (*httptest.ResponseRecorder, *store.Diff) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(sn); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("PUT", uri, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var d store.Diff
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return w, &d
+}
+
+func TestPutSnapshot(t *testing.T) {
+	lb := &mockLoadBalancer{}
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: lb,
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(ctx)
+
+	sn := &store.Snapshot{
+		Version: store.SnapshotVersion,
+		Routes: []*store.Route{
+			{Name: "bar", Port: 80, Hosts: []string{"b"}},
+		},
+	}
+
+	w, d := putSnapshotJSON(t, h, "/api/v1/snapshot?dry_run=1", sn)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if len(d.Added) != 1 || len(d.Removed) != 1 || lb.count != 0 {
+		t.Fatalf("expected dry run diff with no update, got %v (%d updates)", d, lb.count)
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatalf("expected dry run to leave foo: %s", err)
+	}
+
+	lb.err = errors.New("nginx is unhappy")
+	if w, _ := putSnapshotJSON(t, h, "/api/v1/snapshot", sn); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatalf("expected failed restore to be rolled back: %s", err)
+	}
+
+	lb.err = nil
+	if w, _ := putSnapshotJSON(t, h, "/api/v1/snapshot", sn); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	rts, err := ctx.Store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 || rts[0].Name != "bar" {
+		t.Fatalf("expected only bar got %v", rts)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	h := Handler(ctx)
+
+	post := func(rt *store.Route, etag string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(rt); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/v1/routes", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(&store.Route{Name: "foo", Port: 80, Hosts: []string{"a"}}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+
+	w = post(&store.Route{Name: "foo", Port: 81, Hosts: []string{"a"}}, etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the first etag is now stale.
+	w = post(&store.Route{Name: "foo", Port: 82, Hosts: []string{"a"}}, etag)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status 412 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Port != 81 {
+		t.Fatalf("expected port 81 got %d", rt.Port)
+	}
+
+	req, err := http.NewRequest("DELETE", "/api/v1/routes/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Match", etag)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status 412 got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAudit(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	h := Handler(ctx)
+
+	req, err := http.NewRequest("POST", "/api/v1/routes",
+		strings.NewReader(`{"name":"foo","port":80,"hosts":["a"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(UserHeader, "alice")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("DELETE", "/api/v1/routes/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(UserHeader, "bob")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("DELETE", "/api/v1/routes/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(UserHeader, "bob")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("GET", "/api/v1/audit?user=bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var es []*store.AuditEntry
+	if err := json.NewDecoder(w.Body).Decode(&es); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(es) != 2 {
+		t.Fatalf("expected 2 entries for bob got %d", len(es))
+	}
+
+	del := es[0]
+	if del.Method != "DELETE" || del.Status != http.StatusNoContent || len(del.Changes) != 1 {
+		t.Fatalf("unexpected audit entry: %v", del)
+	}
+
+	if c := del.Changes[0]; c.Name != "foo" || c.Before == nil || c.After != nil {
+		t.Fatalf("expected before value only for delete, got %v", c)
+	}
+
+	if es[1].Status != http.StatusNotFound || len(es[1].Changes) != 0 {
+		t.Fatalf("expected failed delete with no changes, got %v", es[1])
+	}
+
+	es, err = ctx.Store.AuditLog(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(es) != 3 || es[0].User != "alice" || es[0].Changes[0].After.Port != 80 {
+		t.Fatalf("expected create by alice first, got %v", es)
+	}
+
+	// the filter finds matches that are older than the most recent limit
+	// entries.
+	req, err = http.NewRequest("GET", "/api/v1/audit?user=alice&limit=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	es = nil
+	if err := json.NewDecoder(w.Body).Decode(&es); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(es) != 1 || es[0].User != "alice" {
+		t.Fatalf("expected the entry by alice, got %v", es)
+	}
+}
+
+func TestHostClaims(t *testing.T) {
+	s := newStore()
+	if err := s.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a.com", "b.com"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateRoute(s, &store.Route{
+		Name:  "bar",
+		Port:  80,
+		Hosts: []string{"c.com", "b.com"},
+	}); err == nil {
+		t.Fatal("expected error claiming b.com:80 twice")
+	}
+
+	if err := validateRoute(s, &store.Route{
+		Name:  "bar",
+		Port:  8080,
+		Hosts: []string{"b.com"},
+	}); err != nil {
+		t.Fatalf("expected b.com:8080 to be available: %s", err)
+	}
+
+	if err := validateRoute(s, &store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a.com"},
+	}); err != nil {
+		t.Fatalf("expected route to be able to keep its own hosts: %s", err)
+	}
+
+	// a batch can move a host from one route to another.
+	st := newBatchState(s, "")
+	var b store.Batch
+	for _, op := range []*batchOp{
+		{Op: batchDelete, Name: "foo"},
+		{Op: batchCreate, Route: &store.Route{Name: "bar", Port: 80, Hosts: []string{"a.com"}}},
+	} {
+		if err := st.apply(context.Background(), op, &b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := st.apply(context.Background(), &batchOp{
+		Op:    batchCreate,
+		Route: &store.Route{Name: "baz", Port: 80, Hosts: []string{"a.com"}},
+	}, &b); err == nil {
+		t.Fatal("expected error claiming a.com:80 within a batch")
+	}
+}
+
+func TestRouteNames(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, name := range []string{"\x00schema", "\x00auditid", "a\x00b", "a/b", ".a"} {
+		if err := validateRoute(ctx.Store, &store.Route{
+			Name:  name,
+			Port:  80,
+			Hosts: []string{"a.com"},
+		}); err == nil {
+			t.Fatalf("expected error for name %q", name)
+		}
+	}
+
+	req, err := http.NewRequest("POST", "/api/v1/routes",
+		strings.NewReader(`{"name":"\u0000auditid","port":80,"hosts":["a.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	Handler(ctx).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	// the audit log is still readable.
+	if _, err := ctx.Store.AuditLog(0, 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a.com"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(ctx)
+
+	post := func(rules []*store.PathRule) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(rules); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/v1/routes/foo/paths", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, rules := range [][]*store.PathRule{
+		{{Path: "api", Backends: []string{"10.0.0.1:80"}}},
+		{{Path: "/", Backends: []string{"10.0.0.1:80"}}},
+		{{Path: "/api"}},
+		{{Match: "glob", Path: "/api", Backends: []string{"10.0.0.1:80"}}},
+		{{Match: store.MatchRegex, Path: "^/a;b", Backends: []string{"10.0.0.1:80"}}},
+		{{Match: store.MatchRegex, Path: "(", Backends: []string{"10.0.0.1:80"}}},
+		{{Match: store.MatchRegex, Path: "[a-", Backends: []string{"10.0.0.1:80"}}},
+		{{Match: store.MatchRegex, Path: `\.png\`, Backends: []string{"10.0.0.1:80"}}},
+		{
+			{Path: "/api", Backends: []string{"10.0.0.1:80"}},
+			{Match: store.MatchPrefix, Path: "/api", Backends: []string{"10.0.0.2:80"}},
+		},
+	} {
+		if w := post(rules); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %v got %d", rules, w.Code)
+		}
+	}
+
+	if err := validateRoute(ctx.Store, &store.Route{
+		Name:  "bar",
+		Port:  80,
+		Hosts: []string{"b.com"},
+		Paths: []*store.PathRule{
+			{Match: store.MatchRegex, Path: `^/(a|b`, Backends: []string{"10.0.0.1:80"}},
+		},
+	}); err == nil {
+		t.Fatal("expected error for an invalid regex path")
+	}
+
+	w := post([]*store.PathRule{
+		{Match: store.MatchExact, Path: "/api", Backends: []string{"10.0.0.1:80"}},
+		{Path: "/api", Backends: []string{"10.0.0.2:80"}},
+		{Match: store.MatchRegex, Path: `\.png$`, Backends: []string{"10.0.0.3:80"}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.Paths) != 3 || rt.Paths[2].Path != `\.png$` {
+		t.Fatalf("expected 3 path rules in order, got %v", rt.Paths)
+	}
+
+	rts, err := ctx.Store.Find(&store.Query{Backend: "10.0.0.2:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 || rts[0].Name != "foo" {
+		t.Fatalf("expected foo to be found by a path backend, got %v", rts)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:     "foo",
+		Port:     80,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.1:80"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(ctx)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/api/v1/routes/foo/health",
+			bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, body := range []string{
+		`{"path": "health"}`,
+		`{"interval": -1}`,
+		`{"fall": -2}`,
+	} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s got %d", body, w.Code)
+		}
+	}
+
+	if w := post(`{"path": "/health", "interval": 5}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if hc := rt.HealthCheck; hc == nil || hc.Path != "/health" || hc.Interval != 5 {
+		t.Fatalf("unexpected health check: %v", hc)
+	}
+
+	if w := post(`null`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.HealthCheck != nil {
+		t.Fatalf("expected health check to be removed, got %v", rt.HealthCheck)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "web",
+		Port:  80,
+		Hosts: []string{"a.com"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:     "pg",
+		Port:     5432,
+		Protocol: store.ProtocolTCP,
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "x", Port: 6379, Protocol: "sctp"},
+		{Name: "x", Port: 6379, Protocol: store.ProtocolTCP, Hosts: []string{"b.com"}},
+		{Name: "x", Port: 6379, Protocol: store.ProtocolTCP, Cert: "x"},
+		{Name: "x", Port: 6379, Protocol: store.ProtocolTCP, Balance: store.BalanceHash, HashHeader: "X"},
+		{Name: "x", Port: 6379, Protocol: store.ProtocolUDP, HealthCheck: &store.HealthCheck{}},
+		{Name: "x", Port: 6379, Protocol: store.ProtocolTCP, HealthCheck: &store.HealthCheck{Path: "/"}},
+		{
+			Name:     "x",
+			Port:     6379,
+			Protocol: store.ProtocolTCP,
+			Paths:    []*store.PathRule{{Path: "/a", Backends: []string{"10.0.0.1:80"}}},
+		},
+
+		// ports that are claimed on the same transport.
+		{Name: "x", Port: 80, Protocol: store.ProtocolTCP},
+		{Name: "x", Port: 5432, Protocol: store.ProtocolTCP},
+		{Name: "x", Port: 5432, Hosts: []string{"b.com"}},
+	} {
+		if err := validateRoute(ctx.Store, rt); err == nil {
+			t.Fatalf("expected error for %v", rt)
+		}
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "x", Port: 6379, Protocol: store.ProtocolTCP, Balance: store.BalanceIPHash},
+		{Name: "x", Port: 80, Protocol: store.ProtocolUDP},
+		{Name: "x", Port: 5432, Protocol: store.ProtocolUDP},
+		{Name: "pg", Port: 5432, Protocol: store.ProtocolTCP, HealthCheck: &store.HealthCheck{}},
+	} {
+		if err := validateRoute(ctx.Store, rt); err != nil {
+			t.Fatalf("unexpected error for %v: %s", rt, err)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "web",
+		Port:  80,
+		Hosts: []string{"a.com"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	redirect := func(to string) *store.Redirect {
+		return &store.Redirect{To: to}
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "x", Port: 80, Hosts: []string{"b.com"}, Redirect: redirect("/b")},
+		{Name: "x", Port: 80, Hosts: []string{"b.com"}, Redirect: redirect("ftp://b.com")},
+		{Name: "x", Port: 80, Hosts: []string{"b.com"}, Redirect: redirect("https://b.com/$host")},
+		{Name: "x", Port: 80, Hosts: []string{"b.com"}, Redirect: redirect("https://b.com;")},
+		{
+			Name:     "x",
+			Port:     80,
+			Hosts:    []string{"b.com"},
+			Redirect: &store.Redirect{To: "https://b.com", Code: 200},
+		},
+		{
+			Name:     "x",
+			Port:     80,
+			Hosts:    []string{"b.com"},
+			Redirect: &store.Redirect{To: "https://b.com/?a=b", PreservePath: true},
+		},
+		{
+			Name:     "x",
+			Port:     80,
+			Hosts:    []string{"b.com"},
+			Backends: []string{"10.0.0.1:80"},
+			Redirect: redirect("https://b.com"),
+		},
+
+		// force_https needs tls and port 80 for its hosts.
+		{Name: "x", Port: 443, Hosts: []string{"b.com"}, ForceHttps: true},
+		{Name: "x", Port: 80, Hosts: []string{"b.com"}, Tls: store.TLSAuto, ForceHttps: true},
+		{Name: "x", Port: 443, Hosts: []string{"a.com"}, Tls: store.TLSAuto, ForceHttps: true},
+	} {
+		if err := validateRoute(ctx.Store, rt); err == nil {
+			t.Fatalf("expected error for %v", rt)
+		}
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "x", Port: 80, Hosts: []string{"www.a.com"}, Redirect: redirect("https://a.com")},
+		{
+			Name:     "x",
+			Port:     80,
+			Hosts:    []string{"www.a.com"},
+			Redirect: &store.Redirect{To: "https://a.com/", Code: 308, PreservePath: true},
+		},
+		{Name: "x", Port: 443, Hosts: []string{"b.com"}, Tls: store.TLSAuto, ForceHttps: true},
+	} {
+		if err := validateRoute(ctx.Store, rt); err != nil {
+			t.Fatalf("unexpected error for %v: %s", rt, err)
+		}
+	}
+
+	// a route that forces https claims port 80 for its hosts.
+	if err := ctx.Store.Save(&store.Route{
+		Name:       "secure",
+		Port:       443,
+		Hosts:      []string{"b.com"},
+		Tls:        store.TLSAuto,
+		ForceHttps: true,
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateRoute(ctx.Store, &store.Route{
+		Name:  "x",
+		Port:  80,
+		Hosts: []string{"b.com"},
+	}); err == nil {
+		t.Fatal("expected port 80 to be claimed by route that forces https")
+	}
+}
+
+func TestSubresourceValidation(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "dns", Port: 53, Protocol: store.ProtocolUDP},
+		{
+			Name:     "www",
+			Port:     80,
+			Hosts:    []string{"www.a.com"},
+			Redirect: &store.Redirect{To: "https://a.com"},
+		},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	post := func(uri, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", uri, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("/api/v1/routes/dns/health", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	if w := post("/api/v1/routes/www/backends", `["10.0.0.1:80"]`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	w := postBatchOps(t, h, []*batchOp{
+		{Op: batchBackends, Name: "www", Backends: []string{"10.0.0.1:80"}},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	if err := ctx.Store.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a.com"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(ctx)
+
+	post := func(rules []*store.HeaderRule) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(rules); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/v1/routes/foo/headers", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, rules := range [][]*store.HeaderRule{
+		{{Direction: "both", Action: store.HeaderSet, Name: "X-A", Value: "a"}},
+		{{Direction: store.HeaderRequest, Action: "append", Name: "X-A", Value: "a"}},
+		{{Direction: store.HeaderRequest, Action: store.HeaderAdd, Name: "X-A", Value: "a"}},
+		{{Direction: store.HeaderRequest, Action: store.HeaderSet, Name: "X A", Value: "a"}},
+		{{Direction: store.HeaderRequest, Action: store.HeaderSet, Name: "X-A", Value: `a";`}},
+		{{Direction: store.HeaderRequest, Action: store.HeaderSet, Name: "X-A", Value: "$host"}},
+		{{Direction: store.HeaderRequest, Action: store.HeaderSet, Name: "X-A", Value: "a\nb"}},
+		{{Direction: store.HeaderRequest, Action: store.HeaderRemove, Name: "X-A", Value: "a"}},
+		{{Direction: store.HeaderResponse, Action: store.HeaderSet, Name: "Server", Value: "a"}},
+		{
+			{Direction: store.HeaderResponse, Action: store.HeaderSet, Name: "X-A", Value: "a"},
+			{Direction: store.HeaderResponse, Action: store.HeaderRemove, Name: "x-a"},
+		},
+	} {
+		if w := post(rules); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %v got %d", rules, w.Code)
+		}
+	}
+
+	w := post([]*store.HeaderRule{
+		{
+			Direction: store.HeaderResponse,
+			Action:    store.HeaderSet,
+			Name:      "Strict-Transport-Security",
+			Value:     "max-age=31536000; includeSubDomains",
+		},
+		{Direction: store.HeaderResponse, Action: store.HeaderAdd, Name: "Link", Value: "</a.css>"},
+		{Direction: store.HeaderResponse, Action: store.HeaderAdd, Name: "Link", Value: "</b.css>"},
+		{Direction: store.HeaderResponse, Action: store.HeaderRemove, Name: "Server"},
+		{Direction: store.HeaderRequest, Action: store.HeaderSet, Name: "X-A", Value: "a"},
+		{Direction: store.HeaderResponse, Action: store.HeaderSet, Name: "X-A", Value: "a"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.Headers) != 6 {
+		t.Fatalf("expected 6 header rules got %d", len(rt.Headers))
+	}
+}
+
+func TestAccess(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "dash", Port: 80, Hosts: []string{"dash.a.com"}},
+		{Name: "pg", Port: 5432, Protocol: store.ProtocolTCP},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	send := func(method, uri, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, uri, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, c := range []struct {
+		method, uri, body string
+	}{
+		{"PUT", "/api/v1/routes/dash/users/bob", `{}`},
+		{"PUT", "/api/v1/routes/dash/users/a:b", `{"password": "x"}`},
+		{"PUT", "/api/v1/routes/pg/users/bob", `{"password": "x"}`},
+		{"DELETE", "/api/v1/routes/dash/users/nobody", ``},
+		{"POST", "/api/v1/routes/dash/acl", `[{"action": "permit", "source": "all"}]`},
+		{"POST", "/api/v1/routes/dash/acl", `[{"action": "allow", "source": "10.0.0.0/33"}]`},
+		{"POST", "/api/v1/routes/dash/acl", `[{"action": "allow", "source": "10.0.0.1; deny"}]`},
+	} {
+		if w := send(c.method, c.uri, c.body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s %s got %d", c.method, c.uri, w.Code)
+		}
+	}
+
+	if w := send("PUT", "/api/v1/routes/dash/users/bob", `{"password": "secret"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := send("POST", "/api/v1/routes/dash/acl",
+		`[{"action": "allow", "source": "10.0.0.0/8"}, {"action": "deny", "source": "all"}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("dash", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Access == nil || len(rt.Access.Users) != 1 || len(rt.Access.Rules) != 2 {
+		t.Fatalf("unexpected access: %v", rt.Access)
+	}
+
+	hash := rt.Access.Users[0].Hash
+	if !strings.HasPrefix(hash, "{SSHA}") {
+		t.Fatalf("expected password to be stored hashed, got %s", hash)
+	}
+
+	// hashes are only returned in backups.
+	for _, uri := range []string{
+		"/api/v1/routes",
+		"/api/v1/routes/dash",
+		"/api/v1/routes/dash/history",
+		"/api/v1/audit",
+	} {
+		if w := send("GET", uri, ``); strings.Contains(w.Body.String(), hash) {
+			t.Fatalf("GET %s revealed a password hash", uri)
+		}
+	}
+
+	if w := send("GET", "/api/v1/snapshot", ``); !strings.Contains(w.Body.String(), hash) {
+		t.Fatal("expected the backup to include password hashes")
+	}
+
+	// a route that was read from the api can be sent back without its hashes.
+	w = send("GET", "/api/v1/routes/dash", ``)
+	if w := send("POST", "/api/v1/routes", w.Body.String()); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	} else if strings.Contains(w.Body.String(), hash) {
+		t.Fatal("POST /api/v1/routes revealed a password hash")
+	}
+
+	if err := ctx.Store.Load("dash", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Access.Users[0].Hash != hash {
+		t.Fatal("expected the password hash to be kept")
+	}
+
+	if w := send("DELETE", "/api/v1/routes/dash/users/bob", ``); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := send("POST", "/api/v1/routes/dash/acl", `[]`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := ctx.Store.Load("dash", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Access != nil {
+		t.Fatalf("expected access to be cleared, got %v", rt.Access)
+	}
+
+	// streams can restrict clients by address.
+	w = send("POST", "/api/v1/routes/pg/acl", `[{"action": "allow", "source": "10.0.0.0/8"}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "web", Port: 80, Hosts: []string{"a.com"}},
+		{Name: "pg", Port: 5432, Protocol: store.ProtocolTCP},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	post := func(name, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST",
+			fmt.Sprintf("/api/v1/routes/%s/limits", name),
+			bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, c := range []struct {
+		name, body string
+	}{
+		{"web", `{"rate": -1}`},
+		{"web", `{"burst": 10}`},
+		{"web", `{"rate": 10, "key_header": "X Key"}`},
+		{"pg", `{"rate": 10}`},
+		{"pg", `{"connections": 10, "key_header": "X-Key"}`},
+	} {
+		if w := post(c.name, c.body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s got %d", c.body, w.Code)
+		}
+	}
+
+	for _, c := range []struct {
+		name, body string
+	}{
+		{"web", `{"rate": 10, "burst": 20, "connections": 5, "key_header": "X-Api-Key"}`},
+		{"pg", `{"connections": 10}`},
+	} {
+		if w := post(c.name, c.body); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s got %d: %s", c.body, w.Code, w.Body.String())
+		}
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("web", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := rt.Limits; l == nil || l.Rate != 10 || l.Burst != 20 || l.KeyHeader != "X-Api-Key" {
+		t.Fatalf("unexpected limits: %v", l)
+	}
+}
+
+func TestProxyOptions(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "web", Port: 80, Hosts: []string{"a.com"}},
+		{Name: "pg", Port: 5432, Protocol: store.ProtocolTCP},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	post := func(name, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST",
+			fmt.Sprintf("/api/v1/routes/%s/proxy", name),
+			bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, c := range []struct {
+		name, body string
+	}{
+		{"web", `{"connect_timeout": 76}`},
+		{"web", `{"read_timeout": -1}`},
+		{"web", `{"send_timeout": 86401}`},
+		{"web", `{"max_body_size": 10241}`},
+		{"pg", `{"websocket": true}`},
+		{"pg", `{"max_body_size": 10}`},
+	} {
+		if w := post(c.name, c.body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s got %d", c.body, w.Code)
+		}
+	}
+
+	for _, c := range []struct {
+		name, body string
+	}{
+		{"web", `{"websocket": true, "disable_buffering": true, "max_body_size": 100}`},
+		{"pg", `{"connect_timeout": 5, "read_timeout": 600}`},
+	} {
+		if w := post(c.name, c.body); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s got %d: %s", c.body, w.Code, w.Body.String())
+		}
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("web", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if o := rt.Proxy; o == nil || !o.Websocket || o.ReadTimeoutOrDefault() != store.StreamingReadTimeout {
+		t.Fatalf("unexpected proxy options: %v", o)
+	}
+
+	if w := post("web", `null`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := ctx.Store.Load("web", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Proxy != nil {
+		t.Fatalf("expected proxy options to be removed, got %v", rt.Proxy)
+	}
+}
+
+// tarball builds a gzipped tarball holding the given files.
+func tarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0644,
+			Size: int64(len(body)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+		StaticDir:    filepath.Join(dir, "static"),
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "site", Port: 80, Hosts: []string{"a.com"}},
+		{Name: "web", Port: 80, Hosts: []string{"b.com"}, Backends: []string{"10.0.0.1:80"}},
+		{Name: "pg", Port: 5432, Protocol: store.ProtocolTCP, Backends: []string{"10.0.0.1:5432"}},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	send := func(method, name string, body []byte) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method,
+			fmt.Sprintf("/api/v1/routes/%s/static", name),
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, name := range []string{"web", "pg"} {
+		if w := send("PUT", name, tarball(t, map[string]string{"index.html": "hi"})); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s got %d", name, w.Code)
+		}
+	}
+
+	if w := send("PUT", "site", []byte("not a tarball")); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	v1 := tarball(t, map[string]string{
+		"index.html":       "v1",
+		"../../escape.txt": "nope",
+	})
+	w := send("PUT", "site", v1)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var s store.Static
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("site", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Static == nil || rt.Static.Digest != s.Digest {
+		t.Fatalf("expected digest %s got %v", s.Digest, rt.Static)
+	}
+
+	root := rt.StaticRoot(ctx.StaticDir)
+	if b, err := ioutil.ReadFile(filepath.Join(root, "index.html")); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "v1" {
+		t.Fatalf("expected v1 got %s", b)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatalf("expected escaping entry to be kept inside root: %s", err)
+	}
+
+	if w := send("PUT", "site", tarball(t, map[string]string{"index.html": "v2"})); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d", w.Code)
+	}
+
+	// content in the history of a route is kept so that it can be rolled back.
+	if _, err := os.Stat(root); err != nil {
+		t.Fatalf("expected %s to be kept: %s", root, err)
+	}
+
+	rollback := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/api/v1/routes/site/rollback", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := rollback(); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := ctx.Store.Load("site", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Static == nil || rt.Static.Digest != s.Digest {
+		t.Fatalf("expected rollback to digest %s got %v", s.Digest, rt.Static)
+	}
+
+	if w := send("DELETE", "site", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 got %d", w.Code)
+	}
+
+	if w := send("DELETE", "site", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	// content that is gone cannot be rolled back to.
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := rollback(); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for missing content got %d", w.Code)
+	}
+
+	// the content of a deleted route is pruned.
+	if err := ctx.Store.Delete("site", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.Store.Save(&store.Route{Name: "blog", Port: 80, Hosts: []string{"c.com"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := send("PUT", "blog", tarball(t, map[string]string{"index.html": "blog"})); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	fis, err := ioutil.ReadDir(ctx.StaticDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fis) != 1 {
+		t.Fatalf("expected only the content of blog, got %d entries", len(fis))
+	}
+
+	if err := ctx.Store.Load("blog", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	// routes may only be written with content that is still there.
+	post := func(uri string, v interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", uri, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	gone := &store.Route{Name: "copy", Port: 80, Hosts: []string{"d.com"}, Static: &s}
+	if w := post("/api/v1/routes", gone); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for missing content got %d", w.Code)
+	}
+
+	if w := post("/api/v1/batch", []*batchOp{{Op: batchCreate, Route: gone}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for missing content got %d", w.Code)
+	}
+
+	ok := &store.Route{Name: "copy", Port: 80, Hosts: []string{"d.com"}, Static: rt.Static}
+	if w := post("/api/v1/batch", []*batchOp{{Op: batchCreate, Route: ok}}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	ok.Hosts = []string{"e.com"}
+	if w := post("/api/v1/routes", ok); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "web", Port: 80, Hosts: []string{"a.com"}, Backends: []string{"10.0.0.1:80"}},
+		{Name: "pg", Port: 5432, Protocol: store.ProtocolTCP, Backends: []string{"10.0.0.1:5432"}},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	post := func(name string, m *store.Maintenance) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(m); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST",
+			fmt.Sprintf("/api/v1/routes/%s/maintenance", name),
+			&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("pg", &store.Maintenance{Enabled: true}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	if w := post("web", &store.Maintenance{
+		Enabled: true,
+		Page:    strings.Repeat("x", maxMaintenancePage+1),
+	}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	for _, enabled := range []bool{true, false} {
+		if w := post("web", &store.Maintenance{Enabled: enabled, Page: "down"}); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+		}
+
+		var rt store.Route
+		if err := ctx.Store.Load("web", &rt); err != nil {
+			t.Fatal(err)
+		}
+
+		if rt.InMaintenance() != enabled || rt.Maintenance.Page != "down" {
+			t.Fatalf("expected enabled=%t page=down got %v", enabled, rt.Maintenance)
+		}
+	}
+
+	if w := post("web", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d", w.Code)
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("web", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Maintenance != nil {
+		t.Fatalf("expected no maintenance got %v", rt.Maintenance)
+	}
+}
+
+func TestDisable(t *testing.T) {
+	lb := &mockLoadBalancer{}
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: lb,
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "a", Port: 80, Hosts: []string{"a.com"}, Backends: []string{"10.0.0.1:80"}},
+		{Name: "b", Port: 80, Hosts: []string{"b.com"}, Backends: []string{"10.0.0.2:80"}},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	post := func(uri string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	served := func() []string {
+		var names []string
+		for _, rt := range lb.rts {
+			names = append(names, rt.Name)
+		}
+		return names
+	}
+
+	if w := post("/api/v1/routes/c/disable"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 got %d", w.Code)
+	}
+
+	if w := post("/api/v1/routes/a/disable"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("a", &rt); err != nil {
+		t.Fatal(err)
+	} else if !rt.Disabled || len(rt.Backends) != 1 || len(rt.Hosts) != 1 {
+		t.Fatalf("expected disabled route to be kept, got %v", &rt)
+	}
+
+	if names := served(); len(names) != 1 || names[0] != "b" {
+		t.Fatalf("expected only b to be served got %v", names)
+	}
+
+	// a disabled route keeps its claim on its hosts.
+	if err := validateRoute(ctx.Store, &store.Route{
+		Name:  "c",
+		Port:  80,
+		Hosts: []string{"a.com"},
+	}); err == nil {
+		t.Fatal("expected error claiming the host of a disabled route")
+	}
+
+	if w := post("/api/v1/routes/a/enable"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if names := served(); len(names) != 2 {
+		t.Fatalf("expected both routes to be served got %v", names)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "a", Port: 80, Hosts: []string{"a.com"}, Labels: map[string]string{"env": "staging"}},
+		{Name: "b", Port: 80, Hosts: []string{"b.com"}, Labels: map[string]string{"env": "staging"}},
+		{Name: "c", Port: 80, Hosts: []string{"c.com"}, Labels: map[string]string{"env": "prod"}},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	post := func(uri, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", uri, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	list := func(sel string) string {
+		req, err := http.NewRequest("GET", "/api/v1/routes?selector="+sel, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s got %d", sel, w.Code)
+		}
+
+		var rts []*store.Route
+		if err := json.NewDecoder(w.Body).Decode(&rts); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, rt := range rts {
+			names = append(names, rt.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for _, c := range []struct {
+		uri, body string
+	}{
+		{"/api/v1/routes/a/labels", `{"te am": "web"}`},
+		{"/api/v1/routes/a/labels", `{"team": "not valid"}`},
+		{"/api/v1/routes/a/annotations", `{"": "x"}`},
+		{"/api/v1/routes/a/annotations", fmt.Sprintf(`{"notes": "%s"}`,
+			strings.Repeat("x", maxAnnotations))},
+	} {
+		if w := post(c.uri, c.body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s got %d", c.uri, w.Code)
+		}
+	}
+
+	if w := post("/api/v1/routes/a/labels", `{"env": "staging", "team": "web"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := post("/api/v1/routes/a/annotations",
+		`{"example.com/ticket": "https://tickets/1 see notes"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	for sel, expected := range map[string]string{
+		"":                  "a,b,c",
+		"env=staging":       "a,b",
+		"team=web":          "a",
+		"env%21%3Dstaging":  "c",
+		"env=staging,!team": "b",
+	} {
+		if names := list(sel); names != expected {
+			t.Fatalf("expected %s for %s got %s", expected, sel, names)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/api/v1/routes?selector=te+am", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	if w := postBatchOps(t, h, []*batchOp{
+		{Op: batchDisable, Name: "a", Selector: "env=staging"},
+	}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
+
+	if w := postBatchOps(t, h, []*batchOp{
+		{Op: batchDisable, Selector: "env=staging"},
+	}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	for name, disabled := range map[string]bool{"a": true, "b": true, "c": false} {
+		var rt store.Route
+		if err := ctx.Store.Load(name, &rt); err != nil {
+			t.Fatal(err)
+		}
+
+		if rt.Disabled != disabled {
+			t.Fatalf("expected %s disabled=%t", name, disabled)
+		}
+	}
+
+	// later ops in a batch select on the labels set by earlier ones.
+	c := &store.Route{
+		Name:   "c",
+		Port:   80,
+		Hosts:  []string{"c.com"},
+		Labels: map[string]string{"env": "staging"},
+	}
+	if w := postBatchOps(t, h, []*batchOp{
+		{Op: batchCreate, Route: c},
+		{Op: batchDelete, Selector: "env=staging"},
+	}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if names := list(""); names != "" {
+		t.Fatalf("expected every route to be deleted, got %s", names)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "web", Port: 80, Hosts: []string{"a.com"}, Backends: []string{"10.0.0.1:80"}},
+		{Name: "bare", Port: 80, Hosts: []string{"b.com"}},
+		{Name: "pg", Port: 5432, Protocol: store.ProtocolTCP, Backends: []string{"10.0.0.1:5432"}},
+	} {
+		if err := ctx.Store.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Handler(ctx)
+
+	send := func(method, uri, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, uri, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, c := range []struct {
+		method, uri, body string
+	}{
+		{"PUT", "/api/v1/routes/pg/groups/v2", `{"backends": ["10.0.0.2:5432"]}`},
+		{"PUT", "/api/v1/routes/bare/groups/v2", `{"backends": ["10.0.0.2:80"]}`},
+		{"PUT", "/api/v1/routes/web/groups/v2", `{"backends": []}`},
+		{"PUT", "/api/v1/routes/web/groups/v%202", `{"backends": ["10.0.0.2:80"]}`},
+		{"PUT", "/api/v1/routes/web/groups/v2", `{"backends": ["10.0.0.2:80"], "weight": 101}`},
+		{"POST", "/api/v1/routes/web/weights", `{"v2": 5}`},
+		{"POST", "/api/v1/routes/web/groups/v2/promote", ``},
+	} {
+		if w := send(c.method, c.uri, c.body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s %s got %d", c.method, c.uri, w.Code)
+		}
+	}
+
+	for _, c := range []struct {
+		method, uri, body string
+	}{
+		{"PUT", "/api/v1/routes/web/groups/v2", `{"backends": ["10.0.0.2:80"], "weight": 60}`},
+		{"PUT", "/api/v1/routes/web/groups/v3", `{"backends": ["10.0.0.3:80"]}`},
+	} {
+		if w := send(c.method, c.uri, c.body); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s got %d: %s", c.uri, w.Code, w.Body.String())
+		}
+	}
+
+	if w := send("POST", "/api/v1/routes/web/weights", `{"v3": 50}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected weights over 100 to fail, got %d", w.Code)
+	}
+
+	if w := send("POST", "/api/v1/routes/web/weights", `{"v2": 0, "v3": 100}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var rt store.Route
+	if err := ctx.Store.Load("web", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Group("v2").Weight != 0 || rt.Group("v3").Weight != 100 || rt.DefaultWeight() != 0 {
+		t.Fatalf("unexpected weights: %v", rt.Groups)
+	}
+
+	// a put without a weight keeps the weight of the group.
+	if w := send("PUT", "/api/v1/routes/web/groups/v3", `{"backends": ["10.0.0.4:80"]}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d", w.Code)
+	}
+
+	if w := send("POST", "/api/v1/routes/web/groups/v3/promote", ``); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := ctx.Store.Load("web", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.Backends) != 1 || rt.Backends[0] != "10.0.0.4:80" ||
+		len(rt.Groups) != 1 || rt.Groups[0].Name != "v2" {
+		t.Fatalf("expected v3 to be promoted, got %v", &rt)
+	}
+
+	if w := send("DELETE", "/api/v1/routes/web/groups/v2", ``); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 got %d", w.Code)
+	}
+
+	if w := send("DELETE", "/api/v1/routes/web/groups/v2", ``); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d", w.Code)
+	}
 }
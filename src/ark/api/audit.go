@@ -0,0 +1,225 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"ark/store"
+)
+
+// defaultAuditLimit is the number of entries returned by GET /api/v1/audit
+// when the request does not specify a limit.
+const defaultAuditLimit = 100
+
+// auditStore is a Store that remembers the changes written through it so
+// they can be recorded in the audit log along with the request that made
+// them.
+type auditStore struct {
+	store.Store
+
+	lck     sync.Mutex
+	changes []*store.AuditEntry_Change
+}
+
+func (s *auditStore) record(revs []*store.Revision) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	for _, rev := range revs {
+		c := &store.AuditEntry_Change{
+			Name: rev.Name,
+		}
+
+		switch rev.Op {
+		case store.Revision_PUT:
+			c.Before = rev.Previous
+			c.After = rev.Route
+		case store.Revision_DELETE:
+			c.Before = rev.Route
+		}
+
+		s.changes = append(s.changes, c)
+	}
+}
+
+func (s *auditStore) Write(b *store.Batch, user string) error {
+	if err := s.Store.Write(b, user); err != nil {
+		return err
+	}
+
+	s.record(b.Revisions())
+	return nil
+}
+
+func (s *auditStore) Save(r *store.Route, user string) error {
+	var b store.Batch
+	b.Save(r)
+	return s.Write(&b, user)
+}
+
+func (s *auditStore) Delete(name, user string) error {
+	var b store.Batch
+	b.Delete(name)
+	return s.Write(&b, user)
+}
+
+// statusWriter is a ResponseWriter that remembers the status of the
+// response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func writeAudit(ctx *Context, e *store.AuditEntry) {
+	if err := ctx.Store.Audit(e); err != nil {
+		log.Printf("unable to write audit log: %s", err)
+	}
+}
+
+// audited wraps a handler for a mutating request so that the request, its
+// outcome and every change it made to the store are recorded in the audit
+// log.
+func audited(
+	ctx *Context,
+	h func(*Context, http.ResponseWriter, *http.Request, []string)) func(
+	http.ResponseWriter, *http.Request, []string) {
+	return func(w http.ResponseWriter, r *http.Request, names []string) {
+		as := &auditStore{Store: ctx.Store}
+		actx := *ctx
+		actx.Store = as
+
+		sw := &statusWriter{ResponseWriter: w}
+		h(&actx, sw, r, names)
+
+		writeAudit(ctx, &store.AuditEntry{
+			User:    userFor(r),
+			Method:  r.Method,
+			Path:    r.URL.RequestURI(),
+			Status:  int32(sw.status),
+			Changes: as.changes,
+		})
+	}
+}
+
+// auditDocker records a mutating request that is being proxied to docker.
+// The outcome of these requests is not known since the connection is
+// hijacked, so they are recorded without a status.
+func auditDocker(ctx *Context, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+
+	writeAudit(ctx, &store.AuditEntry{
+		User:   userFor(r),
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+	})
+}
+
+// auditMatches indicates whether an entry should be included in a response
+// filtered by user and route name.
+func auditMatches(e *store.AuditEntry, user, route string) bool {
+	if user != "" && e.User != user {
+		return false
+	}
+
+	if route == "" {
+		return true
+	}
+
+	for _, c := range e.Changes {
+		if c.Name == route {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getAudit(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	q := r.URL.Query()
+
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			emitJSONError(w, fmt.Errorf("invalid limit: %s", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var before int64
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			emitJSONError(w, fmt.Errorf("invalid before: %s", v), http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	user, route := q.Get("user"), q.Get("route")
+
+	// entries that do not match are skipped, so page back through the log
+	// until limit entries match or the log runs out.
+	res := []*store.AuditEntry{}
+	for len(res) < limit {
+		es, err := ctx.Store.AuditLog(before, limit)
+		if err != nil {
+			emitJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if len(es) == 0 {
+			break
+		}
+
+		var page []*store.AuditEntry
+		for _, e := range es {
+			if auditMatches(e, user, route) {
+				page = append(page, e)
+			}
+		}
+
+		if n := limit - len(res); len(page) > n {
+			page = page[len(page)-n:]
+		}
+		res = append(page, res...)
+
+		before = es[0].Id
+		if before <= 1 {
+			break
+		}
+	}
+
+	for _, e := range res {
+		for _, c := range e.Changes {
+			c.Before, c.After = redactRoute(c.Before), redactRoute(c.After)
+		}
+	}
+
+	emitJSON(w, res)
+}
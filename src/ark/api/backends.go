@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"golang.org/x/net/context"
+
+	"ark/store"
+)
+
+// backendSpec is a backend and its options in the body of a POST to
+// /api/v1/routes/{name}/backends. It may also be given as a bare string, in
+// which case the backend has the default options.
+type backendSpec struct {
+	Addr string `json:"addr"`
+	store.BackendOptions
+}
+
+func (s *backendSpec) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &s.Addr); err == nil {
+		return nil
+	}
+
+	type spec backendSpec
+	return json.Unmarshal(b, (*spec)(s))
+}
+
+// backendsRequest is the body of a POST to /api/v1/routes/{name}/backends.
+// The balancing of the route is only changed if Balance is given. A bare list
+// of backends is also accepted.
+type backendsRequest struct {
+	Backends   []*backendSpec `json:"backends"`
+	Balance    *string        `json:"balance"`
+	HashHeader *string        `json:"hash_header"`
+}
+
+// readBackends decodes a backendsRequest and translates backends that refer
+// to containers into backends that refer to the container's ip address.
+func readBackends(ctx context.Context, r io.Reader) (*backendsRequest, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	var req backendsRequest
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		if err := json.Unmarshal(raw, &req.Backends); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(req.Backends))
+	for i, be := range req.Backends {
+		addrs[i] = be.Addr
+	}
+
+	ips, err := toIPAddresses(ctx, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, be := range req.Backends {
+		be.Addr = ips[i]
+	}
+
+	return &req, nil
+}
+
+// apply replaces the backends of rt with those in the request.
+func (req *backendsRequest) apply(rt *store.Route) {
+	for _, be := range rt.Backends {
+		delete(rt.BackendOptions, be)
+	}
+
+	rt.Backends = make([]string, 0, len(req.Backends))
+	for _, be := range req.Backends {
+		rt.Backends = append(rt.Backends, be.Addr)
+
+		if be.BackendOptions == (store.BackendOptions{}) {
+			continue
+		}
+
+		if rt.BackendOptions == nil {
+			rt.BackendOptions = map[string]*store.BackendOptions{}
+		}
+		opts := be.BackendOptions
+		rt.BackendOptions[be.Addr] = &opts
+	}
+
+	rt.PruneOptions()
+
+	if req.Balance != nil {
+		rt.Balance = *req.Balance
+	}
+
+	if req.HashHeader != nil {
+		rt.HashHeader = *req.HashHeader
+	}
+}
+
+var validHeader = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// validateBalance checks the balancing of the route and the options of its
+// backends.
+func validateBalance(r *store.Route) error {
+	switch r.Balance {
+	case "", store.BalanceRoundRobin, store.BalanceLeastConn, store.BalanceIPHash:
+		if r.HashHeader != "" {
+			return fmt.Errorf("hash_header requires balance %s", store.BalanceHash)
+		}
+	case store.BalanceHash:
+		if !validHeader.MatchString(r.HashHeader) {
+			return fmt.Errorf("invalid hash_header: '%s'", r.HashHeader)
+		}
+	default:
+		return fmt.Errorf("invalid balance: '%s'", r.Balance)
+	}
+
+	for be, o := range r.BackendOptions {
+		if o.Weight < 0 || o.MaxFails < 0 || o.FailTimeout < 0 {
+			return fmt.Errorf("%s: options may not be negative", be)
+		}
+
+		// nginx does not allow backup servers with hash balancing.
+		if o.Backup && (r.Balance == store.BalanceIPHash || r.Balance == store.BalanceHash) {
+			return errors.New("backup backends cannot be used with hash balancing")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"ark/store"
+)
+
+func TestBackendsRequest(t *testing.T) {
+	var req backendsRequest
+	if err := json.Unmarshal([]byte(`{
+		"backends": [
+			"10.0.0.1:80",
+			{"addr": "10.0.0.2:80", "weight": 3, "backup": true}
+		],
+		"balance": "least_conn"
+	}`), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	rt := &store.Route{
+		Name:     "a",
+		Backends: []string{"10.0.0.1:80", "10.0.0.3:80"},
+		Paths: []*store.PathRule{
+			{Path: "/api", Backends: []string{"10.0.0.4:80"}},
+		},
+		BackendOptions: map[string]*store.BackendOptions{
+			"10.0.0.1:80": {Weight: 2},
+			"10.0.0.3:80": {Weight: 2},
+			"10.0.0.4:80": {MaxFails: 1},
+		},
+	}
+
+	req.apply(rt)
+
+	if !sameStrings(rt.Backends, []string{"10.0.0.1:80", "10.0.0.2:80"}) {
+		t.Fatalf("unexpected backends: %v", rt.Backends)
+	}
+
+	if rt.Balance != store.BalanceLeastConn {
+		t.Fatalf("expected least_conn got %s", rt.Balance)
+	}
+
+	// a bare backend goes back to the default options, backends that are
+	// gone lose theirs and those of path rules are untouched.
+	if len(rt.BackendOptions) != 2 {
+		t.Fatalf("expected 2 backends with options, got %v", rt.BackendOptions)
+	}
+
+	if o := rt.BackendOptions["10.0.0.2:80"]; o == nil || o.Weight != 3 || !o.Backup {
+		t.Fatalf("unexpected options for 10.0.0.2:80: %v", o)
+	}
+
+	if o := rt.BackendOptions["10.0.0.4:80"]; o == nil || o.MaxFails != 1 {
+		t.Fatalf("unexpected options for 10.0.0.4:80: %v", o)
+	}
+
+	if err := validateBalance(rt); err != nil {
+		t.Fatal(err)
+	}
+
+	// backup backends do not mix with hash balancing.
+	rt.Balance, rt.HashHeader = store.BalanceHash, "X-User"
+	if err := validateBalance(rt); err == nil {
+		t.Fatal("expected error with a backup backend and hash balancing")
+	}
+
+	delete(rt.BackendOptions, "10.0.0.2:80")
+	if err := validateBalance(rt); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []*store.Route{
+		{Balance: "random"},
+		{Balance: store.BalanceHash},
+		{Balance: store.BalanceHash, HashHeader: "X User"},
+		{HashHeader: "X-User"},
+		{BackendOptions: map[string]*store.BackendOptions{"a:80": {Weight: -1}}},
+	} {
+		if err := validateBalance(bad); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
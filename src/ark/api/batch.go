@@ -0,0 +1,326 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"ark/docker"
+	"ark/store"
+)
+
+const (
+	batchCreate   = "create"
+	batchDelete   = "delete"
+	batchBackends = "backends"
+	batchDisable  = "disable"
+	batchEnable   = "enable"
+)
+
+// batchOp is a single change within a POST to /api/v1/batch. Create requires
+// Route, delete, disable and enable require Name or Selector and backends
+// requires both Name and Backends. If Version is given, the op fails the
+// batch unless the route is at that version, with 0 meaning the route must
+// not exist. An op with a Selector applies to every route whose labels match,
+// which may be none.
+type batchOp struct {
+	Op       string       `json:"op"`
+	Name     string       `json:"name,omitempty"`
+	Selector string       `json:"selector,omitempty"`
+	Route    *store.Route `json:"route,omitempty"`
+	Backends []string     `json:"backends,omitempty"`
+	Version  *int64       `json:"version,omitempty"`
+}
+
+// batchState tracks the state of every route touched by a batch as the
+// operations are applied so that later operations see earlier ones.
+type batchState struct {
+	s store.Store
+
+	// the directory that holds static content.
+	staticDir string
+
+	// the state of the route before the batch, nil if it did not exist.
+	prev map[string]*store.Route
+
+	// the state of the route after the ops so far, nil if it was deleted.
+	next map[string]*store.Route
+
+	// the order in which routes were first touched.
+	names []string
+}
+
+func newBatchState(s store.Store, staticDir string) *batchState {
+	return &batchState{
+		s:         s,
+		staticDir: staticDir,
+		prev:      map[string]*store.Route{},
+		next:      map[string]*store.Route{},
+	}
+}
+
+func (b *batchState) load(name string) (*store.Route, error) {
+	if rt, ok := b.next[name]; ok {
+		return rt, nil
+	}
+
+	var rt store.Route
+	err := b.s.Load(name, &rt)
+	if err == store.ErrNotFound {
+		b.prev[name] = nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		b.prev[name] = &rt
+	}
+
+	b.names = append(b.names, name)
+	b.next[name] = b.prev[name]
+	return b.prev[name], nil
+}
+
+// undo returns a batch that restores every touched route to the state it
+// was in before the batch.
+func (b *batchState) undo() *store.Batch {
+	var u store.Batch
+	for _, name := range b.names {
+		prev, next := b.prev[name], b.next[name]
+		if prev != nil {
+			u.Save(prev)
+		} else if next != nil {
+			u.Delete(name)
+		}
+	}
+	return &u
+}
+
+// routes returns the resulting state of every route that still exists.
+func (b *batchState) routes() []*store.Route {
+	rts := []*store.Route{}
+	for _, name := range b.names {
+		if rt := b.next[name]; rt != nil {
+			rts = append(rts, rt)
+		}
+	}
+	return rts
+}
+
+// Find returns the routes that match q as if the ops so far had already
+// been written to the store.
+func (b *batchState) Find(q *store.Query) ([]*store.Route, error) {
+	rts, err := b.s.Find(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*store.Route
+	for _, rt := range rts {
+		if _, ok := b.next[rt.Name]; !ok {
+			res = append(res, rt)
+		}
+	}
+
+	for _, name := range b.names {
+		if rt := b.next[name]; rt != nil && q.Matches(rt) {
+			res = append(res, rt)
+		}
+	}
+
+	return res, nil
+}
+
+// targets returns the names of the routes that op applies to.
+func (b *batchState) targets(op *batchOp) ([]string, error) {
+	if op.Selector == "" {
+		return []string{op.Name}, nil
+	}
+
+	if op.Name != "" || op.Version != nil {
+		return nil, errors.New("selector cannot be combined with name or version")
+	}
+
+	sel, err := store.ParseSelector(op.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	rts, err := b.Find(&store.Query{Selector: sel})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(rts))
+	for _, rt := range rts {
+		names = append(names, rt.Name)
+	}
+	return names, nil
+}
+
+// save records n as the new state of the route that was loaded as rt. Unless
+// an earlier op in the batch wrote the route, the write fails if the route is
+// no longer the version that the op was applied to.
+func (b *batchState) save(rt, n *store.Route, version *int64, batch *store.Batch) {
+	b.next[n.Name] = n
+	if version != nil {
+		batch.SaveIf(n, *version)
+	} else if rt == b.prev[n.Name] {
+		batch.SaveIf(n, rt.Version)
+	} else {
+		batch.Save(n)
+	}
+}
+
+func (b *batchState) apply(ctx context.Context, op *batchOp, batch *store.Batch) error {
+	switch op.Op {
+	case batchCreate:
+		if op.Route == nil {
+			return errors.New("create requires a route")
+		}
+
+		cur, err := b.load(op.Route.Name)
+		if err != nil {
+			return err
+		}
+		keepHashes(op.Route, cur)
+
+		if err := validateRoute(b, op.Route); err != nil {
+			return err
+		}
+
+		if err := validateCert(b.s, op.Route); err != nil {
+			return err
+		}
+
+		if err := validateStaticContent(b.staticDir, op.Route); err != nil {
+			return err
+		}
+
+		b.next[op.Route.Name] = op.Route
+		if op.Version != nil {
+			batch.SaveIf(op.Route, *op.Version)
+		} else {
+			batch.Save(op.Route)
+		}
+	case batchDelete:
+		names, err := b.targets(op)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			rt, err := b.load(name)
+			if err != nil {
+				return err
+			} else if rt == nil {
+				return fmt.Errorf("route not found: '%s'", name)
+			}
+
+			b.next[name] = nil
+			if op.Version != nil {
+				batch.DeleteIf(name, *op.Version)
+			} else {
+				batch.Delete(name)
+			}
+		}
+	case batchBackends:
+		rt, err := b.load(op.Name)
+		if err != nil {
+			return err
+		} else if rt == nil {
+			return fmt.Errorf("route not found: '%s'", op.Name)
+		}
+
+		bes, err := toIPAddresses(ctx, op.Backends)
+		if err != nil {
+			return err
+		}
+
+		n := proto.Clone(rt).(*store.Route)
+		n.Backends = bes
+		n.PruneOptions()
+		if err := validateRoute(b, n); err != nil {
+			return err
+		}
+		b.save(rt, n, op.Version, batch)
+	case batchDisable, batchEnable:
+		names, err := b.targets(op)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			rt, err := b.load(name)
+			if err != nil {
+				return err
+			} else if rt == nil {
+				return fmt.Errorf("route not found: '%s'", name)
+			}
+
+			n := proto.Clone(rt).(*store.Route)
+			n.Disabled = op.Op == batchDisable
+			b.save(rt, n, op.Version, batch)
+		}
+	default:
+		return fmt.Errorf("unknown op: '%s'", op.Op)
+	}
+
+	return nil
+}
+
+func postBatch(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var ops []*batchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the content must not be pruned before the routes that refer to it are
+	// saved.
+	staticLck.Lock()
+	defer staticLck.Unlock()
+
+	st := newBatchState(ctx.Store, ctx.StaticDir)
+
+	var batch store.Batch
+	for i, op := range ops {
+		err := st.apply(context.Background(), op, &batch)
+		if docker.IsNotFound(err) {
+			emitJSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			emitJSONError(w, fmt.Errorf("op %d: %s", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	user := userFor(r)
+	if err := ctx.Store.Write(&batch, user); err == store.ErrConflict {
+		emitJSONError(w, err, http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := ctx.Update(); err != nil {
+		if rerr := ctx.Store.Write(st.undo(), user); rerr != nil {
+			log.Printf("batch rollback failed: %s", rerr)
+		} else if rerr := ctx.Update(); rerr != nil {
+			log.Printf("batch rollback update failed: %s", rerr)
+		}
+
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	emitJSON(w, redactRoutes(st.routes()))
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"ark/store"
+)
+
+// certRequest is the body of PUT /api/v1/certs/{name}.
+type certRequest struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// certInfo describes a certificate without revealing its key.
+type certInfo struct {
+	Name      string   `json:"name"`
+	Hosts     []string `json:"hosts"`
+	NotBefore int64    `json:"not_before"`
+	NotAfter  int64    `json:"not_after"`
+	Routes    []string `json:"routes"`
+}
+
+// parseCert checks that the PEM encoded certificate chain and key belong
+// together and builds a Certificate from them.
+func parseCert(name string, cert, key []byte) (*store.Certificate, error) {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := leaf.DNSNames
+	if len(hosts) == 0 && leaf.Subject.CommonName != "" {
+		hosts = []string{leaf.Subject.CommonName}
+	}
+
+	return &store.Certificate{
+		Name:      name,
+		Cert:      cert,
+		Key:       key,
+		Hosts:     hosts,
+		NotBefore: leaf.NotBefore.Unix(),
+		NotAfter:  leaf.NotAfter.Unix(),
+	}, nil
+}
+
+// validateCert checks that the certificate a route refers to exists.
+// Certificates for routes with automatic tls are obtained once the route is
+// saved.
+func validateCert(s store.Store, r *store.Route) error {
+	if r.Cert == "" || r.Tls == store.TLSAuto {
+		return nil
+	}
+
+	var c store.Certificate
+	if err := s.LoadCert(r.Cert, &c); err == store.ErrNotFound {
+		return fmt.Errorf("certificate not found: '%s'", r.Cert)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// certUsers returns the names of the routes that use each certificate.
+func certUsers(s store.Store) (map[string][]string, error) {
+	rts, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string][]string{}
+	for _, rt := range rts {
+		if name := rt.CertName(); name != "" {
+			users[name] = append(users[name], rt.Name)
+		}
+	}
+	return users, nil
+}
+
+func infoFor(c *store.Certificate, routes []string) *certInfo {
+	if routes == nil {
+		routes = []string{}
+	}
+
+	return &certInfo{
+		Name:      c.Name,
+		Hosts:     c.Hosts,
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		Routes:    routes,
+	}
+}
+
+func getCerts(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	certs, err := ctx.Store.LoadCerts()
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	users, err := certUsers(ctx.Store)
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]*certInfo, 0, len(certs))
+	for _, c := range certs {
+		res = append(res, infoFor(c, users[c.Name]))
+	}
+
+	emitJSON(w, res)
+}
+
+func putCert(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var req certRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if names[0] == "" {
+		emitJSONError(w, errors.New("name is required"), http.StatusBadRequest)
+		return
+	}
+
+	if strings.HasPrefix(names[0], store.AutoCertPrefix) {
+		emitJSONError(w,
+			fmt.Errorf("names starting with '%s' are reserved for automatic tls", store.AutoCertPrefix),
+			http.StatusBadRequest)
+		return
+	}
+
+	c, err := parseCert(names[0], []byte(req.Cert), []byte(req.Key))
+	if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := ctx.Store.SaveCert(c); err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	users, err := certUsers(ctx.Store)
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// routes that use the certificate must pick up the new one.
+	if len(users[c.Name]) > 0 {
+		if err := ctx.Update(); err != nil {
+			emitJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	emitJSON(w, infoFor(c, users[c.Name]))
+}
+
+func delCert(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	users, err := certUsers(ctx.Store)
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if rts := users[names[0]]; len(rts) > 0 {
+		emitJSONError(w,
+			fmt.Errorf("certificate is used by route '%s'", rts[0]),
+			http.StatusConflict)
+		return
+	}
+
+	if err := ctx.Store.DeleteCert(names[0]); err == store.ErrNotFound {
+		emitJSONError(w, fmt.Errorf("%s not found", names[0]), http.StatusNotFound)
+		return
+	} else if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	emitNoContent(w)
+}
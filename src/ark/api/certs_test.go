@@ -0,0 +1,269 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ark/store"
+)
+
+// selfSigned returns a PEM encoded self-signed certificate for host and its
+// key.
+func selfSigned(t *testing.T, host string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}))
+}
+
+func TestCerts(t *testing.T) {
+	lb := &mockLoadBalancer{}
+	ctx := &Context{
+		Store:        newStore(),
+		LoadBalancer: lb,
+	}
+
+	h := Handler(ctx)
+
+	send := func(method, uri string, src interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(src); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, uri, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	expires := time.Now().Add(30 * 24 * time.Hour)
+	crt, key := selfSigned(t, "a.com", expires)
+	_, other := selfSigned(t, "a.com", expires)
+
+	if w := send("PUT", "/api/v1/certs/a", &certRequest{Cert: crt, Key: other}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a mismatched key got %d", w.Code)
+	}
+
+	rt := &store.Route{Name: "a", Port: 443, Hosts: []string{"a.com"}, Cert: "a"}
+	if w := send("POST", "/api/v1/routes", rt); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a missing certificate got %d", w.Code)
+	}
+
+	w := send("PUT", "/api/v1/certs/a", &certRequest{Cert: crt, Key: key})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var info certInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.NotAfter != expires.Unix() || len(info.Hosts) != 1 || info.Hosts[0] != "a.com" {
+		t.Fatalf("unexpected certificate info: %v", info)
+	}
+
+	if w := send("POST", "/api/v1/routes", rt); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	// a port is served over tls by every route on it or by none of them.
+	plain := &store.Route{Name: "p", Port: 443, Hosts: []string{"p.com"}}
+	if w := send("POST", "/api/v1/routes", plain); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a plain route on a tls port got %d", w.Code)
+	}
+
+	plain.Port, plain.Cert = 8080, "a"
+	if w := send("POST", "/api/v1/routes", plain); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	mixed := &store.Route{Name: "q", Port: 8080, Hosts: []string{"q.com"}}
+	if w := send("POST", "/api/v1/routes", mixed); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a plain route on a tls port got %d", w.Code)
+	}
+
+	if w := send("DELETE", "/api/v1/routes/p", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 got %d", w.Code)
+	}
+
+	// replacing a certificate in use updates the load balancer.
+	count := lb.count
+	if w := send("PUT", "/api/v1/certs/a", &certRequest{Cert: crt, Key: key}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	if lb.count != count+1 {
+		t.Fatal("expected the load balancer to be updated")
+	}
+
+	w = send("GET", "/api/v1/certs", nil)
+	if bytes.Contains(w.Body.Bytes(), []byte("PRIVATE KEY")) {
+		t.Fatal("listing certificates revealed a key")
+	}
+
+	var infos []*certInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 || len(infos[0].Routes) != 1 || infos[0].Routes[0] != "a" {
+		t.Fatalf("expected certificate a used by route a, got %v", infos)
+	}
+
+	if w := send("DELETE", "/api/v1/certs/a", nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected status 409 deleting a certificate in use got %d", w.Code)
+	}
+
+	if w := send("DELETE", "/api/v1/routes/a", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 got %d", w.Code)
+	}
+
+	if w := send("DELETE", "/api/v1/certs/a", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 got %d", w.Code)
+	}
+
+	if w := send("DELETE", "/api/v1/certs/a", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 got %d", w.Code)
+	}
+
+	// routes with automatic tls do not need a certificate up front.
+	auto := &store.Route{Name: "b", Port: 443, Hosts: []string{"b.com"}, Tls: store.TLSAuto}
+	if w := send("POST", "/api/v1/routes", auto); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the certificate obtained for the route can be managed like any other,
+	// but not uploaded.
+	if w := send("PUT", "/api/v1/certs/acme-b", &certRequest{Cert: crt, Key: key}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a reserved name got %d", w.Code)
+	}
+
+	ac, err := parseCert("acme-b", []byte(crt), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.Store.SaveCert(ac); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := send("DELETE", "/api/v1/certs/acme-b", nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected status 409 deleting a certificate in use got %d", w.Code)
+	}
+
+	auto.Cert = "a"
+	if w := send("POST", "/api/v1/routes", auto); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 naming a certificate with automatic tls got %d", w.Code)
+	}
+
+	auto.Cert, auto.Tls = "", "manual"
+	if w := send("POST", "/api/v1/routes", auto); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid tls got %d", w.Code)
+	}
+}
+
+func TestSnapshotCerts(t *testing.T) {
+	src := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	crt, key := selfSigned(t, "a.com", time.Now().Add(30*24*time.Hour))
+	c, err := parseCert("a", []byte(crt), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Store.SaveCert(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Store.Save(&store.Route{
+		Name:  "a",
+		Port:  443,
+		Hosts: []string{"a.com"},
+		Cert:  "a",
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/api/v1/snapshot", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	Handler(src).ServeHTTP(w, req)
+
+	var sn store.Snapshot
+	if err := json.NewDecoder(w.Body).Decode(&sn); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sn.Certs) != 1 || sn.Certs[0].Name != "a" {
+		t.Fatalf("expected certificate a in the snapshot, got %v", sn.Certs)
+	}
+
+	// the route can be restored into a store without its certificate.
+	dst := &Context{
+		Store:        newStore(),
+		LoadBalancer: &mockLoadBalancer{},
+	}
+
+	h := Handler(dst)
+	if w, _ := putSnapshotJSON(t, h, "/api/v1/snapshot", &sn); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d: %s", w.Code, w.Body.String())
+	}
+
+	var got store.Certificate
+	if err := dst.Store.LoadCert("a", &got); err != nil {
+		t.Fatalf("expected certificate a to be restored: %s", err)
+	}
+
+	if !bytes.Equal(got.Key, c.Key) {
+		t.Fatal("restored certificate has a different key")
+	}
+
+	sn.Certs[0].Key = []byte(key[:len(key)/2])
+	if w, _ := putSnapshotJSON(t, h, "/api/v1/snapshot", &sn); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid certificate got %d", w.Code)
+	}
+}
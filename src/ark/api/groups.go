@@ -0,0 +1,203 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"golang.org/x/net/context"
+
+	"ark/docker"
+	"ark/store"
+)
+
+var validGroupName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// groupRequest is the body of a PUT to a backend group. A nil Weight keeps
+// the weight of an existing group and gives a new group none.
+type groupRequest struct {
+	Backends []string `json:"backends"`
+	Weight   *int32   `json:"weight,omitempty"`
+}
+
+// validateGroups checks the backend groups of a route and their weights.
+func validateGroups(r *store.Route) error {
+	if len(r.Groups) == 0 {
+		return nil
+	}
+
+	if r.IsStream() {
+		return errors.New("a stream route cannot have backend groups")
+	}
+
+	if len(r.Backends) == 0 {
+		return errors.New("a route with backend groups must have backends of its own")
+	}
+
+	seen := map[string]bool{}
+	for _, g := range r.Groups {
+		if !validGroupName.MatchString(g.Name) {
+			return fmt.Errorf("invalid group name: '%s'", g.Name)
+		}
+
+		if seen[g.Name] {
+			return fmt.Errorf("duplicate group: '%s'", g.Name)
+		}
+		seen[g.Name] = true
+
+		if len(g.Backends) == 0 {
+			return fmt.Errorf("group '%s' has no backends", g.Name)
+		}
+
+		if g.Weight < 0 || g.Weight > 100 {
+			return fmt.Errorf("weight of group '%s' must be between 0 and 100", g.Name)
+		}
+	}
+
+	if r.DefaultWeight() < 0 {
+		return errors.New("the weights of the groups may not add up to more than 100")
+	}
+
+	return nil
+}
+
+// putGroup creates or replaces a backend group of a route.
+func putGroup(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	bes, err := resolveBackends(context.Background(), req.Backends)
+	if docker.IsNotFound(err) {
+		emitJSONError(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		g := rt.Group(names[1])
+		if g == nil {
+			g = &store.BackendGroup{Name: names[1]}
+			rt.Groups = append(rt.Groups, g)
+		}
+
+		g.Backends = bes
+		if req.Weight != nil {
+			g.Weight = *req.Weight
+		}
+
+		rt.PruneOptions()
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, rt.Group(names[1]))
+}
+
+// delGroup removes a backend group from a route.
+func delGroup(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		if err := removeGroup(rt, names[1]); err != nil {
+			return err
+		}
+
+		rt.PruneOptions()
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitNoContent(w)
+}
+
+// removeGroup removes the named group from the route.
+func removeGroup(rt *store.Route, name string) error {
+	for i, g := range rt.Groups {
+		if g.Name == name {
+			rt.Groups = append(rt.Groups[:i], rt.Groups[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("group not found: '%s'", name)
+}
+
+// postWeights changes the weights of the named groups of a route, leaving
+// the others as they are.
+func postWeights(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var weights map[string]int32
+	if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		for name, weight := range weights {
+			g := rt.Group(name)
+			if g == nil {
+				return fmt.Errorf("group not found: '%s'", name)
+			}
+			g.Weight = weight
+		}
+
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	groups := rt.Groups
+	if groups == nil {
+		groups = []*store.BackendGroup{}
+	}
+
+	emitJSON(w, groups)
+}
+
+// postPromote makes the backends of a group the route's own backends and
+// removes the group, which completes a canary.
+func postPromote(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		g := rt.Group(names[1])
+		if g == nil {
+			return fmt.Errorf("group not found: '%s'", names[1])
+		}
+
+		rt.Backends = g.Backends
+		if err := removeGroup(rt, g.Name); err != nil {
+			return err
+		}
+
+		rt.PruneOptions()
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, redactRoute(rt))
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"ark/store"
+)
+
+// validHeaderValue reports whether v can be written as a quoted string in the
+// nginx config. Values are literal, so nginx variables are not allowed.
+func validHeaderValue(v string) bool {
+	for _, c := range v {
+		if c < 0x20 || c == 0x7f || c == '"' || c == '\\' || c == '$' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateHeaders checks that each header rule is well-formed and that no two
+// rules set or remove the same header.
+func validateHeaders(rules []*store.HeaderRule) error {
+	seen := map[string]bool{}
+	for _, h := range rules {
+		switch h.Direction {
+		case store.HeaderRequest, store.HeaderResponse:
+		default:
+			return fmt.Errorf("invalid header direction: '%s'", h.Direction)
+		}
+
+		if !validHeader.MatchString(h.Name) {
+			return fmt.Errorf("invalid header name: '%s'", h.Name)
+		}
+
+		// nginx always sends its own Server header.
+		if h.Direction == store.HeaderResponse &&
+			strings.EqualFold(h.Name, "Server") &&
+			h.Action != store.HeaderRemove {
+			return errors.New("the Server response header can only be removed")
+		}
+
+		switch h.Action {
+		case store.HeaderSet, store.HeaderAdd:
+			if h.Action == store.HeaderAdd && h.Direction == store.HeaderRequest {
+				return errors.New("request headers can only be set or removed")
+			}
+
+			if !validHeaderValue(h.Value) {
+				return fmt.Errorf(
+					"%s: header value may not contain quotes, backslashes, '$' or control characters",
+					h.Name)
+			}
+		case store.HeaderRemove:
+			if h.Value != "" {
+				return fmt.Errorf("%s: a removed header cannot have a value", h.Name)
+			}
+		default:
+			return fmt.Errorf("invalid header action: '%s'", h.Action)
+		}
+
+		if h.Action == store.HeaderAdd {
+			continue
+		}
+
+		key := h.Direction + " " + strings.ToLower(h.Name)
+		if seen[key] {
+			return fmt.Errorf("duplicate %s header rule: %s", h.Direction, h.Name)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// postHeaders replaces the header rules of a route.
+func postHeaders(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var rules []*store.HeaderRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Headers = rules
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	rules = rt.Headers
+	if rules == nil {
+		rules = []*store.HeaderRule{}
+	}
+
+	emitJSON(w, rules)
+}
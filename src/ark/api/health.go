@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"ark/docker"
+	"ark/health"
+	"ark/store"
+)
+
+// The health of a backend in a backendHealth.
+const (
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+	healthUnchecked = "unchecked"
+)
+
+// backendHealth is an element of the response to
+// GET /api/v1/routes/{name}/backends?health=1.
+type backendHealth struct {
+	// the container the backend refers to, or its address if the container
+	// cannot be found.
+	Backend string `json:"backend"`
+	Addr    string `json:"addr"`
+	Status  string `json:"status"`
+	Checked int64  `json:"checked,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// validateHealthCheck checks the health check of the route, if it has one.
+func validateHealthCheck(r *store.Route) error {
+	hc := r.HealthCheck
+	if hc == nil {
+		return nil
+	}
+
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("health check path must begin with /: '%s'", hc.Path)
+	}
+
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.Fall < 0 || hc.Rise < 0 {
+		return errors.New("health check options may not be negative")
+	}
+
+	return nil
+}
+
+// containersFor translates backends into the containers they refer to. A
+// backend whose container cannot be found is left as it is, which is likely
+// when the container has crashed.
+func containersFor(ctx context.Context, bes []string) []string {
+	res := make([]string, len(bes))
+	copy(res, bes)
+
+	refs, err := docker.ParseRefs(bes)
+	if err != nil {
+		return res
+	}
+
+	if cids, err := docker.ToContainers(ctx, refs); err == nil {
+		for i, cid := range cids {
+			res[i] = cid.String()
+		}
+		return res
+	}
+
+	for i, ref := range refs {
+		if cids, err := docker.ToContainers(ctx, []*docker.Ref{ref}); err == nil {
+			res[i] = cids[0].String()
+		}
+	}
+	return res
+}
+
+// getBackendHealth emits the health of every backend of the route, including
+// those of its path rules and groups.
+func getBackendHealth(ctx *Context, w http.ResponseWriter, rt *store.Route) {
+	var sts map[string]*health.Status
+	if ctx.Health != nil {
+		sts = ctx.Health.Health(rt.Name)
+	}
+
+	var bes []string
+	seen := map[string]bool{}
+	for _, be := range rt.AllBackends() {
+		if !seen[be] {
+			seen[be] = true
+			bes = append(bes, be)
+		}
+	}
+
+	cids := containersFor(context.Background(), bes)
+
+	res := make([]*backendHealth, 0, len(bes))
+	for i, be := range bes {
+		h := &backendHealth{
+			Backend: cids[i],
+			Addr:    be,
+			Status:  healthUnchecked,
+		}
+
+		if s := sts[be]; s != nil {
+			h.Status = healthHealthy
+			if !s.Healthy {
+				h.Status = healthUnhealthy
+			}
+			h.Checked = s.Checked
+			h.Error = s.Error
+		}
+
+		res = append(res, h)
+	}
+
+	emitJSON(w, res)
+}
+
+// postHealth replaces the health check of a route. A body of null stops
+// checking the route's backends.
+func postHealth(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var hc *store.HealthCheck
+	if err := json.NewDecoder(r.Body).Decode(&hc); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.HealthCheck = hc
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, rt.HealthCheck)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"ark/store"
+)
+
+// the most that the annotations of a route may hold, keys and values
+// included.
+const maxAnnotations = 64 << 10
+
+// validateLabels checks the labels and annotations of a route.
+func validateLabels(r *store.Route) error {
+	for k, v := range r.Labels {
+		if !store.ValidLabelKey(k) {
+			return fmt.Errorf("invalid label key: '%s'", k)
+		}
+
+		if !store.ValidLabelValue(v) {
+			return fmt.Errorf("invalid value for label '%s': '%s'", k, v)
+		}
+	}
+
+	size := 0
+	for k, v := range r.Annotations {
+		if !store.ValidLabelKey(k) {
+			return fmt.Errorf("invalid annotation key: '%s'", k)
+		}
+		size += len(k) + len(v)
+	}
+
+	if size > maxAnnotations {
+		return fmt.Errorf("annotations may not be larger than %d bytes", maxAnnotations)
+	}
+
+	return nil
+}
+
+// postLabels replaces the labels of a route.
+func postLabels(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var labels map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Labels = labels
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, rt.Labels)
+}
+
+// postAnnotations replaces the annotations of a route.
+func postAnnotations(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var annotations map[string]string
+	if err := json.NewDecoder(
+		http.MaxBytesReader(w, r.Body, 2*maxAnnotations)).Decode(&annotations); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Annotations = annotations
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, rt.Annotations)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"ark/store"
+)
+
+// validateLimits checks the rate and connection limits of a route.
+func validateLimits(r *store.Route) error {
+	l := r.Limits
+	if l == nil {
+		return nil
+	}
+
+	if l.Rate < 0 || l.Burst < 0 || l.Connections < 0 {
+		return errors.New("limits may not be negative")
+	}
+
+	if l.Burst > 0 && l.Rate == 0 {
+		return errors.New("burst requires a rate")
+	}
+
+	if l.KeyHeader != "" && !validHeader.MatchString(l.KeyHeader) {
+		return fmt.Errorf("invalid key_header: '%s'", l.KeyHeader)
+	}
+
+	// nginx can only limit the connections of streams, by address.
+	if r.IsStream() && (l.Rate > 0 || l.KeyHeader != "") {
+		return errors.New("stream routes can only limit connections by address")
+	}
+
+	return nil
+}
+
+// postLimits replaces the limits of a route. A body of null removes them.
+func postLimits(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var l *store.Limits
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Limits = l
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, rt.Limits)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"ark/store"
+)
+
+// The ranges of the proxy options. nginx caps connect timeouts at 75s.
+const (
+	maxConnectTimeout = 75
+	maxIOTimeout      = 86400
+	maxBodySize       = 10240
+)
+
+// inRange checks that an option is unset or between 1 and max.
+func inRange(name string, v, max int32) error {
+	if v < 0 || v > max {
+		return fmt.Errorf("%s must be between 1 and %d", name, max)
+	}
+	return nil
+}
+
+// validateProxy checks the proxy options of a route.
+func validateProxy(r *store.Route) error {
+	o := r.Proxy
+	if o == nil {
+		return nil
+	}
+
+	if err := inRange("connect_timeout", o.ConnectTimeout, maxConnectTimeout); err != nil {
+		return err
+	}
+
+	if err := inRange("read_timeout", o.ReadTimeout, maxIOTimeout); err != nil {
+		return err
+	}
+
+	if err := inRange("send_timeout", o.SendTimeout, maxIOTimeout); err != nil {
+		return err
+	}
+
+	if err := inRange("max_body_size", o.MaxBodySize, maxBodySize); err != nil {
+		return err
+	}
+
+	if r.IsStream() &&
+		(o.Websocket || o.DisableBuffering || o.SendTimeout > 0 || o.MaxBodySize > 0) {
+		return errors.New("stream routes only support connect_timeout and read_timeout")
+	}
+
+	return nil
+}
+
+// postProxy replaces the proxy options of a route. A body of null restores
+// the defaults.
+func postProxy(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var o *store.ProxyOptions
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Proxy = o
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, rt.Proxy)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"ark/store"
+)
+
+// validateRedirect checks the redirect and force_https settings of a route.
+func validateRedirect(r *store.Route) error {
+	if r.ForceHttps {
+		if r.CertName() == "" {
+			return errors.New("force_https requires the route to be served over tls")
+		}
+
+		if r.Port == store.HTTPPort {
+			return fmt.Errorf("a route that forces https cannot listen on port %d",
+				store.HTTPPort)
+		}
+	}
+
+	rd := r.Redirect
+	if rd == nil {
+		return nil
+	}
+
+	if len(r.Backends) > 0 || len(r.Paths) > 0 {
+		return errors.New("a redirect route cannot have backends or path rules")
+	}
+
+	switch rd.StatusCode() {
+	case 301, 302, 307, 308:
+	default:
+		return fmt.Errorf("invalid redirect code: %d", rd.Code)
+	}
+
+	// the url is written unquoted into the nginx config.
+	if strings.ContainsAny(rd.To, "\"';{}$ \t\r\n") {
+		return fmt.Errorf("redirect may not contain quotes, braces, '$', ';' or spaces: '%s'",
+			rd.To)
+	}
+
+	u, err := url.Parse(rd.To)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("redirect must be an absolute http or https url: '%s'", rd.To)
+	}
+
+	if rd.PreservePath && (u.RawQuery != "" || u.Fragment != "") {
+		return errors.New("a redirect that preserves the path cannot have a query")
+	}
+
+	return nil
+}
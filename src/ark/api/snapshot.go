@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"ark/store"
+)
+
+// redactDiff returns a copy of the diff without the password hashes of the
+// users of its routes.
+func redactDiff(d *store.Diff) *store.Diff {
+	res := &store.Diff{
+		Added:   redactRoutes(d.Added),
+		Removed: redactRoutes(d.Removed),
+	}
+
+	for _, c := range d.Changed {
+		res.Changed = append(res.Changed, &store.Change{
+			From: redactRoute(c.From),
+			To:   redactRoute(c.To),
+		})
+	}
+	return res
+}
+
+// getSnapshot emits a backup of the store. It is the only response that
+// includes the password hashes of users.
+func getSnapshot(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	sn, err := store.TakeSnapshot(ctx.Store)
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	emitJSON(w, sn)
+}
+
+// putSnapshot replaces every route in the store with those in the snapshot,
+// saves the snapshot's certificates and responds with the diff of the routes
+// that was applied. Certificates that are not in the snapshot are kept. If the
+// dry_run query parameter is set, the diff is computed but not applied.
+func putSnapshot(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var sn store.Snapshot
+	if err := json.NewDecoder(r.Body).Decode(&sn); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := sn.Check(); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	certs := map[string]bool{}
+	for i, c := range sn.Certs {
+		pc, err := parseCert(c.Name, c.Cert, c.Key)
+		if err != nil {
+			emitJSONError(w, fmt.Errorf("certificate %s: %s", c.Name, err), http.StatusBadRequest)
+			return
+		}
+		sn.Certs[i] = pc
+		certs[c.Name] = true
+	}
+
+	for _, rt := range sn.Routes {
+		if err := validateRoute(routeList(sn.Routes), rt); err != nil {
+			emitJSONError(w, fmt.Errorf("%s: %s", rt.Name, err), http.StatusBadRequest)
+			return
+		}
+
+		if err := validateStaticContent(ctx.StaticDir, rt); err != nil {
+			emitJSONError(w, fmt.Errorf("%s: %s", rt.Name, err), http.StatusBadRequest)
+			return
+		}
+
+		if certs[rt.Cert] {
+			continue
+		}
+
+		if err := validateCert(ctx.Store, rt); err != nil {
+			emitJSONError(w, fmt.Errorf("%s: %s", rt.Name, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rts, err := ctx.Store.LoadAll()
+	if err != nil {
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	diff := store.DiffRoutes(rts, sn.Routes)
+	if r.URL.Query().Get("dry_run") != "" || (diff.Empty() && len(sn.Certs) == 0) {
+		emitJSON(w, redactDiff(diff))
+		return
+	}
+
+	// certificates are saved before the routes that use them. They are kept
+	// if the routes cannot be restored.
+	for _, c := range sn.Certs {
+		if err := ctx.Store.SaveCert(c); err != nil {
+			emitJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	user := userFor(r)
+	if !diff.Empty() {
+		if err := ctx.Store.Write(diff.Apply(), user); err != nil {
+			emitJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := ctx.Update(); err != nil {
+		if diff.Empty() {
+			// only certificates were saved, there is nothing to undo.
+		} else if rerr := ctx.Store.Write(diff.Undo(), user); rerr != nil {
+			log.Printf("restore rollback failed: %s", rerr)
+		} else if rerr := ctx.Update(); rerr != nil {
+			log.Printf("restore rollback update failed: %s", rerr)
+		}
+
+		emitJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	emitJSON(w, redactDiff(diff))
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"ark/store"
+)
+
+const (
+	// the largest tarball that can be uploaded and the most it can expand to.
+	maxStaticUpload    = 256 << 20
+	maxStaticExtracted = 1 << 30
+
+	// the largest maintenance page.
+	maxMaintenancePage = 64 << 10
+)
+
+var validDigest = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// staticLck is held while static content is moved into place or pruned so
+// that content is never pruned before the route that refers to it is saved.
+var staticLck sync.Mutex
+
+// validateStatic checks the static content and maintenance mode of a route.
+func validateStatic(r *store.Route) error {
+	if s := r.Static; s != nil {
+		if !validDigest.MatchString(s.Digest) {
+			return fmt.Errorf("invalid static digest: '%s'", s.Digest)
+		}
+
+		if len(r.Backends) > 0 || r.Redirect != nil {
+			return errors.New("a route with static content cannot have backends or redirect")
+		}
+	}
+
+	if m := r.Maintenance; m != nil && len(m.Page) > maxMaintenancePage {
+		return fmt.Errorf("maintenance page may not be larger than %d bytes", maxMaintenancePage)
+	}
+
+	if r.IsStream() && (r.Static != nil || r.Maintenance != nil) {
+		return errors.New("a stream route cannot serve static content or a maintenance page")
+	}
+
+	return nil
+}
+
+// extractTo extracts the regular files and directories of a tarball, which
+// may be gzipped, into dir. Links and other special files are skipped.
+func extractTo(dir string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	} else {
+		r = br
+	}
+
+	var total int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// cleaning the name as an absolute path keeps it inside dir.
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+		// old tarballs mark regular files with a zero type.
+		case tar.TypeReg, '\x00':
+			total += hdr.Size
+			if total > maxStaticExtracted {
+				return fmt.Errorf("static content may not be larger than %d bytes",
+					maxStaticExtracted)
+			}
+
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// unpackStatic extracts an uploaded tarball into a temporary directory in dir
+// and returns the directory along with the digest of the tarball. Temporary
+// directories begin with a dot so that pruneStatic leaves them alone.
+func unpackStatic(dir string, r io.Reader) (string, string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+
+	tmp, err := ioutil.TempDir(dir, ".upload")
+	if err != nil {
+		return "", "", err
+	}
+
+	// the tmp dir is created 0700, but nginx's workers need to read it.
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return "", "", err
+	}
+
+	h := sha256.New()
+	if err := extractTo(tmp, io.TeeReader(r, h)); err != nil {
+		os.RemoveAll(tmp)
+		return "", "", err
+	}
+
+	// drain any padding after the end of the archive so that it is hashed.
+	if _, err := io.Copy(h, r); err != nil {
+		os.RemoveAll(tmp)
+		return "", "", err
+	}
+
+	return tmp, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pruneStatic removes the content in dir that none of the routes refer to.
+func pruneStatic(dir string, rts []*store.Route) error {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	for _, rt := range rts {
+		if rt.Static != nil {
+			used[rt.Static.Digest] = true
+		}
+	}
+
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") || used[fi.Name()] {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneRoutesStatic removes the static content that no route in the store
+// refers to. Content that a route used before is kept so that the route can
+// be rolled back. The caller must hold staticLck.
+func pruneRoutesStatic(ctx *Context) error {
+	rts, err := ctx.Store.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	used := rts
+	for _, rt := range rts {
+		revs, err := ctx.Store.History(rt.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, rev := range revs {
+			if rev.Route != nil {
+				used = append(used, rev.Route)
+			}
+		}
+	}
+
+	return pruneStatic(ctx.StaticDir, used)
+}
+
+// validateStaticContent checks that the static content of a route is still
+// in dir. Rolling back or restoring a route may bring back content that was
+// pruned after the route was deleted.
+func validateStaticContent(dir string, r *store.Route) error {
+	if r.Static == nil {
+		return nil
+	}
+
+	if dir == "" {
+		return errors.New("static content is disabled")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, r.Static.Digest)); os.IsNotExist(err) {
+		return fmt.Errorf("static content %s is gone, upload it again", r.Static.Digest)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// putStatic replaces the static content of a route with an uploaded tarball.
+func putStatic(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	if ctx.StaticDir == "" {
+		emitJSONError(w, errors.New("static content is disabled"), http.StatusNotImplemented)
+		return
+	}
+
+	tmp, digest, err := unpackStatic(ctx.StaticDir,
+		http.MaxBytesReader(w, r.Body, maxStaticUpload))
+	if err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	staticLck.Lock()
+	defer staticLck.Unlock()
+
+	dst := filepath.Join(ctx.StaticDir, digest)
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		if err := os.Rename(tmp, dst); err != nil {
+			emitJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Static = &store.Static{Digest: digest}
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	if err := pruneRoutesStatic(ctx); err != nil {
+		log.Printf("unable to prune static content: %s", err)
+	}
+
+	emitJSON(w, rt.Static)
+}
+
+// delStatic removes the static content of a route.
+func delStatic(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	staticLck.Lock()
+	defer staticLck.Unlock()
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		if rt.Static == nil {
+			return fmt.Errorf("route has no static content: '%s'", rt.Name)
+		}
+		rt.Static = nil
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	if err := pruneRoutesStatic(ctx); err != nil {
+		log.Printf("unable to prune static content: %s", err)
+	}
+
+	emitNoContent(w)
+}
+
+// postMaintenance turns maintenance mode of a route on or off. A body of null
+// turns it off and forgets the page.
+func postMaintenance(ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	names []string) {
+
+	var m *store.Maintenance
+	if err := json.NewDecoder(
+		http.MaxBytesReader(w, r.Body, 2*maxMaintenancePage)).Decode(&m); err != nil {
+		emitJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rt := modifyRoute(ctx, w, r, names[0], func(rt *store.Route) error {
+		rt.Maintenance = m
+		return validateRoute(ctx.Store, rt)
+	})
+	if rt == nil {
+		return
+	}
+
+	emitJSON(w, rt.Maintenance)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"ark/store"
+)
+
+// validateStream checks that a TCP or UDP route does not use any of the
+// options that only apply to HTTP.
+func validateStream(r *store.Route) error {
+	if len(r.Hosts) > 0 {
+		return errors.New("a stream route cannot have hosts")
+	}
+
+	if len(r.Paths) > 0 {
+		return errors.New("a stream route cannot have path rules")
+	}
+
+	if r.Cert != "" || r.Tls != "" {
+		return errors.New("a stream route cannot be served over tls")
+	}
+
+	if r.Redirect != nil || r.ForceHttps {
+		return errors.New("a stream route cannot redirect")
+	}
+
+	if len(r.Headers) > 0 {
+		return errors.New("a stream route cannot have header rules")
+	}
+
+	if r.Balance == store.BalanceHash {
+		return fmt.Errorf("balance %s is not supported by stream routes", r.Balance)
+	}
+
+	if hc := r.HealthCheck; hc != nil {
+		if r.ProtocolType() == store.ProtocolUDP {
+			return errors.New("the backends of udp routes cannot be health checked")
+		}
+
+		if hc.Path != "" {
+			return errors.New("the backends of tcp routes can only be checked with a connect")
+		}
+	}
+
+	return nil
+}
+
+// servesTLS reports whether the route serves port over TLS. The plain HTTP
+// port of a route that forces https does not.
+func servesTLS(r *store.Route, port int32) bool {
+	return port == r.Port && r.CertName() != ""
+}
+
+// describeTLS describes whether a port is served over TLS in an error.
+func describeTLS(tls bool) string {
+	if tls {
+		return "over tls"
+	}
+	return "without tls"
+}
+
+// validatePort checks that no other route claims the route's port. A stream
+// route claims its port for its transport, which HTTP routes share with each
+// other by host as long as they all serve it over TLS or none of them do.
+func validatePort(f routeFinder, r *store.Route) error {
+	for _, port := range r.Ports() {
+		rts, err := f.Find(&store.Query{Port: port})
+		if err != nil {
+			return err
+		}
+
+		for _, rt := range rts {
+			if rt.Name == r.Name || rt.Transport() != r.Transport() {
+				continue
+			}
+
+			if rt.IsStream() || r.IsStream() {
+				return fmt.Errorf("%d/%s is already claimed by route '%s'",
+					port, r.Transport(), rt.Name)
+			}
+
+			if servesTLS(rt, port) != servesTLS(r, port) {
+				return fmt.Errorf("port %d is served %s by route '%s'",
+					port, describeTLS(servesTLS(rt, port)), rt.Name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ark/store"
+)
+
+// maxRetries is the number of times a load-modify-save without an If-Match
+// precondition is retried after losing a race with another write.
+const maxRetries = 3
+
+func etagFor(rt *store.Route) string {
+	return fmt.Sprintf("\"%d\"", rt.Version)
+}
+
+func setETag(w http.ResponseWriter, rt *store.Route) {
+	w.Header().Set("ETag", etagFor(rt))
+}
+
+// ifMatch returns the route version required by the request's If-Match
+// header. ok is false if the request has no precondition.
+func ifMatch(r *http.Request) (int64, bool, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return 0, false, nil
+	}
+
+	h = strings.TrimPrefix(h, "W/")
+	v, err := strconv.ParseInt(strings.Trim(h, "\""), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid If-Match: %s", h)
+	}
+
+	return v, true, nil
+}
+
+// emitConflict responds with 412 and as much detail as is available about
+// the write that got in the way.
+func emitConflict(ctx *Context, w http.ResponseWriter, name string) {
+	err := fmt.Errorf("%s was modified by another request", name)
+
+	if revs, herr := ctx.Store.History(name); herr == nil && len(revs) > 0 {
+		last := revs[len(revs)-1]
+
+		who := last.User
+		if who == "" {
+			who = "an unknown user"
+		}
+
+		if last.Op == store.Revision_DELETE {
+			err = fmt.Errorf("%s was deleted by %s at revision %d",
+				name, who, last.Revision)
+		} else {
+			err = fmt.Errorf("%s was modified by %s and is now at version %d",
+				name, who, last.Revision)
+		}
+	}
+
+	emitJSONError(w, err, http.StatusPreconditionFailed)
+}
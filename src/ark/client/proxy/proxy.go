@@ -61,15 +61,17 @@ func Connect(addr *Addr) (*Proxy, error) {
 		return nil, err
 	}
 
+	// the proxy has never checked host keys, but ssh now requires saying so.
 	c, err := ssh.Dial("tcp", addr.Addr, &ssh.ClientConfig{
-		User: addr.User,
-		Auth: []ssh.AuthMethod{auth},
+		User:            addr.User,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	laddr, err := listen(c)
+	laddr, err := listen(c, addr.User)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +96,10 @@ func getAgent() (ssh.AuthMethod, error) {
 	return ssh.PublicKeysCallback(agent.NewClient(c).Signers), nil
 }
 
-func listen(c *ssh.Client) (net.Addr, error) {
+// userHeader carries the ssh user to arkd so that changes can be attributed.
+const userHeader = "X-Ark-User"
+
+func listen(c *ssh.Client, user string) (net.Addr, error) {
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		return nil, err
@@ -105,6 +110,7 @@ func listen(c *ssh.Client) (net.Addr, error) {
 			Director: func(r *http.Request) {
 				r.URL.Scheme = "http"
 				r.URL.Host = "127.0.0.1"
+				r.Header.Set(userHeader, user)
 			},
 			Transport: &http.Transport{
 				Dial: func(network, address string) (net.Conn, error) {
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"ark/store"
+)
+
+func describeChange(c *store.AuditEntry_Change) string {
+	switch {
+	case c.Before == nil && c.After != nil:
+		return fmt.Sprintf("+ %s  %s", c.Name, describeRoute(c.After))
+	case c.Before != nil && c.After == nil:
+		return fmt.Sprintf("- %s  %s", c.Name, describeRoute(c.Before))
+	case c.Before != nil && c.After != nil:
+		return fmt.Sprintf("~ %s  %s -> %s",
+			c.Name,
+			describeRoute(c.Before),
+			describeRoute(c.After))
+	}
+	return c.Name
+}
+
+func runAudit(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("audit", flag.PanicOnError)
+	flagLimit := f.Int("n", 50, "number of entries to show")
+	flagUser := f.String("u", "", "only show changes made by this user")
+	flagRoute := f.String("r", "", "only show changes to this route")
+	f.Parse(args)
+
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(*flagLimit))
+	if *flagUser != "" {
+		q.Set("user", *flagUser)
+	}
+	if *flagRoute != "" {
+		q.Set("route", *flagRoute)
+	}
+
+	var es []*store.AuditEntry
+	if err := getJSON(laddr, "/api/v1/audit?"+q.Encode(), &es); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("% 6s  %- 20s %- 12s %- 7s % 6s  %s\n",
+		"ID", "TIME", "USER", "METHOD", "STATUS", "PATH")
+	for _, e := range es {
+		status := "-"
+		if e.Status != 0 {
+			status = strconv.Itoa(int(e.Status))
+		}
+
+		fmt.Printf("% 6d  %- 20s %- 12s %- 7s % 6s  %s\n",
+			e.Id,
+			time.Unix(e.Time, 0).Format("2006-01-02 15:04:05"),
+			e.User,
+			e.Method,
+			status,
+			e.Path)
+
+		for _, c := range e.Changes {
+			fmt.Printf("%- 8s%s\n", "", describeChange(c))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package routes
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"ark/store"
+)
+
+func printAccess(users []string, rules []*store.AccessRule) {
+	fmt.Printf("users: %s\n", strings.Join(users, ","))
+	for _, ar := range rules {
+		fmt.Printf("%- 6s %s\n", ar.Action, ar.Source)
+	}
+}
+
+func listAuth(laddr net.Addr, args []string) {
+	if len(args) != 1 {
+		errorLn("routes auth ls name")
+	}
+
+	rt := loadRoute(laddr, args[0])
+
+	var users []string
+	var rules []*store.AccessRule
+	if rt.Access != nil {
+		for _, u := range rt.Access.Users {
+			users = append(users, u.Name)
+		}
+		rules = rt.Access.Rules
+	}
+
+	printAccess(users, rules)
+}
+
+// readPassword reads a password from the first line of stdin.
+func readPassword() string {
+	fmt.Fprint(os.Stderr, "password: ")
+
+	s := bufio.NewScanner(os.Stdin)
+	if !s.Scan() {
+		errorLn("password is required")
+	}
+
+	return strings.TrimRight(s.Text(), "\r")
+}
+
+func addUser(laddr net.Addr, args []string) {
+	if len(args) != 2 {
+		errorLn("routes auth add-user name user < password")
+	}
+
+	var users []string
+	if err := putJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/users/%s", args[0], args[1]),
+		map[string]string{"password": readPassword()},
+		&users); err != nil {
+		errorLn(err.Error())
+	}
+
+	printAccess(users, nil)
+}
+
+func removeUser(laddr net.Addr, args []string) {
+	if len(args) != 2 {
+		errorLn("routes auth rm-user name user")
+	}
+
+	var users []string
+	if err := sendJSON(
+		"DELETE",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/users/%s", args[0], args[1]),
+		nil,
+		nil,
+		&users); err != nil {
+		errorLn(err.Error())
+	}
+
+	printAccess(users, nil)
+}
+
+// setACL replaces the allow and deny rules of rt, failing if the route has
+// changed since it was read.
+func setACL(laddr net.Addr, rt *store.Route, rules []*store.AccessRule) {
+	if rules == nil {
+		rules = []*store.AccessRule{}
+	}
+
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/acl", rt.Name),
+		ifMatch(rt),
+		&rules,
+		&rules)
+	checkWrite(err, "rules")
+
+	for _, ar := range rules {
+		fmt.Printf("%- 6s %s\n", ar.Action, ar.Source)
+	}
+}
+
+// appendACL adds a rule with the action for each source in args to the end of
+// the route's rules.
+func appendACL(laddr net.Addr, action string, args []string) {
+	if len(args) < 2 {
+		errorf("routes auth %s name source...\n", action)
+	}
+
+	rt := loadRoute(laddr, args[0])
+
+	var rules []*store.AccessRule
+	if rt.Access != nil {
+		rules = rt.Access.Rules
+	}
+
+	for _, src := range args[1:] {
+		rules = append(rules, &store.AccessRule{
+			Action: action,
+			Source: src,
+		})
+	}
+
+	setACL(laddr, rt, rules)
+}
+
+func clearACL(laddr net.Addr, args []string) {
+	if len(args) != 1 {
+		errorLn("routes auth clear name")
+	}
+
+	setACL(laddr, loadRoute(laddr, args[0]), nil)
+}
+
+func runAuth(laddr net.Addr, args []string) {
+	if len(args) < 1 {
+		errorLn("routes auth ls|add-user|rm-user|allow|deny|clear")
+	}
+
+	switch args[0] {
+	case "ls":
+		listAuth(laddr, args[1:])
+	case "add-user":
+		addUser(laddr, args[1:])
+	case "rm-user":
+		removeUser(laddr, args[1:])
+	case "allow":
+		appendACL(laddr, store.AccessAllow, args[1:])
+	case "deny":
+		appendACL(laddr, store.AccessDeny, args[1:])
+	case "clear":
+		clearACL(laddr, args[1:])
+	default:
+		errorf("'%s' is not an auth command.\n", args[0])
+	}
+}
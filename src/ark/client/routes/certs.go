@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// certInfo mirrors the description of a certificate returned by the api.
+type certInfo struct {
+	Name      string   `json:"name"`
+	Hosts     []string `json:"hosts"`
+	NotBefore int64    `json:"not_before"`
+	NotAfter  int64    `json:"not_after"`
+	Routes    []string `json:"routes"`
+}
+
+// expiry describes how long a certificate has left.
+func expiry(c *certInfo, now time.Time) string {
+	left := time.Unix(c.NotAfter, 0).Sub(now)
+	if left <= 0 {
+		return "EXPIRED"
+	}
+	return fmt.Sprintf("%dd", int(left.Hours()/24))
+}
+
+func addCert(laddr net.Addr, args []string) {
+	if len(args) != 3 {
+		errorLn("certs add name cert.pem key.pem")
+	}
+
+	crt, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	key, err := ioutil.ReadFile(args[2])
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	req := struct {
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+	}{
+		string(crt),
+		string(key),
+	}
+
+	var c certInfo
+	if err := putJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/certs/%s", args[0]),
+		&req,
+		&c); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("%s  %s  expires %s\n",
+		c.Name,
+		strings.Join(c.Hosts, ","),
+		time.Unix(c.NotAfter, 0).Format("2006-01-02"))
+}
+
+func listCerts(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("list-certs", flag.PanicOnError)
+	flagDays := f.Int("days", 0, "only list certificates that expire within this many days")
+	f.Parse(args)
+
+	var certs []*certInfo
+	if err := getJSON(laddr, "/api/v1/certs", &certs); err != nil {
+		errorLn(err.Error())
+	}
+
+	now := time.Now()
+
+	fmt.Printf("%- 15s %- 12s %- 8s %- 30s %s\n",
+		"NAME", "EXPIRES", "LEFT", "HOSTS", "ROUTES")
+	for _, c := range certs {
+		if *flagDays > 0 &&
+			time.Unix(c.NotAfter, 0).After(now.AddDate(0, 0, *flagDays)) {
+			continue
+		}
+
+		fmt.Printf("%- 15s %- 12s %- 8s %- 30s %s\n",
+			c.Name,
+			time.Unix(c.NotAfter, 0).Format("2006-01-02"),
+			expiry(c, now),
+			strings.Join(c.Hosts, ","),
+			strings.Join(c.Routes, ","))
+	}
+}
+
+func removeCert(laddr net.Addr, args []string) {
+	if len(args) != 1 {
+		errorLn("certs rm name")
+	}
+
+	req, err := http.NewRequest(
+		"DELETE",
+		urlFor(laddr, fmt.Sprintf("/api/v1/certs/%s", args[0])),
+		nil)
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	var c http.Client
+	res, err := c.Do(req)
+	if err != nil {
+		errorLn(err.Error())
+	}
+	defer res.Body.Close()
+
+	if err := decodeJSON(res, nil); err != nil {
+		errorLn(err.Error())
+	}
+}
+
+func runCerts(laddr net.Addr, args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "certs add|ls|rm")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "add":
+		addCert(laddr, args[1:])
+	case "ls":
+		listCerts(laddr, args[1:])
+	case "rm":
+		removeCert(laddr, args[1:])
+	default:
+		errorf("'%s' is not a certs command.\n", args[0])
+	}
+}
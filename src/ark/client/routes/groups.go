@@ -0,0 +1,288 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ark/store"
+)
+
+// canaryPoll is how often a canary checks the health of its group.
+const canaryPoll = 5 * time.Second
+
+func listGroups(laddr net.Addr, args []string) {
+	if len(args) != 1 {
+		errorLn("routes groups ls name")
+	}
+
+	rt := loadRoute(laddr, args[0])
+
+	fmt.Printf("%- 15s % 6s  %s\n", "GROUP", "WEIGHT", "BACKENDS")
+	fmt.Printf("%- 15s % 5d%%  %s\n", "-", rt.DefaultWeight(), strings.Join(rt.Backends, ","))
+	for _, g := range rt.Groups {
+		fmt.Printf("%- 15s % 5d%%  %s\n", g.Name, g.Weight, strings.Join(g.Backends, ","))
+	}
+}
+
+func addGroup(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("groups add", flag.PanicOnError)
+	flagWeight := f.Int("weight", -1, "percentage of requests to send to the group")
+	f.Parse(args)
+
+	if f.NArg() < 3 {
+		errorLn("routes groups add [-weight=5] name group backend1 backend2")
+	}
+
+	req := struct {
+		Backends []string `json:"backends"`
+		Weight   *int32   `json:"weight,omitempty"`
+	}{
+		Backends: f.Args()[2:],
+	}
+
+	if *flagWeight >= 0 {
+		w := int32(*flagWeight)
+		req.Weight = &w
+	}
+
+	var g store.BackendGroup
+	if err := putJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/groups/%s", f.Arg(0), f.Arg(1)),
+		&req,
+		&g); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("%s: %d%% %s\n", g.Name, g.Weight, strings.Join(g.Backends, ","))
+}
+
+func removeGroup(laddr net.Addr, args []string) {
+	if len(args) != 2 {
+		errorLn("routes groups rm name group")
+	}
+
+	req, err := http.NewRequest(
+		"DELETE",
+		urlFor(laddr, fmt.Sprintf("/api/v1/routes/%s/groups/%s", args[0], args[1])),
+		nil)
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	var c http.Client
+	res, err := c.Do(req)
+	if err != nil {
+		errorLn(err.Error())
+	}
+	defer res.Body.Close()
+
+	if err := decodeJSON(res, nil); err != nil {
+		errorLn(err.Error())
+	}
+}
+
+// setWeight sends weight percent of the route's requests to the group.
+func setWeight(laddr net.Addr, name, group string, weight int) error {
+	var groups []*store.BackendGroup
+	return postJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/weights", name),
+		map[string]int{group: weight},
+		&groups)
+}
+
+func weighGroup(laddr net.Addr, args []string) {
+	if len(args) != 3 {
+		errorLn("routes groups weight name group percent")
+	}
+
+	weight, err := strconv.Atoi(strings.TrimSuffix(args[2], "%"))
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	if err := setWeight(laddr, args[0], args[1], weight); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("%s: %d%% to %s\n", args[0], weight, args[1])
+}
+
+// promote makes the group's backends the route's own.
+func promote(laddr net.Addr, name, group string) error {
+	var rt store.Route
+	return postJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/groups/%s/promote", name, group),
+		nil,
+		&rt)
+}
+
+func promoteGroup(laddr net.Addr, args []string) {
+	if len(args) != 2 {
+		errorLn("routes groups promote name group")
+	}
+
+	if err := promote(laddr, args[0], args[1]); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("%s: promoted %s\n", args[0], args[1])
+}
+
+func runGroups(laddr net.Addr, args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "routes groups ls|add|rm|weight|promote")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "ls":
+		listGroups(laddr, args[1:])
+	case "add":
+		addGroup(laddr, args[1:])
+	case "rm":
+		removeGroup(laddr, args[1:])
+	case "weight":
+		weighGroup(laddr, args[1:])
+	case "promote":
+		promoteGroup(laddr, args[1:])
+	default:
+		errorf("'%s' is not a groups command.\n", args[0])
+	}
+}
+
+// parseSteps parses a comma separated list of increasing percentages.
+func parseSteps(s string) ([]int, error) {
+	var steps []int
+	for _, p := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(p), "%"))
+		if err != nil {
+			return nil, err
+		}
+
+		if n <= 0 || n > 100 || (len(steps) > 0 && n <= steps[len(steps)-1]) {
+			return nil, fmt.Errorf("steps must increase from 1 to at most 100: '%s'", s)
+		}
+
+		steps = append(steps, n)
+	}
+	return steps, nil
+}
+
+// watchGroup polls the health of the group's backends for d and returns an
+// error as soon as one of them is unhealthy.
+func watchGroup(laddr net.Addr, name, group string, d time.Duration) error {
+	end := time.Now().Add(d)
+	for {
+		rt := loadRoute(laddr, name)
+		g := rt.Group(group)
+		if g == nil {
+			return fmt.Errorf("group '%s' was removed", group)
+		}
+
+		var bes []*backendHealth
+		if err := getJSON(
+			laddr,
+			fmt.Sprintf("/api/v1/routes/%s/backends?health=1", name),
+			&bes); err != nil {
+			return err
+		}
+
+		in := map[string]bool{}
+		for _, be := range g.Backends {
+			in[be] = true
+		}
+
+		for _, be := range bes {
+			if in[be.Addr] && be.Status == "unhealthy" {
+				return fmt.Errorf("%s is unhealthy: %s", be.Backend, be.Error)
+			}
+		}
+
+		left := end.Sub(time.Now())
+		if left <= 0 {
+			return nil
+		} else if left > canaryPoll {
+			left = canaryPoll
+		}
+		time.Sleep(left)
+	}
+}
+
+// runCanary shifts the requests of a route to one of its groups in steps,
+// watching the group's health at each step. If a backend of the group becomes
+// unhealthy, the group's weight is set back to 0. A canary that reaches 100%
+// promotes the group.
+func runCanary(laddr net.Addr, args []string) {
+	usage := "canary name -to group [-steps=5,25,50,100] [-interval=2m] [-no-promote]"
+
+	// the name may come before or after the flags.
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	f := flag.NewFlagSet("canary", flag.PanicOnError)
+	flagTo := f.String("to", "", "group to send the requests to")
+	flagSteps := f.String("steps", "5,25,50,100", "percentages of requests to send at each step")
+	flagInterval := f.Duration("interval", 2*time.Minute, "time to watch each step before the next")
+	flagNoPromote := f.Bool("no-promote", false, "do not promote the group after the last step")
+	f.Parse(args)
+
+	if name == "" && f.NArg() == 1 {
+		name = f.Arg(0)
+	} else if f.NArg() != 0 {
+		errorLn(usage)
+	}
+
+	if name == "" || *flagTo == "" {
+		errorLn(usage)
+	}
+
+	steps, err := parseSteps(*flagSteps)
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	rt := loadRoute(laddr, name)
+	if rt.Group(*flagTo) == nil {
+		errorf("route '%s' has no group '%s'\n", name, *flagTo)
+	}
+
+	if rt.HealthCheck == nil {
+		fmt.Fprintf(os.Stderr,
+			"warning: route '%s' has no health check, the canary will not abort on failures\n",
+			name)
+	}
+
+	for _, step := range steps {
+		if err := setWeight(laddr, name, *flagTo, step); err != nil {
+			errorLn(err.Error())
+		}
+		fmt.Printf("%s: %d%% to %s\n", name, step, *flagTo)
+
+		if err := watchGroup(laddr, name, *flagTo, *flagInterval); err != nil {
+			if rerr := setWeight(laddr, name, *flagTo, 0); rerr != nil {
+				errorf("%s: aborted, %s\nunable to reset weight: %s\n", name, err, rerr)
+			}
+			errorf("%s: aborted, %s\n%s: 0%% to %s\n", name, err, name, *flagTo)
+		}
+	}
+
+	if steps[len(steps)-1] < 100 || *flagNoPromote {
+		return
+	}
+
+	if err := promote(laddr, name, *flagTo); err != nil {
+		errorLn(err.Error())
+	}
+	fmt.Printf("%s: promoted %s\n", name, *flagTo)
+}
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"ark/store"
+)
+
+// setHeaders replaces the header rules of rt, failing if the route has
+// changed since it was read.
+func setHeaders(laddr net.Addr, rt *store.Route, rules []*store.HeaderRule) {
+	if rules == nil {
+		rules = []*store.HeaderRule{}
+	}
+
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/headers", rt.Name),
+		ifMatch(rt),
+		&rules,
+		&rules)
+	checkWrite(err, "headers")
+
+	printHeaders(rules)
+}
+
+func printHeaders(rules []*store.HeaderRule) {
+	fmt.Printf("%- 9s %- 7s %- 30s %s\n", "DIRECTION", "ACTION", "NAME", "VALUE")
+	for _, h := range rules {
+		fmt.Printf("%- 9s %- 7s %- 30s %s\n", h.Direction, h.Action, h.Name, h.Value)
+	}
+}
+
+func listHeaders(laddr net.Addr, args []string) {
+	if len(args) != 1 {
+		errorLn("routes headers ls name")
+	}
+
+	printHeaders(loadRoute(laddr, args[0]).Headers)
+}
+
+// without returns the rules that do not apply to the named header in the
+// direction.
+func without(rules []*store.HeaderRule, direction, name string) []*store.HeaderRule {
+	var res []*store.HeaderRule
+	for _, h := range rules {
+		if h.Direction == direction && strings.EqualFold(h.Name, name) {
+			continue
+		}
+		res = append(res, h)
+	}
+	return res
+}
+
+// changeHeader adds a rule with the action to the route given in args,
+// replacing any rule for the same header unless the action is add.
+func changeHeader(laddr net.Addr, action string, args []string) {
+	f := flag.NewFlagSet(action+"-header", flag.PanicOnError)
+	flagResponse := f.Bool("response", false, "change the response header instead of the request header")
+	f.Parse(args)
+
+	if action == store.HeaderRemove && f.NArg() != 2 {
+		errorLn("routes headers strip [-response] name header")
+	} else if action != store.HeaderRemove && f.NArg() != 3 {
+		errorf("routes headers %s [-response] name header value\n", action)
+	}
+
+	direction := store.HeaderRequest
+	if *flagResponse || action == store.HeaderAdd {
+		direction = store.HeaderResponse
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	rules := rt.Headers
+	if action != store.HeaderAdd {
+		rules = without(rules, direction, f.Arg(1))
+	}
+
+	setHeaders(laddr, rt, append(rules, &store.HeaderRule{
+		Direction: direction,
+		Action:    action,
+		Name:      f.Arg(1),
+		Value:     f.Arg(2),
+	}))
+}
+
+func clearHeader(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("rm-header", flag.PanicOnError)
+	flagResponse := f.Bool("response", false, "clear the response header rules")
+	f.Parse(args)
+
+	if f.NArg() != 2 {
+		errorLn("routes headers rm [-response] name header")
+	}
+
+	direction := store.HeaderRequest
+	if *flagResponse {
+		direction = store.HeaderResponse
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	rules := without(rt.Headers, direction, f.Arg(1))
+	if len(rules) == len(rt.Headers) {
+		errorf("no %s rule for %s\n", direction, f.Arg(1))
+	}
+
+	setHeaders(laddr, rt, rules)
+}
+
+func runHeaders(laddr net.Addr, args []string) {
+	if len(args) < 1 {
+		errorLn("routes headers ls|set|add|strip|rm")
+	}
+
+	switch args[0] {
+	case "ls":
+		listHeaders(laddr, args[1:])
+	case "set":
+		changeHeader(laddr, store.HeaderSet, args[1:])
+	case "add":
+		changeHeader(laddr, store.HeaderAdd, args[1:])
+	case "strip":
+		changeHeader(laddr, store.HeaderRemove, args[1:])
+	case "rm":
+		clearHeader(laddr, args[1:])
+	default:
+		errorf("'%s' is not a headers command.\n", args[0])
+	}
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"ark/store"
+)
+
+// backendHealth is the health of a backend as reported by the backends api.
+type backendHealth struct {
+	Backend string `json:"backend"`
+	Addr    string `json:"addr"`
+	Status  string `json:"status"`
+	Checked int64  `json:"checked"`
+	Error   string `json:"error"`
+}
+
+// describeHealth describes the health of a backend for display after it.
+func describeHealth(hc *store.HealthCheck, be *backendHealth) string {
+	if hc == nil {
+		return ""
+	}
+
+	s := fmt.Sprintf(" [%s]", be.Status)
+	if be.Checked != 0 {
+		s += fmt.Sprintf(" checked %ds ago", time.Now().Unix()-be.Checked)
+	}
+	if be.Error != "" {
+		s += ": " + be.Error
+	}
+	return s
+}
+
+func setHealth(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("health", flag.PanicOnError)
+	flagPath := f.String("path", "",
+		"path to GET on each backend, a TCP connect is used if empty")
+	flagInterval := f.Int("interval", 0, "seconds between checks")
+	flagTimeout := f.Int("timeout", 0, "seconds before a check fails")
+	flagFall := f.Int("fall", 0, "failed checks before a backend is removed")
+	flagRise := f.Int("rise", 0, "passed checks before a backend is restored")
+	flagOff := f.Bool("off", false, "stop checking the route's backends")
+	f.Parse(args)
+
+	if f.NArg() != 1 {
+		errorLn("routes health [-path=/health] [-interval=n] [-timeout=n] " +
+			"[-fall=n] [-rise=n] [-off] name")
+	}
+
+	var hc *store.HealthCheck
+	if !*flagOff {
+		hc = &store.HealthCheck{
+			Path:     *flagPath,
+			Interval: int32(*flagInterval),
+			Timeout:  int32(*flagTimeout),
+			Fall:     int32(*flagFall),
+			Rise:     int32(*flagRise),
+		}
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/health", rt.Name),
+		ifMatch(rt),
+		hc,
+		&hc)
+	checkWrite(err, "health check")
+
+	if hc == nil {
+		fmt.Printf("%s: not checked\n", rt.Name)
+		return
+	}
+
+	fmt.Printf("%s: path=%q interval=%d timeout=%d fall=%d rise=%d\n",
+		rt.Name, hc.Path, hc.Interval, hc.Timeout, hc.Fall, hc.Rise)
+}
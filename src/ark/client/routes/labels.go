@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// batchOp mirrors an op in a POST to /api/v1/batch.
+type batchOp struct {
+	Op       string `json:"op"`
+	Name     string `json:"name,omitempty"`
+	Selector string `json:"selector,omitempty"`
+}
+
+// applyLabels applies changes of the form key=value, which sets key, and
+// key-, which removes it, to m.
+func applyLabels(m map[string]string, changes []string) (map[string]string, error) {
+	if m == nil {
+		m = map[string]string{}
+	}
+
+	for _, c := range changes {
+		if ix := strings.Index(c, "="); ix > 0 {
+			m[c[:ix]] = c[ix+1:]
+		} else if strings.HasSuffix(c, "-") && len(c) > 1 {
+			delete(m, c[:len(c)-1])
+		} else {
+			return nil, fmt.Errorf("expected key=value or key-, got '%s'", c)
+		}
+	}
+	return m, nil
+}
+
+// describeLabels formats labels as a sorted, comma separated list.
+func describeLabels(m map[string]string) string {
+	kvs := make([]string, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// setLabels runs the label and annotate commands, which change the labels
+// and annotations of a route respectively.
+func setLabels(laddr net.Addr, args []string, annotations bool) {
+	cmd, res := "label", "labels"
+	if annotations {
+		cmd, res = "annotate", "annotations"
+	}
+
+	if len(args) < 2 {
+		errorf("routes %s name key=value|key- ...\n", cmd)
+	}
+
+	rt := loadRoute(laddr, args[0])
+
+	cur := rt.Labels
+	if annotations {
+		cur = rt.Annotations
+	}
+
+	m, err := applyLabels(cur, args[1:])
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	err = sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/%s", rt.Name, res),
+		ifMatch(rt),
+		m,
+		&m)
+	checkWrite(err, res)
+
+	fmt.Printf("%s: %s\n", rt.Name, describeLabels(m))
+}
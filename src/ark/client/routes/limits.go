@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"ark/store"
+)
+
+func setLimits(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("limits", flag.PanicOnError)
+	flagRate := f.Int("rate", 0, "requests per second for each client")
+	flagBurst := f.Int("burst", 0, "requests over the rate that are served immediately")
+	flagConns := f.Int("conns", 0, "concurrent connections for each client")
+	flagKeyHeader := f.String("key-header", "",
+		"request header that identifies clients instead of their address")
+	flagOff := f.Bool("off", false, "remove the route's limits")
+	f.Parse(args)
+
+	if f.NArg() != 1 {
+		errorLn("routes limits [-rate=n] [-burst=n] [-conns=n] [-key-header=h] [-off] name")
+	}
+
+	var l *store.Limits
+	if !*flagOff {
+		l = &store.Limits{
+			Rate:        int32(*flagRate),
+			Burst:       int32(*flagBurst),
+			Connections: int32(*flagConns),
+			KeyHeader:   *flagKeyHeader,
+		}
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/limits", rt.Name),
+		ifMatch(rt),
+		l,
+		&l)
+	checkWrite(err, "limits")
+
+	if l == nil {
+		fmt.Printf("%s: not limited\n", rt.Name)
+		return
+	}
+
+	fmt.Printf("%s: rate=%d burst=%d conns=%d key-header=%q\n",
+		rt.Name, l.Rate, l.Burst, l.Connections, l.KeyHeader)
+}
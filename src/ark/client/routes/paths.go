@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"ark/store"
+)
+
+// loadRoute fetches the named route or exits.
+func loadRoute(laddr net.Addr, name string) *store.Route {
+	var rt store.Route
+	if err := getJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s", name),
+		&rt); err != nil {
+		errorLn(err.Error())
+	}
+	return &rt
+}
+
+// setPaths replaces the path rules of rt, failing if the route has changed
+// since it was read.
+func setPaths(laddr net.Addr, rt *store.Route, rules []*store.PathRule) {
+	if rules == nil {
+		rules = []*store.PathRule{}
+	}
+
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/paths", rt.Name),
+		ifMatch(rt),
+		&rules,
+		&rules)
+	checkWrite(err, "paths")
+
+	printPaths(rules)
+}
+
+func printPaths(rules []*store.PathRule) {
+	fmt.Printf("% 3s  %- 7s %- 30s %s\n", "#", "MATCH", "PATH", "BACKENDS")
+	for i, p := range rules {
+		fmt.Printf("% 3d  %- 7s %- 30s %s\n",
+			i,
+			p.MatchType(),
+			p.Path,
+			strings.Join(p.Backends, ","))
+	}
+}
+
+func listPaths(laddr net.Addr, args []string) {
+	if len(args) != 1 {
+		errorLn("routes paths ls name")
+	}
+
+	printPaths(loadRoute(laddr, args[0]).Paths)
+}
+
+func addPath(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("add-path", flag.PanicOnError)
+	flagMatch := f.String("match", store.MatchPrefix, "prefix, exact or regex")
+	flagAt := f.Int("at", -1, "position of the rule, the end by default")
+	f.Parse(args)
+
+	if f.NArg() < 3 {
+		errorLn("routes paths add [-match=prefix] [-at=n] name path backend...")
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	p := &store.PathRule{
+		Match:    *flagMatch,
+		Path:     f.Arg(1),
+		Backends: f.Args()[2:],
+	}
+
+	at := *flagAt
+	if at < 0 || at > len(rt.Paths) {
+		at = len(rt.Paths)
+	}
+
+	rules := make([]*store.PathRule, 0, len(rt.Paths)+1)
+	rules = append(rules, rt.Paths[:at]...)
+	rules = append(rules, p)
+	rules = append(rules, rt.Paths[at:]...)
+
+	setPaths(laddr, rt, rules)
+}
+
+func removePath(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("rm-path", flag.PanicOnError)
+	flagMatch := f.String("match", store.MatchPrefix, "prefix, exact or regex")
+	f.Parse(args)
+
+	if f.NArg() != 2 {
+		errorLn("routes paths rm [-match=prefix] name path")
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	var rules []*store.PathRule
+	for _, p := range rt.Paths {
+		if p.MatchType() == *flagMatch && p.Path == f.Arg(1) {
+			continue
+		}
+		rules = append(rules, p)
+	}
+
+	if len(rules) == len(rt.Paths) {
+		errorf("no %s rule for %s\n", *flagMatch, f.Arg(1))
+	}
+
+	setPaths(laddr, rt, rules)
+}
+
+func runPaths(laddr net.Addr, args []string) {
+	if len(args) < 1 {
+		errorLn("routes paths ls|add|rm")
+	}
+
+	switch args[0] {
+	case "ls":
+		listPaths(laddr, args[1:])
+	case "add":
+		addPath(laddr, args[1:])
+	case "rm":
+		removePath(laddr, args[1:])
+	default:
+		errorf("'%s' is not a paths command.\n", args[0])
+	}
+}
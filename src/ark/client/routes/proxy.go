@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"ark/store"
+)
+
+func setProxy(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("proxy", flag.PanicOnError)
+	flagWebsocket := f.Bool("websocket", false, "pass websocket upgrades to the backends")
+	flagNoBuffering := f.Bool("no-buffering", false, "send responses as they are received")
+	flagConnect := f.Int("connect-timeout", 0, "seconds to wait for a backend to accept")
+	flagRead := f.Int("read-timeout", 0, "seconds to wait between reads from a backend")
+	flagSend := f.Int("send-timeout", 0, "seconds to wait between writes to a backend")
+	flagMaxBody := f.Int("max-body", 0, "largest request body in megabytes")
+	flagReset := f.Bool("reset", false, "restore the defaults")
+	f.Parse(args)
+
+	if f.NArg() != 1 {
+		errorLn("routes proxy [-websocket] [-no-buffering] [-connect-timeout=s] " +
+			"[-read-timeout=s] [-send-timeout=s] [-max-body=mb] [-reset] name")
+	}
+
+	var o *store.ProxyOptions
+	if !*flagReset {
+		o = &store.ProxyOptions{
+			Websocket:        *flagWebsocket,
+			DisableBuffering: *flagNoBuffering,
+			ConnectTimeout:   int32(*flagConnect),
+			ReadTimeout:      int32(*flagRead),
+			SendTimeout:      int32(*flagSend),
+			MaxBodySize:      int32(*flagMaxBody),
+		}
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/proxy", rt.Name),
+		ifMatch(rt),
+		o,
+		&o)
+	checkWrite(err, "proxy options")
+
+	if o == nil {
+		fmt.Printf("%s: defaults\n", rt.Name)
+		return
+	}
+
+	fmt.Printf("%s: websocket=%t no-buffering=%t connect-timeout=%d "+
+		"read-timeout=%d send-timeout=%d max-body=%d\n",
+		rt.Name,
+		o.Websocket,
+		o.DisableBuffering,
+		o.ConnectTimeout,
+		o.ReadTimeoutOrDefault(),
+		o.SendTimeout,
+		o.MaxBodySize)
+}
@@ -8,8 +8,11 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"ark/store"
 )
@@ -17,13 +20,30 @@ import (
 const (
 	routesCmd   = "routes"
 	backendsCmd = "backends"
+	backupCmd   = "backup"
+	restoreCmd  = "restore"
+	auditCmd    = "audit"
+	certsCmd    = "certs"
+	canaryCmd   = "canary"
 )
 
 var errNotImplemented = errors.New("not implemented")
 
+// conflictError is returned when the server rejects a write because the
+// route changed since it was read.
+type conflictError string
+
+func (e conflictError) Error() string {
+	return string(e)
+}
+
 // CanRun ...
 func CanRun(args []string) bool {
-	return args[0] == routesCmd || args[0] == backendsCmd
+	switch args[0] {
+	case routesCmd, backendsCmd, backupCmd, restoreCmd, auditCmd, certsCmd, canaryCmd:
+		return true
+	}
+	return false
 }
 
 // Run ...
@@ -33,6 +53,16 @@ func Run(laddr net.Addr, args []string) {
 		runRoutes(laddr, args)
 	case backendsCmd:
 		runBackends(laddr, args)
+	case backupCmd:
+		runBackup(laddr, args[1:])
+	case restoreCmd:
+		runRestore(laddr, args[1:])
+	case auditCmd:
+		runAudit(laddr, args[1:])
+	case certsCmd:
+		runCerts(laddr, args[1:])
+	case canaryCmd:
+		runCanary(laddr, args[1:])
 	default:
 		fmt.Fprintf(os.Stderr, "'%s' is not a command", args[1])
 		os.Exit(1)
@@ -67,6 +97,10 @@ func decodeJSON(res *http.Response, data interface{}) error {
 			http.StatusText(res.StatusCode))
 	}
 
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return conflictError(e.Error)
+	}
+
 	return errors.New(e.Error)
 }
 
@@ -80,16 +114,28 @@ func getJSON(laddr net.Addr, uri string, dst interface{}) error {
 	return decodeJSON(res, dst)
 }
 
-func postJSON(laddr net.Addr, uri string, src, dst interface{}) error {
+func sendJSON(
+	method string,
+	laddr net.Addr,
+	uri string,
+	hdr http.Header,
+	src, dst interface{}) error {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(src); err != nil {
 		return err
 	}
 
-	res, err := http.Post(
-		fmt.Sprintf("http://%s%s", laddr.String(), uri),
-		"application/json",
-		&buf)
+	req, err := http.NewRequest(method, urlFor(laddr, uri), &buf)
+	if err != nil {
+		return err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var c http.Client
+	res, err := c.Do(req)
 	if err != nil {
 		return err
 	}
@@ -98,6 +144,29 @@ func postJSON(laddr net.Addr, uri string, src, dst interface{}) error {
 	return decodeJSON(res, dst)
 }
 
+func postJSON(laddr net.Addr, uri string, src, dst interface{}) error {
+	return sendJSON("POST", laddr, uri, nil, src, dst)
+}
+
+func putJSON(laddr net.Addr, uri string, src, dst interface{}) error {
+	return sendJSON("PUT", laddr, uri, nil, src, dst)
+}
+
+// ifMatch returns the header that makes a write fail with a conflictError if
+// the route changed since rt was read.
+func ifMatch(rt *store.Route) http.Header {
+	return http.Header{"If-Match": {fmt.Sprintf("\"%d\"", rt.Version)}}
+}
+
+// checkWrite exits if the write of what to a route failed.
+func checkWrite(err error, what string) {
+	if _, ok := err.(conflictError); ok {
+		errorf("conflict: %s\n%s not changed, run the command again.\n", err, what)
+	} else if err != nil {
+		errorLn(err.Error())
+	}
+}
+
 func errorLn(msg string) {
 	fmt.Fprintln(os.Stderr, msg)
 	os.Exit(1)
@@ -109,6 +178,26 @@ func errorf(format string, args ...interface{}) {
 }
 
 func deleteRoute(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("rm", flag.PanicOnError)
+	flagSelector := f.String("l", "", "remove every route whose labels match this selector")
+	f.Parse(args)
+
+	if *flagSelector != "" && f.NArg() == 0 {
+		if err := postJSON(
+			laddr,
+			"/api/v1/batch",
+			[]*batchOp{{Op: "delete", Selector: *flagSelector}},
+			nil); err != nil {
+			errorLn(err.Error())
+		}
+		return
+	}
+
+	if *flagSelector != "" || f.NArg() != 1 {
+		errorLn("routes rm name | routes rm -l selector")
+	}
+	args = f.Args()
+
 	req, err := http.NewRequest(
 		"DELETE",
 		urlFor(laddr, fmt.Sprintf("/api/v1/routes/%s", args[0])),
@@ -132,16 +221,45 @@ func deleteRoute(laddr net.Addr, args []string) {
 func createRoutes(laddr net.Addr, args []string) {
 	f := flag.NewFlagSet("create-routes", flag.PanicOnError)
 	flagPort := f.Int("port", 80, "tcp port")
+	flagCert := f.String("cert", "", "name of the certificate to serve the route over tls")
+	flagTLS := f.String("tls", "", "'auto' to serve the route over tls with a certificate from acme")
+	flagProtocol := f.String("protocol", "", "'tcp' or 'udp' to proxy a raw stream instead of http")
+	flagRedirect := f.String("redirect", "", "url to redirect every request to instead of proxying")
+	flagRedirectCode := f.Int("redirect-code", 0, "status of the redirect, 301 by default")
+	flagPreservePath := f.Bool("preserve-path", false, "append the request path and query to the redirect")
+	flagForceHTTPS := f.Bool("force-https", false, "redirect plain http on port 80 to the route")
+	flagLabels := f.String("labels", "", "comma separated labels, e.g. team=web,env=prod")
 	f.Parse(args)
 
-	if f.NArg() < 2 {
+	// stream routes have no hosts.
+	if f.NArg() < 2 && !(f.NArg() == 1 && *flagProtocol != "") {
 		errorLn("routes create help")
 	}
 
 	rt := store.Route{
-		Name:  f.Arg(0),
-		Port:  int32(*flagPort),
-		Hosts: f.Args()[1:],
+		Name:       f.Arg(0),
+		Port:       int32(*flagPort),
+		Hosts:      f.Args()[1:],
+		Cert:       *flagCert,
+		Tls:        *flagTLS,
+		Protocol:   *flagProtocol,
+		ForceHttps: *flagForceHTTPS,
+	}
+
+	if *flagLabels != "" {
+		labels, err := applyLabels(nil, strings.Split(*flagLabels, ","))
+		if err != nil {
+			errorLn(err.Error())
+		}
+		rt.Labels = labels
+	}
+
+	if *flagRedirect != "" {
+		rt.Redirect = &store.Redirect{
+			To:           *flagRedirect,
+			Code:         int32(*flagRedirectCode),
+			PreservePath: *flagPreservePath,
+		}
 	}
 
 	if err := postJSON(laddr, "/api/v1/routes", &rt, &rt); err != nil {
@@ -152,21 +270,170 @@ func createRoutes(laddr net.Addr, args []string) {
 }
 
 func listRoutes(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("list-routes", flag.PanicOnError)
+	flagHost := f.String("host", "", "only list routes serving this host")
+	flagBackend := f.String("backend", "", "only list routes with this backend")
+	flagSelector := f.String("l", "", "only list routes whose labels match this selector, e.g. team=web")
+	f.Parse(args)
+
+	q := url.Values{}
+	if *flagHost != "" {
+		q.Set("host", *flagHost)
+	}
+	if *flagBackend != "" {
+		q.Set("backend", *flagBackend)
+	}
+	if *flagSelector != "" {
+		q.Set("selector", *flagSelector)
+	}
+
+	uri := "/api/v1/routes"
+	if len(q) > 0 {
+		uri += "?" + q.Encode()
+	}
+
 	var rts []*store.Route
-	if err := getJSON(laddr, "/api/v1/routes", &rts); err != nil {
+	if err := getJSON(laddr, uri, &rts); err != nil {
 		errorLn(err.Error())
 	}
 
-	fmt.Printf("%- 15s % 5s  %- 30s %-30s\n", "NAME", "PORT", "HOSTS", "BACKENDS")
+	fmt.Printf("%- 15s % 9s  %- 9s %- 30s %- 30s %s\n",
+		"NAME", "PORT", "STATE", "HOSTS", "BACKENDS", "LABELS")
 	for _, rt := range rts {
-		fmt.Printf("%- 15s % 5d  %- 30s %- 30s\n",
+		state := "enabled"
+		if rt.Disabled {
+			state = "disabled"
+		}
+
+		port := strconv.Itoa(int(rt.Port))
+		if rt.IsStream() {
+			port += "/" + rt.Protocol
+		}
+
+		bes := strings.Join(rt.Backends, ",")
+		if rt.Redirect != nil {
+			bes = fmt.Sprintf("%d %s", rt.Redirect.StatusCode(), rt.Redirect.To)
+		}
+
+		fmt.Printf("%- 15s % 9s  %- 9s %- 30s %- 30s %s\n",
 			rt.Name,
+			port,
+			state,
+			strings.Join(rt.Hosts, ","),
+			bes,
+			describeLabels(rt.Labels))
+	}
+}
+
+func setDisabled(laddr net.Addr, args []string, disabled bool) {
+	op := "enable"
+	if disabled {
+		op = "disable"
+	}
+
+	f := flag.NewFlagSet(op, flag.PanicOnError)
+	flagSelector := f.String("l", "", "apply to every route whose labels match this selector")
+	f.Parse(args)
+
+	if *flagSelector != "" && f.NArg() == 0 {
+		var rts []*store.Route
+		if err := postJSON(
+			laddr,
+			"/api/v1/batch",
+			[]*batchOp{{Op: op, Selector: *flagSelector}},
+			&rts); err != nil {
+			errorLn(err.Error())
+		}
+
+		for _, rt := range rts {
+			fmt.Printf("%s: %sd\n", rt.Name, op)
+		}
+		return
+	}
+
+	if *flagSelector != "" || f.NArg() != 1 {
+		errorf("routes %s name | routes %s -l selector\n", op, op)
+	}
+	args = f.Args()
+
+	var rt store.Route
+	if err := postJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/%s", args[0], op),
+		nil,
+		&rt); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("%s: %sd\n", rt.Name, op)
+}
+
+func routeHistory(laddr net.Addr, args []string) {
+	if len(args) != 1 {
+		errorLn("routes history name")
+	}
+
+	var revs []*store.Revision
+	if err := getJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/history", args[0]),
+		&revs); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("% 5s  %- 20s %- 12s %- 7s %- 5s  %- 30s %-30s\n",
+		"REV", "TIME", "USER", "OP", "PORT", "HOSTS", "BACKENDS")
+	for _, rev := range revs {
+		rt := rev.Route
+		if rt == nil {
+			rt = &store.Route{}
+		}
+
+		fmt.Printf("% 5d  %- 20s %- 12s %- 7s % 5d  %- 30s %- 30s\n",
+			rev.Revision,
+			time.Unix(rev.Time, 0).Format("2006-01-02 15:04:05"),
+			rev.User,
+			rev.Op.String(),
 			rt.Port,
 			strings.Join(rt.Hosts, ","),
 			strings.Join(rt.Backends, ","))
 	}
 }
 
+func rollbackRoute(laddr net.Addr, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		errorLn("routes rollback name [rev]")
+	}
+
+	var req struct {
+		Revision int64 `json:"revision"`
+	}
+
+	if len(args) == 2 {
+		rev, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			errorf("invalid revision: %s\n", args[1])
+		}
+		req.Revision = rev
+	}
+
+	var rt store.Route
+	if err := postJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/rollback", args[0]),
+		&req,
+		&rt); err != nil {
+		errorLn(err.Error())
+	}
+
+	if rt.Name == "" {
+		fmt.Printf("%s deleted\n", args[0])
+		return
+	}
+
+	fmt.Println(rt.Name)
+}
+
 func runRoutes(laddr net.Addr, args []string) {
 	if len(args) < 2 {
 		routesUsage()
@@ -179,6 +446,36 @@ func runRoutes(laddr net.Addr, args []string) {
 		deleteRoute(laddr, args[2:])
 	case "ls":
 		listRoutes(laddr, args[2:])
+	case "label":
+		setLabels(laddr, args[2:], false)
+	case "annotate":
+		setLabels(laddr, args[2:], true)
+	case "disable":
+		setDisabled(laddr, args[2:], true)
+	case "enable":
+		setDisabled(laddr, args[2:], false)
+	case "history":
+		routeHistory(laddr, args[2:])
+	case "rollback":
+		rollbackRoute(laddr, args[2:])
+	case "paths":
+		runPaths(laddr, args[2:])
+	case "groups":
+		runGroups(laddr, args[2:])
+	case "health":
+		setHealth(laddr, args[2:])
+	case "headers":
+		runHeaders(laddr, args[2:])
+	case "auth":
+		runAuth(laddr, args[2:])
+	case "limits":
+		setLimits(laddr, args[2:])
+	case "proxy":
+		setProxy(laddr, args[2:])
+	case "static":
+		setStatic(laddr, args[2:])
+	case "maintenance":
+		setMaintenance(laddr, args[2:])
 	default:
 		errorf("'%s' is not a routes command.\n", args[1])
 	}
@@ -190,32 +487,162 @@ func backendsUsage() {
 	os.Exit(1)
 }
 
+// backendSpec is a backend and its options as sent to the backends api.
+type backendSpec struct {
+	Addr string `json:"addr"`
+	store.BackendOptions
+}
+
+// parseBackendSpec parses a backend given on the command line in the form
+// addr[=weight][,backup][,max_fails=n][,fail_timeout=seconds].
+func parseBackendSpec(s string) (*backendSpec, error) {
+	parts := strings.Split(s, ",")
+
+	spec := &backendSpec{Addr: parts[0]}
+	if ix := strings.Index(parts[0], "="); ix >= 0 {
+		w, err := strconv.Atoi(parts[0][ix+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight: %s", s)
+		}
+		spec.Addr, spec.Weight = parts[0][:ix], int32(w)
+	}
+
+	for _, opt := range parts[1:] {
+		if opt == "backup" {
+			spec.Backup = true
+			continue
+		}
+
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option: %s", opt)
+		}
+
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid option: %s", opt)
+		}
+
+		switch kv[0] {
+		case "weight":
+			spec.Weight = int32(n)
+		case "max_fails":
+			spec.MaxFails = int32(n)
+		case "fail_timeout":
+			spec.FailTimeout = int32(n)
+		default:
+			return nil, fmt.Errorf("invalid option: %s", opt)
+		}
+	}
+
+	return spec, nil
+}
+
+// describeOptions formats backend options the way they are given to
+// backends set.
+func describeOptions(o *store.BackendOptions) string {
+	if o == nil {
+		return ""
+	}
+
+	var s string
+	if o.Weight > 0 {
+		s += fmt.Sprintf("=%d", o.Weight)
+	}
+
+	if o.Backup {
+		s += ",backup"
+	}
+
+	if o.MaxFails > 0 {
+		s += fmt.Sprintf(",max_fails=%d", o.MaxFails)
+	}
+
+	if o.FailTimeout > 0 {
+		s += fmt.Sprintf(",fail_timeout=%d", o.FailTimeout)
+	}
+
+	return s
+}
+
 func setBackends(laddr net.Addr, name string, args []string) {
-	var bes []string
-	if err := postJSON(
+	f := flag.NewFlagSet("set-backends", flag.PanicOnError)
+	flagBalance := f.String("balance", "",
+		"round_robin, least_conn, ip_hash or hash, unchanged by default")
+	flagHashHeader := f.String("hash-header", "", "request header to hash with -balance=hash")
+	f.Parse(args)
+
+	req := struct {
+		Backends   []*backendSpec `json:"backends"`
+		Balance    *string        `json:"balance,omitempty"`
+		HashHeader *string        `json:"hash_header,omitempty"`
+	}{
+		Backends: []*backendSpec{},
+	}
+
+	for _, arg := range f.Args() {
+		spec, err := parseBackendSpec(arg)
+		if err != nil {
+			errorLn(err.Error())
+		}
+		req.Backends = append(req.Backends, spec)
+	}
+
+	if *flagBalance != "" {
+		req.Balance, req.HashHeader = flagBalance, flagHashHeader
+	}
+
+	// Read the route first so the write fails, rather than silently
+	// clobbering, if anyone else changes it in the meantime.
+	var rt store.Route
+	if err := getJSON(
 		laddr,
-		fmt.Sprintf("/api/v1/routes/%s/backends", name),
-		&args,
-		&bes); err != nil {
+		fmt.Sprintf("/api/v1/routes/%s", name),
+		&rt); err != nil {
 		errorLn(err.Error())
 	}
 
+	var bes []string
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/backends", name),
+		ifMatch(&rt),
+		&req,
+		&bes)
+	checkWrite(err, "backends")
+
 	for _, be := range bes {
 		fmt.Println(be)
 	}
 }
 
 func getBackends(laddr net.Addr, name string) {
-	var bes []string
+	var rt store.Route
 	if err := getJSON(
 		laddr,
-		fmt.Sprintf("/api/v1/routes/%s/backends", name),
+		fmt.Sprintf("/api/v1/routes/%s", name),
+		&rt); err != nil {
+		errorLn(err.Error())
+	}
+
+	var bes []*backendHealth
+	if err := getJSON(
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/backends?health=1", name),
 		&bes); err != nil {
 		errorLn(err.Error())
 	}
 
+	if rt.Balance != "" {
+		fmt.Printf("balance: %s %s\n", rt.Balance, rt.HashHeader)
+	}
+
 	for _, be := range bes {
-		fmt.Println(be)
+		fmt.Printf("%s%s%s\n",
+			be.Backend,
+			describeOptions(rt.BackendOptions[be.Addr]),
+			describeHealth(rt.HealthCheck, be))
 	}
 }
 
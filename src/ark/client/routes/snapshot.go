@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"ark/store"
+)
+
+func runBackup(laddr net.Addr, args []string) {
+	var sn store.Snapshot
+	if err := getJSON(laddr, "/api/v1/snapshot", &sn); err != nil {
+		errorLn(err.Error())
+	}
+
+	b, err := json.MarshalIndent(&sn, "", "  ")
+	if err != nil {
+		errorLn(err.Error())
+	}
+
+	if _, err := fmt.Fprintf(os.Stdout, "%s\n", b); err != nil {
+		errorLn(err.Error())
+	}
+}
+
+func describeRoute(rt *store.Route) string {
+	return fmt.Sprintf("port=%d hosts=%s backends=%s",
+		rt.Port,
+		strings.Join(rt.Hosts, ","),
+		strings.Join(rt.Backends, ","))
+}
+
+func printDiff(d *store.Diff) {
+	for _, rt := range d.Added {
+		fmt.Printf("+ %s  %s\n", rt.Name, describeRoute(rt))
+	}
+
+	for _, c := range d.Changed {
+		fmt.Printf("~ %s  %s\n", c.To.Name, describeRoute(c.From))
+		fmt.Printf("  %s  %s\n", strings.Repeat(" ", len(c.To.Name)), describeRoute(c.To))
+	}
+
+	for _, rt := range d.Removed {
+		fmt.Printf("- %s  %s\n", rt.Name, describeRoute(rt))
+	}
+}
+
+func runRestore(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("restore", flag.PanicOnError)
+	flagDryRun := f.Bool("n", false, "only show the changes a restore would make")
+	f.Parse(args)
+
+	var sn store.Snapshot
+	if err := json.NewDecoder(os.Stdin).Decode(&sn); err != nil {
+		errorf("invalid snapshot: %s\n", err)
+	}
+
+	var d store.Diff
+	if err := putJSON(laddr, "/api/v1/snapshot?dry_run=1", &sn, &d); err != nil {
+		errorLn(err.Error())
+	}
+
+	if d.Empty() && len(sn.Certs) == 0 {
+		fmt.Println("nothing to restore")
+		return
+	}
+
+	printDiff(&d)
+	for _, c := range sn.Certs {
+		fmt.Printf("* certificate %s\n", c.Name)
+	}
+
+	if *flagDryRun {
+		return
+	}
+
+	if err := putJSON(laddr, "/api/v1/snapshot", &sn, &d); err != nil {
+		errorLn(err.Error())
+	}
+
+	fmt.Printf("restored %d routes and %d certificates\n", len(sn.Routes), len(sn.Certs))
+}
@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+
+	"ark/store"
+)
+
+func setStatic(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("static", flag.PanicOnError)
+	flagRm := f.Bool("rm", false, "remove the static content")
+	f.Parse(args)
+
+	if (*flagRm && f.NArg() != 1) || (!*flagRm && f.NArg() != 2) {
+		errorLn("routes static name site.tar.gz | routes static -rm name")
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+	uri := fmt.Sprintf("/api/v1/routes/%s/static", rt.Name)
+
+	var req *http.Request
+	var err error
+	if *flagRm {
+		req, err = http.NewRequest("DELETE", urlFor(laddr, uri), nil)
+	} else {
+		var r *os.File
+		r, err = os.Open(f.Arg(1))
+		if err != nil {
+			errorLn(err.Error())
+		}
+		defer r.Close()
+
+		req, err = http.NewRequest("PUT", urlFor(laddr, uri), r)
+	}
+	if err != nil {
+		errorLn(err.Error())
+	}
+	req.Header = ifMatch(rt)
+
+	var c http.Client
+	res, err := c.Do(req)
+	if err != nil {
+		errorLn(err.Error())
+	}
+	defer res.Body.Close()
+
+	var s *store.Static
+	err = decodeJSON(res, &s)
+	checkWrite(err, "static content")
+
+	if s == nil {
+		fmt.Printf("%s: no static content\n", rt.Name)
+		return
+	}
+
+	fmt.Printf("%s: %s\n", rt.Name, s.Digest)
+}
+
+func setMaintenance(laddr net.Addr, args []string) {
+	f := flag.NewFlagSet("maintenance", flag.PanicOnError)
+	flagPage := f.String("page", "", "html file to show while in maintenance")
+	f.Parse(args)
+
+	if f.NArg() != 2 || (f.Arg(1) != "on" && f.Arg(1) != "off") {
+		errorLn("routes maintenance [-page=down.html] name on|off")
+	}
+
+	rt := loadRoute(laddr, f.Arg(0))
+
+	// the page is kept when maintenance is turned off, so that it need not be
+	// given again next time.
+	m := &store.Maintenance{Enabled: f.Arg(1) == "on"}
+	if *flagPage != "" {
+		b, err := ioutil.ReadFile(*flagPage)
+		if err != nil {
+			errorLn(err.Error())
+		}
+		m.Page = string(b)
+	} else if rt.Maintenance != nil {
+		m.Page = rt.Maintenance.Page
+	}
+
+	err := sendJSON(
+		"POST",
+		laddr,
+		fmt.Sprintf("/api/v1/routes/%s/maintenance", rt.Name),
+		ifMatch(rt),
+		m,
+		&m)
+	checkWrite(err, "maintenance")
+
+	state := "off"
+	if m.Enabled {
+		state = "on"
+	}
+	fmt.Printf("%s: maintenance %s\n", rt.Name, state)
+}
@@ -20,11 +20,53 @@ func usage() {
 }
 
 func run(addr net.Addr, args []string) {
-	// routes create --port=80 name host1 host2
-	// routes ls
-	// routes rm name
-	// backends name set upstrea1 upstream2
+	// routes create --port=80 [--cert=name|--tls=auto] name host1 host2
+	// routes create --port=5432 --protocol=tcp name
+	// routes create [--redirect-code=301] [--preserve-path] --redirect=https://a.com name www.a.com
+	// routes create --port=443 --tls=auto --force-https name a.com
+	// routes create --labels=team=web,env=prod name a.com
+	// routes ls [-l team=web,env!=prod]
+	// routes rm name | -l env=staging
+	// routes disable name | -l env=staging
+	// routes enable name | -l env=staging
+	// routes label name team=web env-
+	// routes annotate name example.com/ticket=https://tickets/123
+	// routes history name
+	// routes rollback name [rev]
+	// routes paths ls name
+	// routes paths add [-match=prefix] [-at=n] name path backend1 backend2
+	// routes paths rm [-match=prefix] name path
+	// routes groups ls name
+	// routes groups add [-weight=0] name v2 backend1 backend2
+	// routes groups weight name v2 25
+	// routes groups promote name v2
+	// routes groups rm name v2
+	// routes headers ls name
+	// routes headers set [-response] name X-Frame-Options DENY
+	// routes headers add name Link "</a.css>; rel=preload"
+	// routes headers strip [-response] name Server
+	// routes headers rm [-response] name X-Frame-Options
+	// routes auth ls name
+	// routes auth add-user name user < password
+	// routes auth rm-user name user
+	// routes auth allow name 10.0.0.0/8 192.168.1.4
+	// routes auth deny name all
+	// routes auth clear name
+	// routes limits [-rate=10] [-burst=20] [-conns=5] [-key-header=X-Api-Key] [-off] name
+	// routes proxy [-websocket] [-no-buffering] [-read-timeout=60] [-max-body=10] [-reset] name
+	// routes static name site.tar.gz
+	// routes static -rm name
+	// routes maintenance [-page=down.html] name on|off
+	// routes health [-path=/health] [-interval=10] [-fall=2] [-rise=1] [-off] name
+	// backends name set [-balance=least_conn] upstream1=3 upstream2=1,backup
 	// backends name get
+	// backup > file
+	// restore [-n] < file
+	// audit [-n 50] [-u user] [-r route]
+	// certs add name cert.pem key.pem
+	// certs ls [-days 30]
+	// certs rm name
+	// canary name -to v2 [-steps=5,25,50,100] [-interval=2m] [-no-promote]
 
 	if routes.CanRun(args) {
 		routes.Run(addr, args)
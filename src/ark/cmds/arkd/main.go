@@ -1,38 +1,181 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"time"
 
+	"golang.org/x/net/context"
+
+	"ark/acme"
 	"ark/api"
 	"ark/fe/nginx"
+	"ark/health"
 	"ark/store"
 )
 
+// runMigrate implements `arkd [-data=...] migrate [-dry-run]`, which upgrades
+// the store to the current schema without starting the server.
+func runMigrate(data string, args []string) {
+	f := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flagDryRun := f.Bool("dry-run", false,
+		"report the migrations that would run without changing the store")
+	f.Parse(args)
+
+	res, err := store.Migrate(data, *flagDryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(res) == 0 {
+		fmt.Printf("store is at schema version %d\n", store.SchemaVersion)
+		return
+	}
+
+	for _, r := range res {
+		fmt.Printf("%d: %s (%d puts, %d deletes)\n",
+			r.Version,
+			r.Description,
+			r.Puts,
+			r.Deletes)
+	}
+
+	if *flagDryRun {
+		fmt.Println("dry run: the store was not changed")
+	}
+}
+
+// runFsck implements `arkd [-data=...] fsck [-dry-run]`, which reports and
+// quarantines routes that cannot be parsed or are not valid.
+func runFsck(data string, args []string) {
+	f := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flagDryRun := f.Bool("dry-run", false,
+		"report problems without quarantining them")
+	f.Parse(args)
+
+	probs, err := store.Fsck(data, api.ValidateRoute, *flagDryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(probs) == 0 {
+		fmt.Println("no problems found")
+		return
+	}
+
+	for _, p := range probs {
+		fmt.Printf("%q: %s\n", p.Name, p.Reason)
+	}
+
+	if *flagDryRun {
+		fmt.Printf("dry run: %d records were not quarantined\n", len(probs))
+	} else {
+		fmt.Printf("quarantined %d records\n", len(probs))
+	}
+}
+
+// localAddr returns an address that nginx can use to reach arkd when it
+// listens on addr.
+func localAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
 func main() {
 	flagAddr := flag.String("addr", ":6660", "")
 	flagSock := flag.String("sock", "/var/run/docker.sock", "")
-	flagStore := flag.String("data", "routes.db", "")
+	flagStore := flag.String("data", "routes.db",
+		"route store: a leveldb path or a leveldb://, bolt://, file:// or mem:// URL")
+	flagACME := flag.String("acme-directory", "",
+		"ACME directory used to obtain certificates for routes with -tls=auto, "+
+			"e.g. "+acme.LetsEncryptURL)
+	flagACMEEmail := flag.String("acme-email", "", "contact email for the ACME account")
+	flagACMEInsecure := flag.Bool("acme-insecure", false,
+		"skip verifying the ACME directory's certificate, for testing against pebble")
+	flagStatic := flag.String("static-dir", nginx.DefaultOptions.StaticDir,
+		"directory that holds the static content uploaded to routes")
+	flagStream := flag.String("stream-dir", "",
+		"directory for the configuration of tcp and udp routes, e.g. /etc/nginx/stream.d; "+
+			"nginx must be built with the stream module")
 	flag.Parse()
 
+	if flag.Arg(0) == "migrate" {
+		runMigrate(*flagStore, flag.Args()[1:])
+		return
+	}
+
+	if flag.Arg(0) == "fsck" {
+		runFsck(*flagStore, flag.Args()[1:])
+		return
+	}
+
 	db, err := store.Open(*flagStore)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	fe, err := nginx.Start(nil)
+	opts := nginx.DefaultOptions
+	opts.StaticDir = *flagStatic
+	opts.StreamDir = *flagStream
+	if *flagACME != "" {
+		opts.ChallengeAddr = localAddr(*flagAddr)
+	}
+
+	fe, err := nginx.Start(&opts)
 	if err != nil {
 		log.Panic(err)
 	}
 
+	// backends that fail their health checks are kept out of nginx.
+	checker := health.NewChecker(fe)
+
 	ctx := api.Context{
 		Store:        db,
-		LoadBalancer: fe,
+		LoadBalancer: checker,
+		Health:       checker,
+		StaticDir:    *flagStatic,
 		DockerDialer: func() (net.Conn, error) {
 			return net.Dial("unix", *flagSock)
 		},
 	}
 
+	// nginx is still running with the config that the last arkd wrote, so
+	// bring it up to date and start checking backends before serving.
+	if err := ctx.Update(); err != nil {
+		log.Panic(err)
+	}
+
+	if *flagACME != "" {
+		m := &acme.Manager{
+			Store:        db,
+			DirectoryURL: *flagACME,
+			Email:        *flagACMEEmail,
+			Update:       ctx.Update,
+		}
+
+		if *flagACMEInsecure {
+			m.HTTPClient = &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				},
+			}
+		}
+
+		ctx.ACME = m
+		go m.Run(context.Background(), time.Hour)
+	}
+
 	log.Panic(api.ListenAndServe(*flagAddr, &ctx))
 }
@@ -4,5 +4,7 @@ import "ark/store"
 
 // Service ...
 type Service interface {
-	Update([]*store.Route) error
+	// Update replaces the configuration with the routes and the
+	// certificates that they refer to.
+	Update(rts []*store.Route, certs []*store.Certificate) error
 }
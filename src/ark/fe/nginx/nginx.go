@@ -1,9 +1,12 @@
 package nginx
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,33 +21,457 @@ import (
 var DefaultOptions = Options{
 	Command:   "nginx",
 	ConfigDir: "/etc/nginx/conf.d",
+	StaticDir: "/var/lib/ark/static",
+	CertDir:   "/etc/nginx/certs",
 }
 
 const tpl = `
+{{if .Proxy}}{{if .Proxy.Websocket}}
+map $http_upgrade $connection_upgrade{{.ID}} {
+  default upgrade;
+  '' close;
+}
+{{end}}{{end}}
+{{if .Groups}}
+split_clients "${remote_addr}${http_user_agent}" $be{{.ID}} {
+{{range $i, $g := .Groups}}{{if $g.Weight}}
+  {{$g.Weight}}% be{{$.ID}}g{{$i}};
+{{end}}{{end}}
+  * be{{.ID}};
+}
+{{end}}
+{{with .Limits}}
+{{if .Rate}}
+limit_req_zone {{limitKey .}} zone=req{{$.ID}}:10m rate={{.Rate}}r/s;
+{{end}}
+{{if .Connections}}
+limit_conn_zone {{limitKey .}} zone=conn{{$.ID}}:10m;
+{{end}}
+{{end}}
+
 server {
+{{if .CertFile}}
+  listen {{.Port}} ssl;
+  ssl_certificate {{.CertFile}};
+  ssl_certificate_key {{.KeyFile}};
+{{else}}
   listen {{.Port}};
-  root /var/www/html;
+{{end}}
+  root {{if .StaticRoot}}{{.StaticRoot}}{{else}}/var/www/html{{end}};
   index index.html;
 
   server_name {{.ServerName}};
-
+{{range responseHeaders .Route}}
+  {{.}}
+{{end}}
+{{range accessRules .Route}}
+  {{.}}
+{{end}}
+{{if .AuthFile}}
+  auth_basic "restricted";
+  auth_basic_user_file {{.AuthFile}};
+{{end}}
+{{range proxyOptions .Route}}
+  {{.}}
+{{end}}
+{{with .Limits}}
+{{if .Rate}}
+  limit_req zone=req{{$.ID}}{{if .Burst}} burst={{.Burst}} nodelay{{end}};
+  limit_req_status 429;
+{{end}}
+{{if .Connections}}
+  limit_conn conn{{$.ID}} {{.Connections}};
+  limit_conn_status 429;
+{{end}}
+{{end}}
+{{if and .ChallengeAddr (not .CertFile)}}
+  location /.well-known/acme-challenge/ {
+    allow all;
+    auth_basic off;
+    proxy_set_header Host $http_host;
+    proxy_pass http://{{.ChallengeAddr}};
+  }
+{{end}}
+{{if .Route.InMaintenance}}
+{{if .MaintenancePage}}
+  error_page 503 /.ark/maintenance.html;
+  location = /.ark/maintenance.html {
+    internal;
+    alias {{.MaintenancePage}};
+  }
+{{end}}
+  location / {
+    return 503;
+  }
+{{else}}
+{{range $i, $p := .Paths}}
+  location {{$p | modifier}}{{$p.Path}} {
+{{if passServer $.Route}}
+    proxy_pass_header Server;
+{{end}}
+    proxy_redirect off;
+{{range requestHeaders $.Route}}
+    {{.}}
+{{end}}
+    proxy_pass http://be{{$.ID}}p{{$i}};
+  }
+{{end}}
+{{if .Redirect}}
   location / {
+    return {{.Redirect.StatusCode}} {{redirectURL .Redirect}};
+  }
+{{else if .Backends}}
+  location / {
+{{if passServer $.Route}}
     proxy_pass_header Server;
-    proxy_set_header Host $http_host;
+{{end}}
     proxy_redirect off;
-    proxy_set_header X-Real-IP $remote_addr;
-    proxy_set_header X-Scheme $scheme;
-    proxy_pass http://be{{.ID}};
+{{range requestHeaders $.Route}}
+    {{.}}
+{{end}}
+    proxy_pass http://{{if .Groups}}${{end}}be{{.ID}};
   }
+{{else if .StaticRoot}}
+  location / {
+    try_files $uri $uri/ =404;
+  }
+{{end}}
+{{end}}
+}
+
+{{if .ForceHttps}}
+server {
+  listen 80;
+  server_name {{.ServerName}};
+{{if .ChallengeAddr}}
+  location /.well-known/acme-challenge/ {
+    proxy_set_header Host $http_host;
+    proxy_pass http://{{.ChallengeAddr}};
+  }
+{{end}}
+  location / {
+    return 301 https://$host{{httpsPort .Port}}$request_uri;
+  }
+}
+{{end}}
+
+{{if .Backends}}
+upstream be{{.ID}} {
+  {{balance .Route}}
+  {{range .Backends}}
+  server {{.}}{{params $.Route .}};
+  {{end}}
+}
+{{end}}
+
+{{range $i, $p := .Paths}}
+upstream be{{$.ID}}p{{$i}} {
+  {{balance $.Route}}
+  {{range $p.Backends}}
+  server {{.}}{{params $.Route .}};
+  {{end}}
+}
+{{end}}
+
+{{range $i, $g := .Groups}}
+upstream be{{$.ID}}g{{$i}} {
+  {{balance $.Route}}
+  {{range $g.Backends}}
+  server {{.}}{{params $.Route .}};
+  {{end}}
+}
+{{end}}
+`
+
+// streamTpl proxies the TCP connections or UDP datagrams of a stream route.
+const streamTpl = `
+{{with .Limits}}
+{{if .Connections}}
+limit_conn_zone $binary_remote_addr zone=conn{{$.ID}}:10m;
+{{end}}
+{{end}}
+
+server {
+  listen {{.Port}}{{if .UDP}} udp{{end}};
+{{range accessRules .Route}}
+  {{.}}
+{{end}}
+{{with .Limits}}
+{{if .Connections}}
+  limit_conn conn{{$.ID}} {{.Connections}};
+{{end}}
+{{end}}
+{{range streamProxyOptions .Route}}
+  {{.}}
+{{end}}
+  proxy_pass be{{.ID}};
 }
 
 upstream be{{.ID}} {
+  {{balance .Route}}
   {{range .Backends}}
-  server {{.}};
+  server {{.}}{{params $.Route .}};
   {{end}}
 }
 `
 
+// streamInclude is written to the stream dir on start and included in the
+// main context of nginx's configuration to load the stream routes.
+const streamInclude = `
+stream {
+  include %s;
+}
+`
+
+// challengeTpl is a server that only answers ACME HTTP-01 challenges for
+// hosts that no other route serves over plain HTTP on port 80.
+const challengeTpl = `
+server {
+  listen 80;
+  server_name {{.ServerName}};
+
+  location /.well-known/acme-challenge/ {
+    proxy_set_header Host $http_host;
+    proxy_pass http://{{.ChallengeAddr}};
+  }
+
+  location / {
+    return 404;
+  }
+}
+`
+
+// balance returns the directive that selects the route's balancing method
+// in an upstream block.
+func balance(r *store.Route) string {
+	switch r.Balance {
+	case store.BalanceLeastConn:
+		return "least_conn;"
+	case store.BalanceIPHash:
+		// ip_hash is only available to HTTP upstreams.
+		if r.IsStream() {
+			return "hash $remote_addr consistent;"
+		}
+		return "ip_hash;"
+	case store.BalanceHash:
+		return fmt.Sprintf("hash %s consistent;", headerVar(r.HashHeader))
+	}
+	return ""
+}
+
+// headerVar returns the nginx variable that holds the named request header.
+func headerVar(name string) string {
+	return "$http_" + strings.Replace(strings.ToLower(name), "-", "_", -1)
+}
+
+// limitKey returns the variable that tells clients apart for the limits.
+func limitKey(l *store.Limits) string {
+	if l.KeyHeader != "" {
+		return headerVar(l.KeyHeader)
+	}
+	return "$binary_remote_addr"
+}
+
+// params returns the parameters of the server line for a backend.
+func params(r *store.Route, be string) string {
+	o := r.BackendOptions[be]
+	if o == nil {
+		return ""
+	}
+
+	var p string
+	if o.Weight > 0 {
+		p += fmt.Sprintf(" weight=%d", o.Weight)
+	}
+
+	if o.MaxFails > 0 {
+		p += fmt.Sprintf(" max_fails=%d", o.MaxFails)
+	}
+
+	if o.FailTimeout > 0 {
+		p += fmt.Sprintf(" fail_timeout=%ds", o.FailTimeout)
+	}
+
+	if o.Backup {
+		p += " backup"
+	}
+
+	return p
+}
+
+// redirectURL returns the target of a redirect, which appends the request's
+// path and query when it preserves them.
+func redirectURL(rd *store.Redirect) string {
+	if rd.PreservePath {
+		return strings.TrimSuffix(rd.To, "/") + "$request_uri"
+	}
+	return rd.To
+}
+
+// httpsPort returns the port suffix of URLs that redirect to port.
+func httpsPort(port int32) string {
+	if port == 443 {
+		return ""
+	}
+	return fmt.Sprintf(":%d", port)
+}
+
+// defaultRequestHeaders are set on every request to the backends unless a
+// header rule of the route replaces or removes them.
+var defaultRequestHeaders = [][2]string{
+	{"Host", "$http_host"},
+	{"X-Real-IP", "$remote_addr"},
+	{"X-Scheme", "$scheme"},
+}
+
+// hasHeaderRule indicates whether the route has a rule for the named header.
+func hasHeaderRule(r *store.Route, direction, name string) bool {
+	for _, h := range r.Headers {
+		if h.Direction == direction && strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// passServer indicates whether the Server header of the backends is passed
+// on to clients.
+func passServer(r *store.Route) bool {
+	return !hasHeaderRule(r, store.HeaderResponse, "Server")
+}
+
+// requestHeaders returns the directives that set the headers of requests to
+// the backends. nginx drops headers that are set to an empty string.
+func requestHeaders(r *store.Route) []string {
+	defaults := defaultRequestHeaders
+	if r.Proxy != nil && r.Proxy.Websocket {
+		defaults = append(defaults[:len(defaults):len(defaults)],
+			[2]string{"Upgrade", "$http_upgrade"},
+			[2]string{"Connection", "$connection_upgrade" + nameFor(r)})
+	}
+
+	var res []string
+	for _, d := range defaults {
+		if !hasHeaderRule(r, store.HeaderRequest, d[0]) {
+			res = append(res, fmt.Sprintf("proxy_set_header %s %s;", d[0], d[1]))
+		}
+	}
+
+	for _, h := range r.Headers {
+		if h.Direction == store.HeaderRequest {
+			res = append(res, fmt.Sprintf("proxy_set_header %s \"%s\";", h.Name, h.Value))
+		}
+	}
+	return res
+}
+
+// responseHeaders returns the directives that change the headers of
+// responses to clients.
+func responseHeaders(r *store.Route) []string {
+	var res []string
+	for _, h := range r.Headers {
+		if h.Direction != store.HeaderResponse {
+			continue
+		}
+
+		switch h.Action {
+		case store.HeaderSet:
+			res = append(res,
+				fmt.Sprintf("proxy_hide_header %s;", h.Name),
+				fmt.Sprintf("add_header %s \"%s\" always;", h.Name, h.Value))
+		case store.HeaderAdd:
+			res = append(res, fmt.Sprintf("add_header %s \"%s\" always;", h.Name, h.Value))
+		case store.HeaderRemove:
+			if strings.EqualFold(h.Name, "Server") {
+				res = append(res, "server_tokens off;")
+			} else {
+				res = append(res, fmt.Sprintf("proxy_hide_header %s;", h.Name))
+			}
+		}
+	}
+	return res
+}
+
+// proxyOptions returns the directives that tune how an HTTP route proxies
+// requests.
+func proxyOptions(r *store.Route) []string {
+	o := r.Proxy
+	if o == nil {
+		return nil
+	}
+
+	var res []string
+	if o.Websocket {
+		res = append(res, "proxy_http_version 1.1;")
+	}
+
+	if o.DisableBuffering {
+		res = append(res, "proxy_buffering off;")
+	}
+
+	if o.ConnectTimeout > 0 {
+		res = append(res, fmt.Sprintf("proxy_connect_timeout %ds;", o.ConnectTimeout))
+	}
+
+	if t := o.ReadTimeoutOrDefault(); t > 0 {
+		res = append(res, fmt.Sprintf("proxy_read_timeout %ds;", t))
+	}
+
+	if o.SendTimeout > 0 {
+		res = append(res, fmt.Sprintf("proxy_send_timeout %ds;", o.SendTimeout))
+	}
+
+	if o.MaxBodySize > 0 {
+		res = append(res, fmt.Sprintf("client_max_body_size %dm;", o.MaxBodySize))
+	}
+
+	return res
+}
+
+// streamProxyOptions returns the directives that tune how a stream route
+// proxies connections.
+func streamProxyOptions(r *store.Route) []string {
+	o := r.Proxy
+	if o == nil {
+		return nil
+	}
+
+	var res []string
+	if o.ConnectTimeout > 0 {
+		res = append(res, fmt.Sprintf("proxy_connect_timeout %ds;", o.ConnectTimeout))
+	}
+
+	if o.ReadTimeout > 0 {
+		res = append(res, fmt.Sprintf("proxy_timeout %ds;", o.ReadTimeout))
+	}
+
+	return res
+}
+
+// accessRules returns the allow and deny directives of a route.
+func accessRules(r *store.Route) []string {
+	if r.Access == nil {
+		return nil
+	}
+
+	res := make([]string, 0, len(r.Access.Rules))
+	for _, ar := range r.Access.Rules {
+		res = append(res, fmt.Sprintf("%s %s;", ar.Action, ar.Source))
+	}
+	return res
+}
+
+// modifier returns the nginx location modifier for a path rule.
+func modifier(p *store.PathRule) string {
+	switch p.MatchType() {
+	case store.MatchExact:
+		return "= "
+	case store.MatchRegex:
+		return "~ "
+	}
+	return ""
+}
+
 // Service ...
 type Service struct {
 	p *os.Process
@@ -55,6 +482,23 @@ type Service struct {
 type Options struct {
 	Command   string
 	ConfigDir string
+
+	// StreamDir is where the configuration of TCP and UDP routes is written.
+	// It is included in a stream context, so nginx must be built with the
+	// stream module. Stream routes are skipped if it is empty, which is the
+	// default.
+	StreamDir string
+
+	// CertDir is where the certificates and keys of routes served over TLS
+	// are written. It should only be readable by nginx.
+	CertDir string
+
+	// StaticDir is where arkd keeps the static content of routes.
+	StaticDir string
+
+	// ChallengeAddr is the address of arkd, to which nginx proxies ACME
+	// HTTP-01 challenges. Empty if automatic certificates are disabled.
+	ChallengeAddr string
 }
 
 // Reload ...
@@ -62,16 +506,38 @@ func (s *Service) Reload() error {
 	return s.p.Signal(syscall.SIGHUP)
 }
 
-func nameFor(r *store.Route) string {
+func hashOf(s string) string {
 	h := sha1.New()
-	h.Write([]byte(r.Name))
+	h.Write([]byte(s))
 	return hex.EncodeToString(h.Sum(nil))[:16]
 }
 
-func writeTo(dir string, r *store.Route) error {
+func nameFor(r *store.Route) string {
+	return hashOf(r.Name)
+}
+
+// certFiles returns the paths of the certificate and key files for the named
+// certificate.
+func certFiles(dir, name string) (string, string) {
+	base := filepath.Join(dir, hashOf(name))
+	return base + ".crt", base + ".key"
+}
+
+// writeCert writes the certificate chain and key of c to dir.
+func writeCert(dir string, c *store.Certificate) error {
+	crt, key := certFiles(dir, c.Name)
+
+	if err := ioutil.WriteFile(crt, c.Cert, 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(key, c.Key, 0600)
+}
+
+func writeTo(o *Options, r *store.Route) error {
 	id := nameFor(r)
 
-	dst := filepath.Join(dir, fmt.Sprintf("%s.conf", id))
+	dst := filepath.Join(o.ConfigDir, fmt.Sprintf("%s.conf", id))
 
 	w, err := os.Create(dst)
 	if err != nil {
@@ -79,46 +545,274 @@ func writeTo(dir string, r *store.Route) error {
 	}
 	defer w.Close()
 
-	t, err := template.New("tpl").Parse(tpl)
+	t, err := template.New("tpl").Funcs(template.FuncMap{
+		"modifier":        modifier,
+		"balance":         balance,
+		"params":          params,
+		"redirectURL":     redirectURL,
+		"httpsPort":       httpsPort,
+		"passServer":      passServer,
+		"requestHeaders":  requestHeaders,
+		"responseHeaders": responseHeaders,
+		"accessRules":     accessRules,
+		"limitKey":        limitKey,
+		"proxyOptions":    proxyOptions,
+	}).Parse(tpl)
 	if err != nil {
 		return err
 	}
 
 	data := struct {
 		*store.Route
-		ID         string
-		ServerName string
+		ID              string
+		ServerName      string
+		CertFile        string
+		KeyFile         string
+		AuthFile        string
+		StaticRoot      string
+		MaintenancePage string
+		ChallengeAddr   string
 	}{
-		r,
-		id,
-		strings.Join(r.Hosts, " "),
+		Route:         r,
+		ID:            id,
+		ServerName:    strings.Join(r.Hosts, " "),
+		ChallengeAddr: o.ChallengeAddr,
+	}
+
+	if name := r.CertName(); name != "" {
+		data.CertFile, data.KeyFile = certFiles(o.CertDir, name)
+	}
+
+	data.StaticRoot = r.StaticRoot(o.StaticDir)
+
+	if r.InMaintenance() && r.Maintenance.Page != "" {
+		data.MaintenancePage = filepath.Join(o.ConfigDir, fmt.Sprintf("%s.maintenance.html", id))
+		if err := ioutil.WriteFile(
+			data.MaintenancePage,
+			[]byte(r.Maintenance.Page),
+			0644); err != nil {
+			return err
+		}
+	}
+
+	if r.Access != nil && len(r.Access.Users) > 0 {
+		data.AuthFile = filepath.Join(o.ConfigDir, fmt.Sprintf("%s.htpasswd", id))
+		if err := writeUsers(data.AuthFile, r.Access.Users); err != nil {
+			return err
+		}
 	}
 
 	return t.Execute(w, &data)
 }
 
-// Update ...
-func (s *Service) Update(rts []*store.Route) error {
-	files, err := filepath.Glob(filepath.Join(s.o.ConfigDir, "*.conf"))
+// writeUsers writes the basic auth users of a route as an htpasswd file.
+func writeUsers(dst string, users []*store.BasicUser) error {
+	var buf bytes.Buffer
+	for _, u := range users {
+		fmt.Fprintf(&buf, "%s:%s\n", u.Name, u.Hash)
+	}
+
+	// nginx's workers read the file on each request.
+	return ioutil.WriteFile(dst, buf.Bytes(), 0644)
+}
+
+// writeStreamTo writes the configuration of a stream route to the stream dir.
+func writeStreamTo(o *Options, r *store.Route) error {
+	id := nameFor(r)
+
+	dst := filepath.Join(o.StreamDir, fmt.Sprintf("%s.conf", id))
+
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	t, err := template.New("stream").Funcs(template.FuncMap{
+		"balance":            balance,
+		"params":             params,
+		"accessRules":        accessRules,
+		"streamProxyOptions": streamProxyOptions,
+	}).Parse(streamTpl)
+	if err != nil {
+		return err
+	}
+
+	return t.Execute(w, &struct {
+		*store.Route
+		ID  string
+		UDP bool
+	}{
+		Route: r,
+		ID:    id,
+		UDP:   r.ProtocolType() == store.ProtocolUDP,
+	})
+}
+
+// streamIncludeFile is the file that wraps the stream dir in a stream context.
+func streamIncludeFile(o *Options) string {
+	return filepath.Join(o.StreamDir, "stream.include")
+}
+
+// writeStreamInclude writes the file that is included in nginx's main context
+// to load the stream routes.
+func writeStreamInclude(o *Options) error {
+	if err := os.MkdirAll(o.StreamDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(
+		streamIncludeFile(o),
+		[]byte(fmt.Sprintf(streamInclude, filepath.Join(o.StreamDir, "*.conf"))),
+		0644)
+}
+
+// writeChallenges writes a server that answers ACME challenges for hosts.
+func writeChallenges(o *Options, hosts []string) error {
+	dst := filepath.Join(o.ConfigDir, "acme-challenges.conf")
+
+	w, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
+	defer w.Close()
 
-	for _, file := range files {
-		if err := os.Remove(file); err != nil {
+	t, err := template.New("challenge").Parse(challengeTpl)
+	if err != nil {
+		return err
+	}
+
+	return t.Execute(w, &struct {
+		ServerName    string
+		ChallengeAddr string
+	}{
+		strings.Join(hosts, " "),
+		o.ChallengeAddr,
+	})
+}
+
+// removeAll removes the files in dir that match any of the patterns.
+func removeAll(dir string, patterns ...string) error {
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
 			return err
 		}
+
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
+// servable indicates whether the route has anything to serve.
+func servable(r *store.Route) bool {
+	return len(r.AllBackends()) > 0 ||
+		r.Redirect != nil ||
+		r.Static != nil ||
+		r.InMaintenance()
+}
+
+// Update ...
+func (s *Service) Update(rts []*store.Route, certs []*store.Certificate) error {
+	if err := removeAll(s.o.ConfigDir, "*.conf", "*.htpasswd", "*.html"); err != nil {
+		return err
+	}
+
+	if err := removeAll(s.o.CertDir, "*.crt", "*.key"); err != nil {
+		return err
+	}
+
+	if s.o.StreamDir != "" {
+		if err := removeAll(s.o.StreamDir, "*.conf"); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(s.o.CertDir, 0700); err != nil {
+		return err
+	}
+
+	byName := map[string]*store.Certificate{}
+	for _, c := range certs {
+		byName[c.Name] = c
+	}
+
+	// hosts that are served over plain HTTP on port 80, which answer ACME
+	// challenges themselves.
+	served := map[string]bool{}
+
+	written := map[string]bool{}
 	for _, rt := range rts {
-		if len(rt.Backends) == 0 {
+		if !servable(rt) {
+			continue
+		}
+
+		if rt.IsStream() {
+			if s.o.StreamDir == "" {
+				log.Printf("skipping route '%s': stream routes are disabled", rt.Name)
+				continue
+			}
+
+			if err := writeStreamTo(s.o, rt); err != nil {
+				return err
+			}
 			continue
 		}
 
-		if err := writeTo(s.o.ConfigDir, rt); err != nil {
+		name := rt.CertName()
+		if name != "" && !written[name] {
+			c := byName[name]
+			if c == nil {
+				// serving the route without its certificate would expose
+				// it over plain HTTP on its TLS port.
+				log.Printf("skipping route '%s': certificate not found: '%s'",
+					rt.Name, name)
+				continue
+			}
+
+			if err := writeCert(s.o.CertDir, c); err != nil {
+				return err
+			}
+			written[name] = true
+		}
+
+		if err := writeTo(s.o, rt); err != nil {
 			return err
 		}
+
+		if (name == "" && rt.Port == store.HTTPPort) || rt.ForceHttps {
+			for _, host := range rt.Hosts {
+				served[host] = true
+			}
+		}
 	}
+
+	if s.o.ChallengeAddr != "" {
+		var hosts []string
+		for _, rt := range rts {
+			if rt.Tls != store.TLSAuto {
+				continue
+			}
+
+			for _, host := range rt.Hosts {
+				if !served[host] {
+					hosts = append(hosts, host)
+					served[host] = true
+				}
+			}
+		}
+
+		if len(hosts) > 0 {
+			if err := writeChallenges(s.o, hosts); err != nil {
+				return err
+			}
+		}
+	}
+
 	return s.Reload()
 }
 
@@ -128,7 +822,15 @@ func Start(opts *Options) (*Service, error) {
 		opts = &DefaultOptions
 	}
 
-	cmd := exec.Command(opts.Command, "-g", "daemon off;")
+	global := "daemon off;"
+	if opts.StreamDir != "" {
+		if err := writeStreamInclude(opts); err != nil {
+			return nil, err
+		}
+		global += fmt.Sprintf(" include %s;", streamIncludeFile(opts))
+	}
+
+	cmd := exec.Command(opts.Command, "-g", global)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
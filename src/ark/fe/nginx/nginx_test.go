@@ -0,0 +1,482 @@
+package nginx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ark/store"
+)
+
+// testOptions returns options that write into a new temporary directory,
+// which the caller must remove.
+func testOptions(t *testing.T) (*Options, string) {
+	dir, err := ioutil.TempDir("", "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Options{
+		ConfigDir: filepath.Join(dir, "conf.d"),
+		StreamDir: filepath.Join(dir, "stream.d"),
+		CertDir:   filepath.Join(dir, "certs"),
+		StaticDir: filepath.Join(dir, "static"),
+	}
+
+	for _, d := range []string{o.ConfigDir, o.StreamDir, o.CertDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return o, dir
+}
+
+// normalize trims every line of a configuration and drops the blank ones so
+// that expectations do not depend on the template's whitespace.
+func normalize(s string) string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func readFile(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// render writes the configuration of the route and returns it normalized.
+func render(t *testing.T, o *Options, rt *store.Route) string {
+	write := writeTo
+	dir := o.ConfigDir
+	if rt.IsStream() {
+		write, dir = writeStreamTo, o.StreamDir
+	}
+
+	if err := write(o, rt); err != nil {
+		t.Fatal(err)
+	}
+
+	return normalize(readFile(t, filepath.Join(dir, nameFor(rt)+".conf")))
+}
+
+// checkConf fails the test unless conf has each of the snippets in want and
+// none of those in not. Snippets may span lines.
+func checkConf(t *testing.T, name, conf string, want, not []string) {
+	for _, s := range want {
+		if !strings.Contains(conf, normalize(s)) {
+			t.Fatalf("%s: expected %q in:\n%s", name, s, conf)
+		}
+	}
+
+	for _, s := range not {
+		if strings.Contains(conf, normalize(s)) {
+			t.Fatalf("%s: unexpected %q in:\n%s", name, s, conf)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	o, dir := testOptions(t)
+	defer os.RemoveAll(dir)
+
+	digest := strings.Repeat("ab", 32)
+	crt, key := certFiles(o.CertDir, "a")
+	acrt, akey := certFiles(o.CertDir, store.AutoCertPrefix+"auto")
+
+	id := func(name string) string {
+		return nameFor(&store.Route{Name: name})
+	}
+
+	tests := []struct {
+		rt        *store.Route
+		want, not []string
+	}{
+		{
+			rt: &store.Route{
+				Name:     "plain",
+				Port:     80,
+				Hosts:    []string{"a.com", "www.a.com"},
+				Backends: []string{"10.0.0.1:80", "10.0.0.2:80"},
+			},
+			want: []string{
+				"listen 80;",
+				"server_name a.com www.a.com;",
+				"proxy_set_header Host $http_host;",
+				"proxy_pass_header Server;",
+				"proxy_pass http://be" + id("plain") + ";",
+				`upstream be` + id("plain") + ` {
+				  server 10.0.0.1:80;
+				  server 10.0.0.2:80;
+				}`,
+			},
+			not: []string{"ssl", "split_clients", "limit_req", "auth_basic", "acme-challenge"},
+		},
+		{
+			rt: &store.Route{
+				Name:     "paths",
+				Port:     80,
+				Hosts:    []string{"a.com"},
+				Backends: []string{"10.0.0.1:80"},
+				Paths: []*store.PathRule{
+					{Path: "/api/", Backends: []string{"10.0.0.2:80"}},
+					{Match: store.MatchExact, Path: "/health", Backends: []string{"10.0.0.3:80"}},
+					{Match: store.MatchRegex, Path: `\.php$`, Backends: []string{"10.0.0.4:80"}},
+				},
+			},
+			want: []string{
+				`location /api/ {`,
+				"proxy_pass http://be" + id("paths") + "p0;",
+				`location = /health {`,
+				"proxy_pass http://be" + id("paths") + "p1;",
+				`location ~ \.php$ {`,
+				`upstream be` + id("paths") + `p2 {
+				  server 10.0.0.4:80;
+				}`,
+			},
+		},
+		{
+			rt: &store.Route{
+				Name:       "tls",
+				Port:       443,
+				Hosts:      []string{"a.com"},
+				Backends:   []string{"10.0.0.1:80"},
+				Cert:       "a",
+				ForceHttps: true,
+			},
+			want: []string{
+				`listen 443 ssl;
+				ssl_certificate ` + crt + `;
+				ssl_certificate_key ` + key + `;`,
+				`server {
+				  listen 80;
+				  server_name a.com;
+				  location / {
+				    return 301 https://$host$request_uri;
+				  }
+				}`,
+			},
+		},
+		{
+			rt: &store.Route{
+				Name:       "tls8443",
+				Port:       8443,
+				Hosts:      []string{"a.com"},
+				Backends:   []string{"10.0.0.1:80"},
+				Cert:       "a",
+				ForceHttps: true,
+			},
+			want: []string{
+				"listen 8443 ssl;",
+				"return 301 https://$host:8443$request_uri;",
+			},
+		},
+		{
+			rt: &store.Route{
+				Name:     "groups",
+				Port:     80,
+				Hosts:    []string{"a.com"},
+				Backends: []string{"10.0.0.1:80"},
+				Groups: []*store.BackendGroup{
+					{Name: "canary", Backends: []string{"10.0.0.2:80"}, Weight: 10},
+					{Name: "idle", Backends: []string{"10.0.0.3:80"}},
+				},
+			},
+			want: []string{
+				`split_clients "${remote_addr}${http_user_agent}" $be` + id("groups") + ` {
+				  10% be` + id("groups") + `g0;
+				  * be` + id("groups") + `;
+				}`,
+				"proxy_pass http://$be" + id("groups") + ";",
+				`upstream be` + id("groups") + `g0 {
+				  server 10.0.0.2:80;
+				}`,
+				`upstream be` + id("groups") + `g1 {
+				  server 10.0.0.3:80;
+				}`,
+			},
+			not: []string{"% be" + id("groups") + "g1;"},
+		},
+		{
+			rt: &store.Route{
+				Name:     "limits",
+				Port:     80,
+				Hosts:    []string{"a.com"},
+				Backends: []string{"10.0.0.1:80"},
+				Limits: &store.Limits{
+					Rate:        10,
+					Burst:       20,
+					Connections: 5,
+					KeyHeader:   "X-Api-Key",
+				},
+			},
+			want: []string{
+				"limit_req_zone $http_x_api_key zone=req" + id("limits") + ":10m rate=10r/s;",
+				"limit_conn_zone $http_x_api_key zone=conn" + id("limits") + ":10m;",
+				`limit_req zone=req` + id("limits") + ` burst=20 nodelay;
+				limit_req_status 429;`,
+				`limit_conn conn` + id("limits") + ` 5;
+				limit_conn_status 429;`,
+			},
+		},
+		{
+			rt: &store.Route{
+				Name:     "headers",
+				Port:     80,
+				Hosts:    []string{"a.com"},
+				Backends: []string{"10.0.0.1:80"},
+				Headers: []*store.HeaderRule{
+					{Direction: store.HeaderRequest, Action: store.HeaderSet, Name: "Host", Value: "b.com"},
+					{Direction: store.HeaderRequest, Action: store.HeaderSet, Name: "X-Env", Value: "prod"},
+					{Direction: store.HeaderResponse, Action: store.HeaderSet, Name: "X-Frame-Options", Value: "DENY"},
+					{Direction: store.HeaderResponse, Action: store.HeaderAdd, Name: "X-Served-By", Value: "ark"},
+					{Direction: store.HeaderResponse, Action: store.HeaderRemove, Name: "Server"},
+					{Direction: store.HeaderResponse, Action: store.HeaderRemove, Name: "X-Powered-By"},
+				},
+			},
+			want: []string{
+				`proxy_set_header Host "b.com";`,
+				`proxy_set_header X-Env "prod";`,
+				`proxy_hide_header X-Frame-Options;
+				add_header X-Frame-Options "DENY" always;`,
+				`add_header X-Served-By "ark" always;`,
+				"server_tokens off;",
+				"proxy_hide_header X-Powered-By;",
+				"proxy_set_header X-Real-IP $remote_addr;",
+			},
+			not: []string{"proxy_set_header Host $http_host;", "proxy_pass_header Server;"},
+		},
+		{
+			rt: &store.Route{
+				Name:     "access",
+				Port:     80,
+				Hosts:    []string{"a.com"},
+				Backends: []string{"10.0.0.1:80"},
+				Access: &store.Access{
+					Users: []*store.BasicUser{{Name: "bob", Hash: "{SSHA}abc"}},
+					Rules: []*store.AccessRule{
+						{Action: store.AccessAllow, Source: "10.0.0.0/8"},
+						{Action: store.AccessDeny, Source: store.AccessAll},
+					},
+				},
+			},
+			want: []string{
+				`allow 10.0.0.0/8;
+				deny all;`,
+				`auth_basic "restricted";
+				auth_basic_user_file ` + filepath.Join(o.ConfigDir, id("access")+".htpasswd") + `;`,
+			},
+		},
+		{
+			rt: &store.Route{
+				Name:        "maintenance",
+				Port:        80,
+				Hosts:       []string{"a.com"},
+				Backends:    []string{"10.0.0.1:80"},
+				Maintenance: &store.Maintenance{Enabled: true, Page: "<h1>down</h1>"},
+			},
+			want: []string{
+				`error_page 503 /.ark/maintenance.html;
+				location = /.ark/maintenance.html {
+				  internal;
+				  alias ` + filepath.Join(o.ConfigDir, id("maintenance")+".maintenance.html") + `;
+				}
+				location / {
+				  return 503;
+				}`,
+			},
+			not: []string{"proxy_pass http://be"},
+		},
+		{
+			rt: &store.Route{
+				Name:        "disabled-maintenance",
+				Port:        80,
+				Hosts:       []string{"a.com"},
+				Backends:    []string{"10.0.0.1:80"},
+				Maintenance: &store.Maintenance{Page: "<h1>down</h1>"},
+			},
+			want: []string{"proxy_pass http://be" + id("disabled-maintenance") + ";"},
+			not:  []string{"error_page 503", "return 503;"},
+		},
+		{
+			rt: &store.Route{
+				Name:   "static",
+				Port:   80,
+				Hosts:  []string{"a.com"},
+				Static: &store.Static{Digest: digest},
+			},
+			want: []string{
+				"root " + filepath.Join(o.StaticDir, digest) + ";",
+				`location / {
+				  try_files $uri $uri/ =404;
+				}`,
+			},
+			not: []string{"proxy_pass", "upstream"},
+		},
+	}
+
+	for _, test := range tests {
+		checkConf(t, test.rt.Name, render(t, o, test.rt), test.want, test.not)
+	}
+
+	if got := readFile(t, filepath.Join(o.ConfigDir, id("access")+".htpasswd")); got != "bob:{SSHA}abc\n" {
+		t.Fatalf("unexpected htpasswd file: %q", got)
+	}
+
+	if got := readFile(t, filepath.Join(o.ConfigDir, id("maintenance")+".maintenance.html")); got != "<h1>down</h1>" {
+		t.Fatalf("unexpected maintenance page: %q", got)
+	}
+
+	// routes with automatic tls use the certificate named for them.
+	auto := &store.Route{
+		Name:     "auto",
+		Port:     443,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.1:80"},
+		Tls:      store.TLSAuto,
+	}
+	checkConf(t, auto.Name, render(t, o, auto), []string{
+		`listen 443 ssl;
+		ssl_certificate ` + acrt + `;
+		ssl_certificate_key ` + akey + `;`,
+	}, nil)
+}
+
+func TestChallenges(t *testing.T) {
+	o, dir := testOptions(t)
+	defer os.RemoveAll(dir)
+
+	o.ChallengeAddr = "127.0.0.1:6660"
+	challenge := `location /.well-known/acme-challenge/ {
+	  allow all;
+	  auth_basic off;
+	  proxy_set_header Host $http_host;
+	  proxy_pass http://127.0.0.1:6660;
+	}`
+
+	// a plain route answers challenges for its hosts itself, in spite of its
+	// access rules.
+	plain := &store.Route{
+		Name:     "plain",
+		Port:     80,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.1:80"},
+		Access: &store.Access{
+			Rules: []*store.AccessRule{{Action: store.AccessDeny, Source: store.AccessAll}},
+		},
+	}
+	checkConf(t, plain.Name, render(t, o, plain), []string{challenge}, nil)
+
+	// a tls route answers them on the port 80 server that redirects to it.
+	auto := &store.Route{
+		Name:       "auto",
+		Port:       443,
+		Hosts:      []string{"b.com"},
+		Backends:   []string{"10.0.0.1:80"},
+		Tls:        store.TLSAuto,
+		ForceHttps: true,
+	}
+	checkConf(t, auto.Name, render(t, o, auto), []string{
+		`listen 80;
+		server_name b.com;
+		location /.well-known/acme-challenge/ {
+		  proxy_set_header Host $http_host;
+		  proxy_pass http://127.0.0.1:6660;
+		}
+		location / {
+		  return 301 https://$host$request_uri;
+		}`,
+	}, []string{challenge})
+
+	if err := writeChallenges(o, []string{"c.com", "d.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := normalize(readFile(t, filepath.Join(o.ConfigDir, "acme-challenges.conf")))
+	checkConf(t, "challenges", conf, []string{
+		`listen 80;
+		server_name c.com d.com;
+		location /.well-known/acme-challenge/ {
+		  proxy_set_header Host $http_host;
+		  proxy_pass http://127.0.0.1:6660;
+		}
+		location / {
+		  return 404;
+		}`,
+	}, nil)
+}
+
+func TestStreamTemplate(t *testing.T) {
+	o, dir := testOptions(t)
+	defer os.RemoveAll(dir)
+
+	id := func(name string) string {
+		return nameFor(&store.Route{Name: name})
+	}
+
+	tests := []struct {
+		rt        *store.Route
+		want, not []string
+	}{
+		{
+			rt: &store.Route{
+				Name:     "pg",
+				Port:     5432,
+				Protocol: store.ProtocolTCP,
+				Backends: []string{"10.0.0.1:5432"},
+				Balance:  store.BalanceIPHash,
+				Access: &store.Access{
+					Rules: []*store.AccessRule{{Action: store.AccessAllow, Source: "10.0.0.0/8"}},
+				},
+				Limits: &store.Limits{Connections: 10},
+				Proxy:  &store.ProxyOptions{ConnectTimeout: 5, ReadTimeout: 60},
+			},
+			want: []string{
+				"limit_conn_zone $binary_remote_addr zone=conn" + id("pg") + ":10m;",
+				`listen 5432;
+				allow 10.0.0.0/8;
+				limit_conn conn` + id("pg") + ` 10;
+				proxy_connect_timeout 5s;
+				proxy_timeout 60s;
+				proxy_pass be` + id("pg") + `;`,
+				`upstream be` + id("pg") + ` {
+				  hash $remote_addr consistent;
+				  server 10.0.0.1:5432;
+				}`,
+			},
+			not: []string{"udp", "limit_conn_status", "server_name"},
+		},
+		{
+			rt: &store.Route{
+				Name:     "dns",
+				Port:     53,
+				Protocol: store.ProtocolUDP,
+				Backends: []string{"10.0.0.1:53"},
+			},
+			want: []string{"listen 53 udp;", "proxy_pass be" + id("dns") + ";"},
+		},
+	}
+
+	for _, test := range tests {
+		checkConf(t, test.rt.Name, render(t, o, test.rt), test.want, test.not)
+	}
+
+	if err := writeStreamInclude(o); err != nil {
+		t.Fatal(err)
+	}
+
+	checkConf(t, "include", normalize(readFile(t, streamIncludeFile(o))), []string{
+		`stream {
+		  include ` + filepath.Join(o.StreamDir, "*.conf") + `;
+		}`,
+	}, nil)
+}
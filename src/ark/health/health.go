@@ -0,0 +1,328 @@
+// Package health actively checks the backends of routes and keeps the ones
+// that fail their checks out of the load balancer until they recover.
+package health
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"ark/fe"
+	"ark/store"
+)
+
+// Defaults for the zero values of a store.HealthCheck.
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 2 * time.Second
+	DefaultFall     = 2
+	DefaultRise     = 1
+)
+
+// Status is the health of a backend as of its last check.
+type Status struct {
+	Healthy bool   `json:"healthy"`
+	Checked int64  `json:"checked,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// the number of consecutive probes with the same outcome.
+	fails  int
+	passes int
+}
+
+// target is a backend of a route that is being checked.
+type target struct {
+	route   string
+	backend string
+	hc      *store.HealthCheck
+
+	status Status
+	stop   chan struct{}
+}
+
+func (t *target) interval() time.Duration {
+	if t.hc.Interval > 0 {
+		return time.Duration(t.hc.Interval) * time.Second
+	}
+	return DefaultInterval
+}
+
+func (t *target) timeout() time.Duration {
+	if t.hc.Timeout > 0 {
+		return time.Duration(t.hc.Timeout) * time.Second
+	}
+	return DefaultTimeout
+}
+
+func (t *target) fall() int {
+	if t.hc.Fall > 0 {
+		return int(t.hc.Fall)
+	}
+	return DefaultFall
+}
+
+func (t *target) rise() int {
+	if t.hc.Rise > 0 {
+		return int(t.hc.Rise)
+	}
+	return DefaultRise
+}
+
+// probe checks the backend once.
+func probe(hc *store.HealthCheck, backend string, timeout time.Duration) error {
+	if hc.Path == "" {
+		c, err := net.DialTimeout("tcp", backend, timeout)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	c := http.Client{Timeout: timeout}
+	res, err := c.Get(fmt.Sprintf("http://%s%s", backend, hc.Path))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func keyFor(route, backend string) string {
+	return route + "\x00" + backend
+}
+
+// Checker is a fe.Service that checks the backends of every route that has a
+// health check and passes the routes on to another fe.Service without their
+// unhealthy backends. If every backend of an upstream is unhealthy, they are
+// all kept since there is nothing better to send requests to.
+type Checker struct {
+	fe fe.Service
+
+	// probe is replaced in tests.
+	probe func(hc *store.HealthCheck, backend string, timeout time.Duration) error
+
+	lck     sync.Mutex
+	rts     []*store.Route
+	certs   []*store.Certificate
+	targets map[string]*target
+
+	// held while updating fe so that updates are applied in order.
+	ulck sync.Mutex
+}
+
+// NewChecker returns a Checker that updates s.
+func NewChecker(s fe.Service) *Checker {
+	return &Checker{
+		fe:      s,
+		probe:   probe,
+		targets: map[string]*target{},
+	}
+}
+
+// Update starts checking the backends of the routes, stops checking those
+// that are gone and updates the underlying service.
+func (c *Checker) Update(rts []*store.Route, certs []*store.Certificate) error {
+	c.lck.Lock()
+
+	c.rts, c.certs = rts, certs
+
+	seen := map[string]bool{}
+	for _, rt := range rts {
+		if rt.HealthCheck == nil {
+			continue
+		}
+
+		for _, be := range rt.AllBackends() {
+			key := keyFor(rt.Name, be)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			if t := c.targets[key]; t != nil {
+				if proto.Equal(t.hc, rt.HealthCheck) {
+					continue
+				}
+				close(t.stop)
+			}
+
+			// backends are assumed healthy until they fail so that new
+			// routes are served right away.
+			t := &target{
+				route:   rt.Name,
+				backend: be,
+				hc:      rt.HealthCheck,
+				status:  Status{Healthy: true},
+				stop:    make(chan struct{}),
+			}
+			c.targets[key] = t
+			go c.run(t)
+		}
+	}
+
+	for key, t := range c.targets {
+		if !seen[key] {
+			close(t.stop)
+			delete(c.targets, key)
+		}
+	}
+
+	c.lck.Unlock()
+
+	return c.push()
+}
+
+// push updates the underlying service with the latest routes, leaving out
+// unhealthy backends.
+func (c *Checker) push() error {
+	c.ulck.Lock()
+	defer c.ulck.Unlock()
+
+	c.lck.Lock()
+	rts := make([]*store.Route, 0, len(c.rts))
+	for _, rt := range c.rts {
+		rts = append(rts, c.filter(rt))
+	}
+	certs := c.certs
+	c.lck.Unlock()
+
+	return c.fe.Update(rts, certs)
+}
+
+// filter returns the route without its unhealthy backends. The caller must
+// hold c.lck.
+func (c *Checker) filter(rt *store.Route) *store.Route {
+	if rt.HealthCheck == nil {
+		return rt
+	}
+
+	healthy := func(bes []string) []string {
+		var res []string
+		for _, be := range bes {
+			if t := c.targets[keyFor(rt.Name, be)]; t == nil || t.status.Healthy {
+				res = append(res, be)
+			}
+		}
+
+		if len(res) == 0 {
+			return bes
+		}
+		return res
+	}
+
+	f := proto.Clone(rt).(*store.Route)
+	f.Backends = healthy(f.Backends)
+	for _, p := range f.Paths {
+		p.Backends = healthy(p.Backends)
+	}
+	for _, g := range f.Groups {
+		g.Backends = healthy(g.Backends)
+	}
+	return f
+}
+
+func (c *Checker) run(t *target) {
+	tick := time.NewTicker(t.interval())
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			c.check(t)
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// check probes the target once and updates the service if its health
+// changes.
+func (c *Checker) check(t *target) {
+	err := c.probe(t.hc, t.backend, t.timeout())
+
+	c.lck.Lock()
+
+	// the target may have been replaced while it was being probed.
+	if c.targets[keyFor(t.route, t.backend)] != t {
+		c.lck.Unlock()
+		return
+	}
+
+	s := &t.status
+	s.Checked = time.Now().Unix()
+
+	was := s.Healthy
+	if err != nil {
+		s.Error = err.Error()
+		s.fails++
+		s.passes = 0
+		if s.fails >= t.fall() {
+			s.Healthy = false
+		}
+	} else {
+		s.Error = ""
+		s.passes++
+		s.fails = 0
+		if s.passes >= t.rise() {
+			s.Healthy = true
+		}
+	}
+
+	healthy := s.Healthy
+	c.lck.Unlock()
+
+	if was == healthy {
+		return
+	}
+
+	if healthy {
+		log.Printf("backend %s of route '%s' is healthy", t.backend, t.route)
+	} else {
+		log.Printf("backend %s of route '%s' is unhealthy: %s", t.backend, t.route, err)
+	}
+
+	if err := c.push(); err != nil {
+		log.Printf("unable to update load balancer: %s", err)
+	}
+}
+
+// Health returns the status of each backend of the named route, keyed by
+// backend. It returns nil if the route's backends are not checked.
+func (c *Checker) Health(route string) map[string]*Status {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	var res map[string]*Status
+	for _, t := range c.targets {
+		if t.route != route {
+			continue
+		}
+
+		if res == nil {
+			res = map[string]*Status{}
+		}
+		s := t.status
+		res[t.backend] = &s
+	}
+	return res
+}
+
+// Close stops every check.
+func (c *Checker) Close() {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	for key, t := range c.targets {
+		close(t.stop)
+		delete(c.targets, key)
+	}
+}
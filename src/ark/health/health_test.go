@@ -0,0 +1,304 @@
+package health
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"ark/store"
+)
+
+type fakeService struct {
+	lck sync.Mutex
+	rts []*store.Route
+}
+
+func (s *fakeService) Update(rts []*store.Route, certs []*store.Certificate) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.rts = rts
+	return nil
+}
+
+func (s *fakeService) backends(name string) []string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for _, rt := range s.rts {
+		if rt.Name == name {
+			return rt.Backends
+		}
+	}
+	return nil
+}
+
+func sameBackends(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// newTestChecker returns a Checker whose probes fail for the backends in
+// down.
+func newTestChecker(fe *fakeService, down map[string]bool, lck *sync.Mutex) *Checker {
+	c := NewChecker(fe)
+	c.probe = func(hc *store.HealthCheck, be string, timeout time.Duration) error {
+		lck.Lock()
+		defer lck.Unlock()
+		if down[be] {
+			return errors.New("down")
+		}
+		return nil
+	}
+	return c
+}
+
+func (c *Checker) targetFor(route, backend string) *target {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.targets[keyFor(route, backend)]
+}
+
+func TestEject(t *testing.T) {
+	var lck sync.Mutex
+	down := map[string]bool{}
+	fe := &fakeService{}
+	c := newTestChecker(fe, down, &lck)
+	defer c.Close()
+
+	rt := &store.Route{
+		Name:     "a",
+		Port:     80,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		HealthCheck: &store.HealthCheck{
+			Interval: 3600,
+			Fall:     2,
+			Rise:     2,
+		},
+	}
+
+	if err := c.Update([]*store.Route{rt}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if bes := fe.backends("a"); !sameBackends(bes, rt.Backends) {
+		t.Fatalf("expected new backends to be healthy, got %v", bes)
+	}
+
+	lck.Lock()
+	down["10.0.0.2:80"] = true
+	lck.Unlock()
+
+	t2 := c.targetFor("a", "10.0.0.2:80")
+
+	c.check(t2)
+	if bes := fe.backends("a"); !sameBackends(bes, rt.Backends) {
+		t.Fatalf("expected backend to stay until fall, got %v", bes)
+	}
+
+	c.check(t2)
+	if bes := fe.backends("a"); !sameBackends(bes, []string{"10.0.0.1:80"}) {
+		t.Fatalf("expected unhealthy backend to be removed, got %v", bes)
+	}
+
+	h := c.Health("a")
+	if s := h["10.0.0.2:80"]; s == nil || s.Healthy || s.Error != "down" {
+		t.Fatalf("unexpected status: %v", s)
+	}
+	if s := h["10.0.0.1:80"]; s == nil || !s.Healthy {
+		t.Fatalf("unexpected status: %v", s)
+	}
+
+	// the stored route is never changed.
+	if len(rt.Backends) != 2 {
+		t.Fatalf("route was modified: %v", rt.Backends)
+	}
+
+	lck.Lock()
+	down["10.0.0.2:80"] = false
+	lck.Unlock()
+
+	c.check(t2)
+	if bes := fe.backends("a"); !sameBackends(bes, []string{"10.0.0.1:80"}) {
+		t.Fatalf("expected backend to stay out until rise, got %v", bes)
+	}
+
+	c.check(t2)
+	if bes := fe.backends("a"); !sameBackends(bes, rt.Backends) {
+		t.Fatalf("expected recovered backend to be restored, got %v", bes)
+	}
+}
+
+// TestStoredRoutes checks that a new Checker, as arkd creates when it starts,
+// probes the routes that are already in the store and ejects dead backends
+// without waiting for the routes to change.
+func TestStoredRoutes(t *testing.T) {
+	s, err := store.Open("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Save(&store.Route{
+		Name:     "a",
+		Port:     80,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		HealthCheck: &store.HealthCheck{
+			Interval: 1,
+			Fall:     1,
+		},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var lck sync.Mutex
+	down := map[string]bool{"10.0.0.2:80": true}
+	fe := &fakeService{}
+	c := newTestChecker(fe, down, &lck)
+	defer c.Close()
+
+	rts, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Update(rts, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+		if sameBackends(fe.backends("a"), []string{"10.0.0.1:80"}) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("expected the dead backend to be ejected, got %v", fe.backends("a"))
+}
+
+func TestFailOpen(t *testing.T) {
+	var lck sync.Mutex
+	down := map[string]bool{"10.0.0.1:80": true, "10.0.0.2:80": true}
+	fe := &fakeService{}
+	c := newTestChecker(fe, down, &lck)
+	defer c.Close()
+
+	rt := &store.Route{
+		Name:        "a",
+		Port:        80,
+		Hosts:       []string{"a.com"},
+		Backends:    []string{"10.0.0.1:80", "10.0.0.2:80"},
+		HealthCheck: &store.HealthCheck{Interval: 3600, Fall: 1},
+	}
+
+	if err := c.Update([]*store.Route{rt}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c.check(c.targetFor("a", "10.0.0.1:80"))
+	if bes := fe.backends("a"); !sameBackends(bes, []string{"10.0.0.2:80"}) {
+		t.Fatalf("expected unhealthy backend to be removed, got %v", bes)
+	}
+
+	c.check(c.targetFor("a", "10.0.0.2:80"))
+	if bes := fe.backends("a"); !sameBackends(bes, rt.Backends) {
+		t.Fatalf("expected all backends when none are healthy, got %v", bes)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	var lck sync.Mutex
+	fe := &fakeService{}
+	c := newTestChecker(fe, map[string]bool{}, &lck)
+	defer c.Close()
+
+	a := &store.Route{
+		Name:        "a",
+		Port:        80,
+		Hosts:       []string{"a.com"},
+		Backends:    []string{"10.0.0.1:80"},
+		HealthCheck: &store.HealthCheck{Interval: 3600},
+	}
+	b := &store.Route{
+		Name:     "b",
+		Port:     80,
+		Hosts:    []string{"b.com"},
+		Backends: []string{"10.0.0.2:80"},
+	}
+
+	if err := c.Update([]*store.Route{a, b}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Health("a") == nil {
+		t.Fatal("expected route with a health check to be checked")
+	}
+
+	if c.Health("b") != nil {
+		t.Fatal("expected route without a health check not to be checked")
+	}
+
+	ta := c.targetFor("a", "10.0.0.1:80")
+
+	if err := c.Update([]*store.Route{a, b}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.targetFor("a", "10.0.0.1:80") != ta {
+		t.Fatal("expected unchanged check to keep running")
+	}
+
+	a.HealthCheck = nil
+	if err := c.Update([]*store.Route{a, b}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Health("a") != nil {
+		t.Fatal("expected check to stop when removed from the route")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	var lck sync.Mutex
+	down := map[string]bool{"10.0.0.3:80": true}
+	fe := &fakeService{}
+	c := newTestChecker(fe, down, &lck)
+	defer c.Close()
+
+	rt := &store.Route{
+		Name:     "a",
+		Port:     80,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.1:80"},
+		Groups: []*store.BackendGroup{
+			{Name: "v2", Backends: []string{"10.0.0.2:80", "10.0.0.3:80"}, Weight: 5},
+		},
+		HealthCheck: &store.HealthCheck{Interval: 3600, Fall: 1},
+	}
+
+	if err := c.Update([]*store.Route{rt}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c.check(c.targetFor("a", "10.0.0.3:80"))
+
+	if s := c.Health("a")["10.0.0.3:80"]; s == nil || s.Healthy {
+		t.Fatalf("expected group backend to be checked, got %v", s)
+	}
+
+	fe.lck.Lock()
+	bes := fe.rts[0].Groups[0].Backends
+	fe.lck.Unlock()
+
+	if !sameBackends(bes, []string{"10.0.0.2:80"}) {
+		t.Fatalf("expected unhealthy group backend to be removed, got %v", bes)
+	}
+}
@@ -0,0 +1,45 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+)
+
+// The actions of an AccessRule.
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessAll is the source of an AccessRule that matches every client.
+const AccessAll = "all"
+
+const sshaPrefix = "{SSHA}"
+
+// HashPassword hashes a password as salted SHA-1 in the {SSHA} form of
+// htpasswd files, which nginx supports without relying on the system's crypt.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return sshaHash(password, salt), nil
+}
+
+func sshaHash(password string, salt []byte) string {
+	h := sha1.New()
+	h.Write([]byte(password))
+	h.Write(salt)
+	return sshaPrefix + base64.StdEncoding.EncodeToString(append(h.Sum(nil), salt...))
+}
+
+// User returns the named user of the route or nil.
+func (a *Access) User(name string) *BasicUser {
+	for _, u := range a.Users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// checkPassword indicates whether the password matches a hash returned by
+// HashPassword.
+func checkPassword(hash, password string) bool {
+	if !strings.HasPrefix(hash, sshaPrefix) {
+		return false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(hash[len(sshaPrefix):])
+	if err != nil || len(b) <= sha1.Size {
+		return false
+	}
+
+	return sshaHash(password, b[sha1.Size:]) == hash
+}
+
+func TestHashPassword(t *testing.T) {
+	a, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Fatal("expected hashes of the same password to be salted")
+	}
+
+	if !checkPassword(a, "secret") || !checkPassword(b, "secret") {
+		t.Fatal("expected password to match its hash")
+	}
+
+	if checkPassword(a, "Secret") || checkPassword("secret", "secret") {
+		t.Fatal("expected password not to match")
+	}
+}
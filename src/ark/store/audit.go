@@ -0,0 +1,71 @@
+package store
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func auditKey(id int64) []byte {
+	return append([]byte(prefixAudit), encodeRevision(id)...)
+}
+
+// Audit appends e to the audit log, assigning its ID and, if it is not
+// already set, its Time.
+func (s *store) Audit(e *AuditEntry) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	e.Id = s.audit + 1
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+
+	b, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var batch kvBatch
+	batch.Put(auditKey(e.Id), b)
+	batch.Put([]byte(keyAudit), encodeRevision(e.Id))
+	if err := s.db.Write(&batch); err != nil {
+		return err
+	}
+
+	s.audit = e.Id
+	return nil
+}
+
+// AuditLog returns, oldest first, the limit most recent entries in the
+// audit log with an ID less than before. A before of 0 returns the most
+// recent entries in the log.
+func (s *store) AuditLog(before int64, limit int) ([]*AuditEntry, error) {
+	s.lck.Lock()
+	last := s.audit
+	s.lck.Unlock()
+
+	if before <= 0 || before > last+1 {
+		before = last + 1
+	}
+
+	// ids are assigned without gaps, so the range is known up front.
+	start := before - int64(limit)
+	if start < 1 {
+		start = 1
+	}
+
+	var es []*AuditEntry
+	if err := s.db.Iterate(auditKey(start), auditKey(before), func(k, v []byte) error {
+		e := &AuditEntry{}
+		if err := proto.Unmarshal(v, e); err != nil {
+			return err
+		}
+		es = append(es, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
@@ -0,0 +1,27 @@
+package store
+
+// The ways that a route can spread requests over its backends.
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceIPHash     = "ip_hash"
+	BalanceHash       = "hash"
+)
+
+// PruneOptions removes the options of backends that the route no longer has.
+func (r *Route) PruneOptions() {
+	if len(r.BackendOptions) == 0 {
+		return
+	}
+
+	has := map[string]bool{}
+	for _, be := range r.AllBackends() {
+		has[be] = true
+	}
+
+	for be := range r.BackendOptions {
+		if !has[be] {
+			delete(r.BackendOptions, be)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package store
+
+// batchOp is a single operation in a Batch. If check is set, the operation
+// only succeeds if the route is currently at the given version, where a
+// version of 0 means the route must not exist.
+type batchOp struct {
+	name    string
+	op      Revision_Op
+	route   *Route
+	check   bool
+	version int64
+}
+
+// Batch collects saves and deletes that are to be applied to a Store as a
+// single atomic write. Operations are applied in the order they were added.
+type Batch struct {
+	ops  []*batchOp
+	revs []*Revision
+
+	// the error that the batch fails with when it is written.
+	err error
+}
+
+// Revisions returns the revisions that were recorded when the batch was
+// written, or nil if it has not been written.
+func (b *Batch) Revisions() []*Revision {
+	return b.revs
+}
+
+// Save adds a save of the route to the batch. If the route's name is not
+// valid, the entire batch fails with ErrInvalidName when it is written.
+func (b *Batch) Save(r *Route) {
+	if !ValidName(r.Name) && b.err == nil {
+		b.err = ErrInvalidName
+	}
+
+	b.ops = append(b.ops, &batchOp{
+		name:  r.Name,
+		op:    Revision_PUT,
+		route: r,
+	})
+}
+
+// SaveIf is like Save but the entire batch fails with ErrConflict unless the
+// route is at the given version when the save is applied. A version of 0
+// requires that the route not exist.
+func (b *Batch) SaveIf(r *Route, version int64) {
+	b.Save(r)
+	b.ops[len(b.ops)-1].check = true
+	b.ops[len(b.ops)-1].version = version
+}
+
+// Delete ...
+func (b *Batch) Delete(name string) {
+	b.ops = append(b.ops, &batchOp{
+		name: name,
+		op:   Revision_DELETE,
+	})
+}
+
+// DeleteIf is like Delete but the entire batch fails with ErrConflict unless
+// the route is at the given version when the delete is applied.
+func (b *Batch) DeleteIf(name string, version int64) {
+	b.Delete(name)
+	b.ops[len(b.ops)-1].check = true
+	b.ops[len(b.ops)-1].version = version
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("ark")
+
+// boltDB is an engine backed by a single bbolt database file. It is selected
+// with a data URL of bolt://path.
+type boltDB struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (engine, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltDB{db: db}, nil
+}
+
+func (e *boltDB) Get(key []byte) ([]byte, error) {
+	var val []byte
+	if err := e.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+
+		// v is only valid for the life of the transaction.
+		val = make([]byte, len(v))
+		copy(val, v)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
+
+func (e *boltDB) Iterate(start, limit []byte, fn func(k, v []byte) error) error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			if limit != nil && bytes.Compare(k, limit) >= 0 {
+				break
+			}
+
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *boltDB) Write(b *kvBatch) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltBucket)
+		for _, op := range b.ops {
+			var err error
+			if op.del {
+				err = bkt.Delete(op.key)
+			} else {
+				// bolt treats a nil value as a missing key.
+				val := op.val
+				if val == nil {
+					val = []byte{}
+				}
+				err = bkt.Put(op.key, val)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *boltDB) Close() error {
+	return e.db.Close()
+}
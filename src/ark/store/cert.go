@@ -0,0 +1,99 @@
+package store
+
+import "github.com/golang/protobuf/proto"
+
+func certKey(name string) []byte {
+	return []byte(prefixCert + name)
+}
+
+// SaveCert stores the certificate, replacing any with the same name.
+func (s *store) SaveCert(c *Certificate) error {
+	b, err := proto.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	var batch kvBatch
+	batch.Put(certKey(c.Name), b)
+	return s.db.Write(&batch)
+}
+
+// LoadCert loads the named certificate.
+func (s *store) LoadCert(name string, c *Certificate) error {
+	b, err := s.db.Get(certKey(name))
+	if err != nil {
+		return err
+	}
+
+	return proto.Unmarshal(b, c)
+}
+
+// LoadCerts returns every certificate, ordered by name.
+func (s *store) LoadCerts() ([]*Certificate, error) {
+	var certs []*Certificate
+
+	prefix := []byte(prefixCert)
+	if err := s.db.Iterate(prefix, prefixLimit(prefix), func(k, v []byte) error {
+		c := &Certificate{}
+		if err := proto.Unmarshal(v, c); err != nil {
+			return err
+		}
+
+		certs = append(certs, c)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return certs, nil
+}
+
+// DeleteCert removes the named certificate. It returns ErrNotFound if there
+// is no such certificate.
+func (s *store) DeleteCert(name string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if _, err := s.db.Get(certKey(name)); err != nil {
+		return err
+	}
+
+	var batch kvBatch
+	batch.Delete(certKey(name))
+	return s.db.Write(&batch)
+}
+
+// TLSAuto is the value of Route.Tls for routes whose certificate is obtained
+// and renewed by arkd with ACME.
+const TLSAuto = "auto"
+
+// AutoCertPrefix starts the names of the certificates obtained for routes
+// with TLSAuto. Uploaded certificates may not use it.
+const AutoCertPrefix = "acme-"
+
+// CertName returns the name of the certificate that the route is served
+// with, or "" if it is served over plain HTTP. Routes with TLSAuto use a
+// certificate that is named for the route.
+func (r *Route) CertName() string {
+	if r.Tls == TLSAuto {
+		return AutoCertPrefix + r.Name
+	}
+	return r.Cert
+}
+
+func settingKey(name string) []byte {
+	return []byte(prefixSetting + name)
+}
+
+// SaveSetting stores an opaque value that arkd needs to keep, like the key
+// of its ACME account.
+func (s *store) SaveSetting(name string, val []byte) error {
+	var batch kvBatch
+	batch.Put(settingKey(name), val)
+	return s.db.Write(&batch)
+}
+
+// LoadSetting returns a value stored with SaveSetting or ErrNotFound.
+func (s *store) LoadSetting(name string) ([]byte, error) {
+	return s.db.Get(settingKey(name))
+}
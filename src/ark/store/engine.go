@@ -0,0 +1,99 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// engine is the ordered key/value storage that a store is built on. Every
+// engine must return ErrNotFound from Get when a key does not exist.
+type engine interface {
+	Get(key []byte) ([]byte, error)
+
+	// Iterate calls fn, in key order, for every key k such that
+	// start <= k < limit. A nil limit iterates to the end of the keyspace.
+	// k and v are only valid for the duration of the call to fn.
+	Iterate(start, limit []byte, fn func(k, v []byte) error) error
+
+	// Write applies every operation in b atomically.
+	Write(b *kvBatch) error
+
+	Close() error
+}
+
+type kvOp struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// kvBatch is a list of puts and deletes to be written atomically.
+type kvBatch struct {
+	ops []kvOp
+}
+
+func (b *kvBatch) Put(key, val []byte) {
+	b.ops = append(b.ops, kvOp{key: key, val: val})
+}
+
+func (b *kvBatch) Delete(key []byte) {
+	b.ops = append(b.ops, kvOp{key: key, del: true})
+}
+
+// apply writes the batch into kvs. Values are copied so that callers are
+// free to reuse their buffers.
+func (b *kvBatch) apply(kvs map[string][]byte) {
+	for _, op := range b.ops {
+		if op.del {
+			delete(kvs, string(op.key))
+			continue
+		}
+
+		v := make([]byte, len(op.val))
+		copy(v, op.val)
+		kvs[string(op.key)] = v
+	}
+}
+
+// prefixLimit returns the smallest key that is greater than every key with
+// the given prefix, or nil if there isn't one.
+func prefixLimit(prefix []byte) []byte {
+	limit := make([]byte, len(prefix))
+	copy(limit, prefix)
+	for i := len(limit) - 1; i >= 0; i-- {
+		if limit[i] < 0xff {
+			limit[i]++
+			return limit[:i+1]
+		}
+	}
+	return nil
+}
+
+// engines maps the scheme of a data URL to the function that opens it.
+var engines = map[string]func(path string) (engine, error){
+	"leveldb": openLevelDB,
+	"mem":     openMemory,
+	"file":    openFile,
+	"bolt":    openBolt,
+}
+
+// parseDataURL splits a data URL of the form scheme://path. A bare path with
+// no scheme refers to a leveldb database.
+func parseDataURL(url string) (string, string) {
+	ix := strings.Index(url, "://")
+	if ix < 0 {
+		return "leveldb", url
+	}
+	return url[:ix], url[ix+3:]
+}
+
+func openEngine(url string) (engine, error) {
+	scheme, path := parseDataURL(url)
+
+	open := engines[scheme]
+	if open == nil {
+		return nil, fmt.Errorf("unknown store type: %s", scheme)
+	}
+
+	return open(path)
+}
@@ -0,0 +1,649 @@
+package store_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"ark/store"
+	"ark/store/storetest"
+)
+
+type testStore struct {
+	store.Store
+	dir string
+}
+
+func (s *testStore) Close() error {
+	err := s.Store.Close()
+	if err := os.RemoveAll(s.dir); err != nil {
+		return err
+	}
+	return err
+}
+
+// opener returns a function that opens a new store of the given type in a
+// temporary directory that is removed on Close.
+func opener(scheme, name string) func(t *testing.T) store.Store {
+	return func(t *testing.T) store.Store {
+		tmp, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := store.Open(scheme + filepath.Join(tmp, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &testStore{
+			Store: s,
+			dir:   tmp,
+		}
+	}
+}
+
+func TestLevelDB(t *testing.T) {
+	storetest.Run(t, opener("leveldb://", "r.db"))
+}
+
+func TestBareLevelDB(t *testing.T) {
+	storetest.Run(t, opener("", "r.db"))
+}
+
+func TestBolt(t *testing.T) {
+	storetest.Run(t, opener("bolt://", "r.bolt"))
+}
+
+func TestFile(t *testing.T) {
+	storetest.Run(t, opener("file://", "r.json"))
+}
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		s, err := store.Open("mem://")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestOpenUnknown(t *testing.T) {
+	if _, err := store.Open("nope://foo"); err == nil {
+		t.Fatal("expected error opening unknown store type")
+	}
+}
+
+func testRevisionSurvivesReopen(t *testing.T, scheme, name string) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	url := scheme + filepath.Join(tmp, name)
+
+	for i := 0; i < 2; i++ {
+		s, err := store.Open(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Save(&store.Route{
+			Name:  "foo",
+			Port:  80,
+			Hosts: []string{"a"},
+		}, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := store.Open(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	revs, err := s.History("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revs) != 2 || revs[1].Revision != 2 {
+		t.Fatalf("expected revisions 1 and 2 got %v", revs)
+	}
+}
+
+func TestRevisionSurvivesReopen(t *testing.T) {
+	testRevisionSurvivesReopen(t, "leveldb://", "r.db")
+	testRevisionSurvivesReopen(t, "bolt://", "r.bolt")
+	testRevisionSurvivesReopen(t, "file://", "r.json")
+}
+
+func TestFileIsEditable(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "r.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+  "routes": [
+    {"name": "foo", "port": 80, "hosts": ["foo.com"], "backends": ["10.0.0.1:80"]}
+  ]
+}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var rt store.Route
+	if err := s.Load("foo", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Port != 80 || len(rt.Hosts) != 1 || rt.Hosts[0] != "foo.com" {
+		t.Fatalf("unexpected route: %v", &rt)
+	}
+
+	if err := s.Save(&store.Route{
+		Name:  "bar",
+		Port:  8080,
+		Hosts: []string{"bar.com"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b, []byte(`"name": "bar"`)) {
+		t.Fatalf("expected bar to be written as json: %s", b)
+	}
+
+	// hand edited routes are indexed.
+	rts, err := s.Find(&store.Query{Host: "foo.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 || rts[0].Name != "foo" {
+		t.Fatalf("expected foo to be found by host, got %v", rts)
+	}
+}
+
+func TestFileIndexesFollowEdits(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// the file was written with an index entry for a route that has since
+	// been removed by hand.
+	path := filepath.Join(tmp, "r.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+  "routes": [],
+  "meta": {"`+hex.EncodeToString([]byte("\x00idx\x00host\x00a.com\x00a"))+`": ""}
+}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	rts, err := s.Find(&store.Query{Host: "a.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 0 {
+		t.Fatalf("expected no routes, got %v", rts)
+	}
+
+	if err := s.Save(&store.Route{Name: "b", Port: 80, Hosts: []string{"b.com"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte(hex.EncodeToString([]byte("\x00idx\x00")))) {
+		t.Fatalf("expected indexes to be left out of the file: %s", b)
+	}
+}
+
+func TestDiffRoutes(t *testing.T) {
+	from := []*store.Route{
+		{Name: "a", Port: 80, Hosts: []string{"a"}},
+		{Name: "b", Port: 80, Hosts: []string{"b"}},
+		{Name: "c", Port: 80, Hosts: []string{"c"}},
+	}
+
+	to := []*store.Route{
+		{Name: "a", Port: 80, Hosts: []string{"a"}},
+		{Name: "c", Port: 8080, Hosts: []string{"c"}},
+		{Name: "d", Port: 80, Hosts: []string{"d"}},
+	}
+
+	d := store.DiffRoutes(from, to)
+	if len(d.Added) != 1 || d.Added[0].Name != "d" {
+		t.Fatalf("expected d to be added got %v", d.Added)
+	}
+
+	if len(d.Removed) != 1 || d.Removed[0].Name != "b" {
+		t.Fatalf("expected b to be removed got %v", d.Removed)
+	}
+
+	if len(d.Changed) != 1 || d.Changed[0].From.Port != 80 || d.Changed[0].To.Port != 8080 {
+		t.Fatalf("expected c to be changed got %v", d.Changed)
+	}
+
+	if !store.DiffRoutes(to, to).Empty() {
+		t.Fatal("expected no difference between identical routes")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s, err := store.Open("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, name := range []string{"a", "b"} {
+		if err := s.Save(&store.Route{
+			Name:  name,
+			Port:  80,
+			Hosts: []string{name},
+		}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sn, err := store.TakeSnapshot(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sn.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete("a", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save(&store.Route{
+		Name:  "c",
+		Port:  80,
+		Hosts: []string{"c"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rts, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := store.DiffRoutes(rts, sn.Routes)
+	if err := s.Write(d.Apply(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rts, err = s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.DiffRoutes(rts, sn.Routes).Empty() {
+		t.Fatalf("expected restored routes to match snapshot, got %v", rts)
+	}
+
+	if err := s.Write(d.Undo(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var rt store.Route
+	if err := s.Load("c", &rt); err != nil {
+		t.Fatalf("expected undo to restore c: %s", err)
+	}
+}
+
+func TestSnapshotCheck(t *testing.T) {
+	sn := store.Snapshot{
+		Version: store.SnapshotVersion + 1,
+	}
+
+	if err := sn.Check(); err == nil {
+		t.Fatal("expected error for future snapshot version")
+	}
+
+	sn = store.Snapshot{
+		Version: store.SnapshotVersion,
+		Routes: []*store.Route{
+			{Name: "a"},
+			{Name: "a"},
+		},
+	}
+
+	if err := sn.Check(); err == nil {
+		t.Fatal("expected error for duplicate routes")
+	}
+}
+
+// writeRaw writes kvs directly to the leveldb database at path, bypassing
+// the store, to simulate data written by an older version of ark.
+func writeRaw(t *testing.T, path string, kvs map[string][]byte) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for k, v := range kvs {
+		if err := db.Put([]byte(k), v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "r.db")
+
+	old, err := proto.Marshal(&store.Route{
+		Name:     "a",
+		Port:     80,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.1:80"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRaw(t, path, map[string][]byte{"a": old})
+
+	res, err := store.Migrate(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != store.SchemaVersion {
+		t.Fatalf("expected %d migrations, got %d", store.SchemaVersion, len(res))
+	}
+
+	if res[len(res)-1].Version != store.SchemaVersion {
+		t.Fatalf("last migration is %d, expected %d",
+			res[len(res)-1].Version,
+			store.SchemaVersion)
+	}
+
+	// a dry run must leave the data untouched.
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := db.Get([]byte("a"), nil); err != nil || !bytes.Equal(b, old) {
+		t.Fatalf("dry run changed route: %v", err)
+	}
+
+	if _, err := db.Get([]byte("\x00schema"), nil); err != leveldb.ErrNotFound {
+		t.Fatalf("dry run wrote a schema version: %v", err)
+	}
+	db.Close()
+
+	s, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rt store.Route
+	if err := s.Load("a", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Version != 1 {
+		t.Fatalf("expected version 1, got %d", rt.Version)
+	}
+
+	revs, err := s.History("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revs) != 1 || revs[0].Revision != 1 {
+		t.Fatalf("expected an initial revision, got %v", revs)
+	}
+
+	rts, err := s.Find(&store.Query{Host: "a.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 || rts[0].Name != "a" {
+		t.Fatalf("expected route a to be indexed, got %v", rts)
+	}
+
+	// new writes continue from the migrated revisions.
+	if err := s.Save(&store.Route{Name: "b", Port: 80}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Load("b", &rt); err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Version != 2 {
+		t.Fatalf("expected version 2, got %d", rt.Version)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an up to date store has nothing to do.
+	res, err = store.Migrate(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 0 {
+		t.Fatalf("expected no migrations, got %d", len(res))
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "r.db")
+
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], store.SchemaVersion+1)
+	writeRaw(t, path, map[string][]byte{"\x00schema": v[:]})
+
+	if _, err := store.Open(path); err == nil {
+		t.Fatal("expected error opening a store with a newer schema")
+	}
+}
+
+func TestFsck(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "r.db")
+
+	s, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rt := range []*store.Route{
+		{Name: "a", Port: 80, Hosts: []string{"a.com"}},
+		{Name: "b", Port: 80, Hosts: []string{"b.com"}},
+	} {
+		if err := s.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeRaw(t, path, map[string][]byte{"c": []byte("\xff\xff\xff")})
+
+	s, err = store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unparseable record must not break every other route.
+	rts, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(rts))
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reject := func(r *store.Route, ok []*store.Route) error {
+		if r.Name == "b" {
+			return errors.New("bad route")
+		}
+		return nil
+	}
+
+	probs, err := store.Fsck(path, reject, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(probs) != 2 || probs[0].Name != "b" || probs[1].Name != "c" {
+		t.Fatalf("expected problems with b and c, got %v", probs)
+	}
+
+	if _, err := store.Fsck(path, reject, false); err != nil {
+		t.Fatal(err)
+	}
+
+	probs, err = store.Fsck(path, reject, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(probs) != 0 {
+		t.Fatalf("expected no problems after repair, got %v", probs)
+	}
+
+	s, err = store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	rts, err = s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 || rts[0].Name != "a" {
+		t.Fatalf("expected only route a, got %v", rts)
+	}
+
+	// quarantined routes must also be gone from the indexes.
+	rts, err = s.Find(&store.Query{Host: "b.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 0 {
+		t.Fatalf("expected b to be unindexed, got %v", rts)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{
+		"team":             "web",
+		"env":              "staging",
+		"example.com/tier": "1",
+	}
+
+	for _, c := range []struct {
+		sel     string
+		matches bool
+	}{
+		{"", true},
+		{"team=web", true},
+		{"team==web", true},
+		{"team=api", false},
+		{"team=web, env=staging", true},
+		{"team=web,env=prod", false},
+		{"env!=prod", true},
+		{"owner!=bob", true},
+		{"env!=staging", false},
+		{"example.com/tier", true},
+		{"owner", false},
+		{"!owner", true},
+		{"!team", false},
+		{"owner=", false},
+	} {
+		sel, err := store.ParseSelector(c.sel)
+		if err != nil {
+			t.Fatalf("unable to parse '%s': %s", c.sel, err)
+		}
+
+		if sel.Matches(labels) != c.matches {
+			t.Fatalf("expected '%s' to match %t", c.sel, c.matches)
+		}
+	}
+
+	for _, sel := range []string{"te am=web", "team=w b", "=web", "!", "team=-web"} {
+		if _, err := store.ParseSelector(sel); err == nil {
+			t.Fatalf("expected error parsing '%s'", sel)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// fileData is the on-disk format of a file engine. Routes are kept as plain
+// JSON so that operators can edit them by hand while arkd is stopped.
+// Everything else the store records, like the revision log, is kept opaque
+// in Meta, keyed by the hex encoding of the key. The indexes are left out and
+// rebuilt on open so that they follow hand edits.
+type fileData struct {
+	Routes []*Route          `json:"routes"`
+	Meta   map[string][]byte `json:"meta,omitempty"`
+}
+
+// file is an engine that keeps everything in memory and rewrites a single
+// JSON file on every write. It is selected with a data URL of file://path.
+type file struct {
+	path string
+
+	lck sync.Mutex
+	mem *memory
+}
+
+func openFile(path string) (engine, error) {
+	e := &file{
+		path: path,
+		mem:  newMemory(),
+	}
+
+	r, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var data fileData
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	for _, rt := range data.Routes {
+		b, err := proto.Marshal(rt)
+		if err != nil {
+			return nil, err
+		}
+		e.mem.kvs[rt.Name] = b
+	}
+
+	for k, v := range data.Meta {
+		key, err := hex.DecodeString(k)
+		if err != nil {
+			return nil, err
+		}
+		if !isIndexKey(key) {
+			e.mem.kvs[string(key)] = v
+		}
+	}
+
+	var batch kvBatch
+	if err := rebuildIndexes(e.mem, &batch); err != nil {
+		return nil, err
+	}
+	batch.apply(e.mem.kvs)
+
+	return e, nil
+}
+
+// save atomically replaces the file with the contents of kvs.
+func (e *file) save(kvs map[string][]byte) error {
+	data := fileData{
+		Routes: []*Route{},
+		Meta:   map[string][]byte{},
+	}
+
+	m := &memory{kvs: kvs}
+	for _, k := range m.keys(nil, nil) {
+		v := kvs[k]
+
+		if isIndexKey([]byte(k)) {
+			continue
+		}
+
+		if k[0] != 0 {
+			rt := &Route{}
+			if err := proto.Unmarshal(v, rt); err == nil && rt.Name == k {
+				data.Routes = append(data.Routes, rt)
+				continue
+			}
+		}
+
+		data.Meta[hex.EncodeToString([]byte(k))] = v
+	}
+
+	b, err := json.MarshalIndent(&data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(
+		filepath.Dir(e.path),
+		"."+filepath.Base(e.path)+".tmp")
+
+	w, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, e.path)
+}
+
+func (e *file) Get(key []byte) ([]byte, error) {
+	return e.mem.Get(key)
+}
+
+func (e *file) Iterate(start, limit []byte, fn func(k, v []byte) error) error {
+	return e.mem.Iterate(start, limit, fn)
+}
+
+func (e *file) Write(b *kvBatch) error {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+
+	e.mem.lck.RLock()
+	kvs := make(map[string][]byte, len(e.mem.kvs))
+	for k, v := range e.mem.kvs {
+		kvs[k] = v
+	}
+	e.mem.lck.RUnlock()
+
+	b.apply(kvs)
+
+	if err := e.save(kvs); err != nil {
+		return err
+	}
+
+	e.mem.lck.Lock()
+	e.mem.kvs = kvs
+	e.mem.lck.Unlock()
+	return nil
+}
+
+func (e *file) Close() error {
+	return e.mem.Close()
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Problem is a record that Fsck found to be unparseable or invalid.
+type Problem struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func quarantineKey(name string) []byte {
+	return []byte(prefixQuarantine + name)
+}
+
+// Fsck scans every route in the store described by the data URL and reports
+// the records that cannot be parsed, that are stored under the wrong name or
+// that check rejects. Routes are checked in name order and check is given the
+// routes that have passed so far, so when two routes conflict the first one
+// is kept. Unless dryRun is set, the records with problems are moved to a
+// quarantine keyspace where LoadAll and Find no longer see them.
+func Fsck(
+	url string,
+	check func(r *Route, ok []*Route) error,
+	dryRun bool) ([]*Problem, error) {
+	db, err := openEngine(url)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var keys []string
+	var vals [][]byte
+	if err := db.Iterate([]byte{1}, nil, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		vals = append(vals, append([]byte{}, v...))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var ok []*Route
+	var probs []*Problem
+	for i, key := range keys {
+		rt := &Route{}
+		if err := proto.Unmarshal(vals[i], rt); err != nil {
+			probs = append(probs, &Problem{
+				Name:   key,
+				Reason: fmt.Sprintf("unable to parse: %s", err),
+			})
+			continue
+		}
+
+		if rt.Name != key {
+			probs = append(probs, &Problem{
+				Name:   key,
+				Reason: fmt.Sprintf("stored as '%s' but named '%s'", key, rt.Name),
+			})
+			continue
+		}
+
+		if check != nil {
+			if err := check(rt, ok); err != nil {
+				probs = append(probs, &Problem{
+					Name:   key,
+					Reason: err.Error(),
+				})
+				continue
+			}
+		}
+
+		ok = append(ok, rt)
+	}
+
+	if dryRun || len(probs) == 0 {
+		return probs, nil
+	}
+
+	return probs, quarantine(db, probs, keys, vals)
+}
+
+// quarantine moves the records with problems out of the route keyspace along
+// with any index entries that refer to them.
+func quarantine(db engine, probs []*Problem, keys []string, vals [][]byte) error {
+	byKey := make(map[string][]byte, len(keys))
+	for i, key := range keys {
+		byKey[key] = vals[i]
+	}
+
+	bad := map[string]bool{}
+	now := time.Now().Unix()
+
+	var batch kvBatch
+	for _, p := range probs {
+		b, err := proto.Marshal(&Quarantined{
+			Name:   p.Name,
+			Value:  byKey[p.Name],
+			Reason: p.Reason,
+			Time:   now,
+		})
+		if err != nil {
+			return err
+		}
+
+		batch.Delete([]byte(p.Name))
+		batch.Put(quarantineKey(p.Name), b)
+		bad[p.Name] = true
+	}
+
+	for _, prefix := range []string{prefixIndexHost, prefixIndexBackend} {
+		if err := db.Iterate(
+			[]byte(prefix),
+			prefixLimit([]byte(prefix)),
+			func(k, v []byte) error {
+				name := string(k[strings.LastIndex(string(k), "\x00")+1:])
+				if bad[name] {
+					batch.Delete(append([]byte{}, k...))
+				}
+				return nil
+			}); err != nil {
+			return err
+		}
+	}
+
+	return db.Write(&batch)
+}
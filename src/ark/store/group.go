@@ -0,0 +1,22 @@
+package store
+
+// Group returns the route's backend group with the given name, or nil if it
+// has none.
+func (r *Route) Group(name string) *BackendGroup {
+	for _, g := range r.Groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// DefaultWeight returns the percentage of requests that go to the route's
+// own backends rather than to one of its groups.
+func (r *Route) DefaultWeight() int32 {
+	w := int32(100)
+	for _, g := range r.Groups {
+		w -= g.Weight
+	}
+	return w
+}
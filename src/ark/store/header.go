@@ -0,0 +1,14 @@
+package store
+
+// The directions of a HeaderRule.
+const (
+	HeaderRequest  = "request"
+	HeaderResponse = "response"
+)
+
+// The actions of a HeaderRule.
+const (
+	HeaderSet    = "set"
+	HeaderAdd    = "add"
+	HeaderRemove = "remove"
+)
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Secondary indexes map a host or a backend to the names of the routes that
+// use it. Index entries have empty values; everything is in the key. A
+// change to the set of indexes needs a migration that calls rebuildIndexes.
+const (
+	prefixIndex        = "\x00idx\x00"
+	prefixIndexHost    = prefixIndex + "host\x00"
+	prefixIndexBackend = prefixIndex + "be\x00"
+)
+
+// isIndexKey indicates whether key is an index entry.
+func isIndexKey(key []byte) bool {
+	return strings.HasPrefix(string(key), prefixIndex)
+}
+
+// Query selects routes in Find. Every field that is set must match.
+type Query struct {
+	// Host matches routes that serve the host exactly.
+	Host string
+
+	// Backend matches routes that have the backend, either as one of their
+	// own backends or in a path rule. A backend without a port matches that
+	// address on any port.
+	Backend string
+
+	// Port matches routes that listen on the port, including port 80 for
+	// routes that force https.
+	Port int32
+
+	// Selector matches routes by their labels.
+	Selector Selector
+}
+
+// Matches indicates whether the route satisfies the query.
+func (q *Query) Matches(r *Route) bool {
+	if q.Host != "" && !contains(r.Hosts, q.Host) {
+		return false
+	}
+
+	if !q.Selector.Matches(r.Labels) {
+		return false
+	}
+
+	if q.Port != 0 {
+		found := false
+		for _, port := range r.Ports() {
+			if port == q.Port {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if q.Backend != "" {
+		found := false
+		for _, be := range r.AllBackends() {
+			if backendMatches(be, q.Backend) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+func backendMatches(be, q string) bool {
+	if strings.Contains(q, ":") {
+		return be == q
+	}
+	return strings.HasPrefix(be, q+":")
+}
+
+func indexKey(prefix, value, name string) []byte {
+	return []byte(prefix + value + "\x00" + name)
+}
+
+// indexKeys returns every index entry for the route.
+func indexKeys(r *Route) [][]byte {
+	var keys [][]byte
+	for _, host := range r.Hosts {
+		keys = append(keys, indexKey(prefixIndexHost, host, r.Name))
+	}
+
+	for _, be := range r.AllBackends() {
+		keys = append(keys, indexKey(prefixIndexBackend, be, r.Name))
+	}
+	return keys
+}
+
+// reindex adds the changes needed to move the indexes from the state of
+// route prev to the state of route next to batch. Either may be nil.
+func reindex(batch *kvBatch, prev, next *Route) {
+	if prev != nil {
+		for _, key := range indexKeys(prev) {
+			batch.Delete(key)
+		}
+	}
+
+	if next != nil {
+		for _, key := range indexKeys(next) {
+			batch.Put(key, nil)
+		}
+	}
+}
+
+// rebuildIndexes adds the changes needed to rebuild every index from
+// scratch to batch.
+func rebuildIndexes(db engine, batch *kvBatch) error {
+	for _, prefix := range []string{prefixIndexHost, prefixIndexBackend} {
+		if err := db.Iterate(
+			[]byte(prefix),
+			prefixLimit([]byte(prefix)),
+			func(k, v []byte) error {
+				batch.Delete(append([]byte{}, k...))
+				return nil
+			}); err != nil {
+			return err
+		}
+	}
+
+	return db.Iterate([]byte{1}, nil, func(k, v []byte) error {
+		// unparseable records are left for arkd fsck.
+		r := &Route{}
+		if err := proto.Unmarshal(v, r); err != nil {
+			return nil
+		}
+		reindex(batch, nil, r)
+		return nil
+	})
+}
+
+// namesIn returns the route names in the index under prefix.
+func (s *store) namesIn(prefix string) (map[string]bool, error) {
+	names := map[string]bool{}
+	if err := s.db.Iterate(
+		[]byte(prefix),
+		prefixLimit([]byte(prefix)),
+		func(k, v []byte) error {
+			names[string(k[len(prefix):])] = true
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Find returns the routes that match q, ordered by name.
+func (s *store) Find(q *Query) ([]*Route, error) {
+	var names map[string]bool
+
+	if q.Host != "" {
+		ns, err := s.namesIn(prefixIndexHost + q.Host + "\x00")
+		if err != nil {
+			return nil, err
+		}
+		names = ns
+	}
+
+	if q.Backend != "" {
+		prefix := prefixIndexBackend + q.Backend + "\x00"
+		if !strings.Contains(q.Backend, ":") {
+			prefix = prefixIndexBackend + q.Backend + ":"
+		}
+
+		ns, err := s.namesIn(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		// entries for an address without a port have the form
+		// addr:port\x00name, so strip the port.
+		if !strings.Contains(q.Backend, ":") {
+			bare := map[string]bool{}
+			for n := range ns {
+				if ix := strings.Index(n, "\x00"); ix >= 0 {
+					bare[n[ix+1:]] = true
+				}
+			}
+			ns = bare
+		}
+
+		if names == nil {
+			names = ns
+		} else {
+			for n := range names {
+				if !ns[n] {
+					delete(names, n)
+				}
+			}
+		}
+	}
+
+	if names == nil {
+		rts, err := s.LoadAll()
+		if err != nil {
+			return nil, err
+		}
+
+		var res []*Route
+		for _, rt := range rts {
+			if q.Matches(rt) {
+				res = append(res, rt)
+			}
+		}
+		return res, nil
+	}
+
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	rts := make([]*Route, 0, len(sorted))
+	for _, n := range sorted {
+		// entries for routes that are gone are skipped rather than failing
+		// every lookup.
+		rt := &Route{}
+		if err := s.Load(n, rt); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// ports and labels are not indexed.
+		if q.Matches(rt) {
+			rts = append(rts, rt)
+		}
+	}
+
+	return rts, nil
+}
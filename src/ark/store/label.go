@@ -0,0 +1,101 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	validLabelKey   = regexp.MustCompile(`^([a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?/)?[A-Za-z0-9]([A-Za-z0-9_.-]{0,61}[A-Za-z0-9])?$`)
+	validLabelValue = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9_.-]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// ValidLabelKey indicates whether k can be used as the key of a label or an
+// annotation, e.g. team or example.com/ticket.
+func ValidLabelKey(k string) bool {
+	return validLabelKey.MatchString(k)
+}
+
+// ValidLabelValue indicates whether v can be used as the value of a label.
+func ValidLabelValue(v string) bool {
+	return validLabelValue.MatchString(v)
+}
+
+const (
+	selectEquals    = "="
+	selectNotEquals = "!="
+	selectExists    = ""
+	selectNotExists = "!"
+)
+
+type selectorTerm struct {
+	key, op, value string
+}
+
+func (t *selectorTerm) matches(labels map[string]string) bool {
+	v, ok := labels[t.key]
+	switch t.op {
+	case selectEquals:
+		return ok && v == t.value
+	case selectNotEquals:
+		return !ok || v != t.value
+	case selectExists:
+		return ok
+	case selectNotExists:
+		return !ok
+	}
+	return false
+}
+
+// Selector matches routes by their labels. The empty selector matches every
+// route.
+type Selector []selectorTerm
+
+// ParseSelector parses a comma separated list of terms that must all hold,
+// each of the form key=value, key!=value, key or !key.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var t selectorTerm
+		if ix := strings.Index(term, "!="); ix >= 0 {
+			t = selectorTerm{term[:ix], selectNotEquals, term[ix+2:]}
+		} else if ix := strings.Index(term, "=="); ix >= 0 {
+			t = selectorTerm{term[:ix], selectEquals, term[ix+2:]}
+		} else if ix := strings.Index(term, "="); ix >= 0 {
+			t = selectorTerm{term[:ix], selectEquals, term[ix+1:]}
+		} else if strings.HasPrefix(term, "!") {
+			t = selectorTerm{term[1:], selectNotExists, ""}
+		} else {
+			t = selectorTerm{term, selectExists, ""}
+		}
+
+		t.key = strings.TrimSpace(t.key)
+		t.value = strings.TrimSpace(t.value)
+		if !ValidLabelKey(t.key) {
+			return nil, fmt.Errorf("invalid label key in selector: '%s'", t.key)
+		}
+
+		if !ValidLabelValue(t.value) {
+			return nil, fmt.Errorf("invalid label value in selector: '%s'", t.value)
+		}
+
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+// Matches indicates whether labels satisfy every term of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for i := range s {
+		if !s[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelDB is an engine backed by a goleveldb database directory.
+type levelDB struct {
+	db *leveldb.DB
+}
+
+func openLevelDB(path string) (engine, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &levelDB{db: db}, nil
+}
+
+func (e *levelDB) Get(key []byte) ([]byte, error) {
+	return e.db.Get(key, nil)
+}
+
+func (e *levelDB) Iterate(start, limit []byte, fn func(k, v []byte) error) error {
+	it := e.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if err := fn(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+func (e *levelDB) Write(b *kvBatch) error {
+	var batch leveldb.Batch
+	for _, op := range b.ops {
+		if op.del {
+			batch.Delete(op.key)
+		} else {
+			batch.Put(op.key, op.val)
+		}
+	}
+	return e.db.Write(&batch, nil)
+}
+
+func (e *levelDB) Close() error {
+	return e.db.Close()
+}
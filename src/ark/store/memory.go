@@ -0,0 +1,90 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// memory is an engine that keeps everything in memory and loses it all on
+// Close. It is selected with a data URL of mem://.
+type memory struct {
+	lck sync.RWMutex
+	kvs map[string][]byte
+}
+
+func openMemory(path string) (engine, error) {
+	return newMemory(), nil
+}
+
+func newMemory() *memory {
+	return &memory{
+		kvs: map[string][]byte{},
+	}
+}
+
+func (e *memory) Get(key []byte) ([]byte, error) {
+	e.lck.RLock()
+	defer e.lck.RUnlock()
+
+	v, ok := e.kvs[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return v, nil
+}
+
+// keys returns the keys in the range [start, limit) in order. The caller
+// must hold e.lck.
+func (e *memory) keys(start, limit []byte) []string {
+	var keys []string
+	for k := range e.kvs {
+		if bytes.Compare([]byte(k), start) < 0 {
+			continue
+		}
+
+		if limit != nil && bytes.Compare([]byte(k), limit) >= 0 {
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *memory) Iterate(start, limit []byte, fn func(k, v []byte) error) error {
+	e.lck.RLock()
+	keys := e.keys(start, limit)
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		vals[i] = e.kvs[k]
+	}
+	e.lck.RUnlock()
+
+	for i, k := range keys {
+		if err := fn([]byte(k), vals[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *memory) Write(b *kvBatch) error {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+
+	b.apply(e.kvs)
+	return nil
+}
+
+func (e *memory) Close() error {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+
+	e.kvs = map[string][]byte{}
+	return nil
+}
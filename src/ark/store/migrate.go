@@ -0,0 +1,169 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// SchemaVersion is the version of the stored data written by this version of
+// ark. It is the version of the last migration.
+const SchemaVersion = 2
+
+// migration upgrades the stored data from the previous schema version to
+// version. fn adds the changes it needs to batch; it must not write to db.
+type migration struct {
+	version int64
+	desc    string
+	fn      func(db engine, batch *kvBatch) error
+}
+
+// migrations are run in order by Open. New migrations are appended here along
+// with a bump to SchemaVersion. Never change or remove a migration that has
+// been released.
+var migrations = []migration{
+	{1, "assign versions and an initial revision to unversioned routes", versionRoutes},
+	{2, "build the host and backend indexes", rebuildIndexes},
+}
+
+// MigrationResult describes a migration that was applied to a store, or would
+// be in a dry run.
+type MigrationResult struct {
+	Version     int64  `json:"version"`
+	Description string `json:"description"`
+	Puts        int    `json:"puts"`
+	Deletes     int    `json:"deletes"`
+}
+
+// versionRoutes gives every route that was written before routes had
+// versions a version and an entry in the revision log.
+func versionRoutes(db engine, batch *kvBatch) error {
+	var rts []*Route
+	if err := db.Iterate([]byte{1}, nil, func(k, v []byte) error {
+		// unparseable records are left for arkd fsck.
+		r := &Route{}
+		if err := proto.Unmarshal(v, r); err != nil {
+			return nil
+		}
+
+		if r.Version == 0 {
+			rts = append(rts, r)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(rts) == 0 {
+		return nil
+	}
+
+	rev, err := loadCounter(db, keyRevision)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, rt := range rts {
+		rev++
+		rt.Version = rev
+
+		b, err := proto.Marshal(rt)
+		if err != nil {
+			return err
+		}
+		batch.Put([]byte(rt.Name), b)
+
+		b, err = proto.Marshal(&Revision{
+			Revision: rev,
+			Name:     rt.Name,
+			Op:       Revision_PUT,
+			Time:     now,
+			Route:    rt,
+		})
+		if err != nil {
+			return err
+		}
+		batch.Put(logKey(rev), b)
+		batch.Put(historyKey(rt.Name, rev), nil)
+	}
+
+	batch.Put([]byte(keyRevision), encodeRevision(rev))
+	return nil
+}
+
+// migrate brings the data in db up to SchemaVersion. Each migration is
+// written atomically along with the new schema version, so an interrupted
+// upgrade resumes where it left off the next time the store is opened.
+func migrate(db engine) ([]*MigrationResult, error) {
+	version, err := loadCounter(db, keySchema)
+	if err != nil {
+		return nil, err
+	}
+
+	if version > SchemaVersion {
+		return nil, fmt.Errorf(
+			"store schema version %d is newer than this version of ark supports (%d)",
+			version,
+			SchemaVersion)
+	}
+
+	var res []*MigrationResult
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		var batch kvBatch
+		if err := m.fn(db, &batch); err != nil {
+			return nil, fmt.Errorf("migration %d: %s", m.version, err)
+		}
+
+		r := &MigrationResult{
+			Version:     m.version,
+			Description: m.desc,
+		}
+		for _, op := range batch.ops {
+			if op.del {
+				r.Deletes++
+			} else {
+				r.Puts++
+			}
+		}
+
+		batch.Put([]byte(keySchema), encodeRevision(m.version))
+		if err := db.Write(&batch); err != nil {
+			return nil, err
+		}
+
+		res = append(res, r)
+	}
+
+	return res, nil
+}
+
+// Migrate brings the store described by the data URL up to SchemaVersion and
+// returns the migrations that were applied. With dryRun, the migrations are
+// run against an in-memory copy of the store and the store is not changed.
+func Migrate(url string, dryRun bool) ([]*MigrationResult, error) {
+	db, err := openEngine(url)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if !dryRun {
+		return migrate(db)
+	}
+
+	mem := newMemory()
+	if err := db.Iterate(nil, nil, func(k, v []byte) error {
+		mem.kvs[string(k)] = append([]byte{}, v...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return migrate(mem)
+}
@@ -0,0 +1,30 @@
+package store
+
+// The ways that a PathRule can match a request path.
+const (
+	MatchPrefix = "prefix"
+	MatchExact  = "exact"
+	MatchRegex  = "regex"
+)
+
+// MatchType returns how the rule matches request paths, which is MatchPrefix
+// when Match is not set.
+func (r *PathRule) MatchType() string {
+	if r.Match == "" {
+		return MatchPrefix
+	}
+	return r.Match
+}
+
+// AllBackends returns the route's backends followed by the backends of each
+// of its path rules and then of each of its backend groups.
+func (r *Route) AllBackends() []string {
+	bes := r.Backends
+	for _, p := range r.Paths {
+		bes = append(bes[:len(bes):len(bes)], p.Backends...)
+	}
+	for _, g := range r.Groups {
+		bes = append(bes[:len(bes):len(bes)], g.Backends...)
+	}
+	return bes
+}
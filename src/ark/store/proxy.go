@@ -0,0 +1,14 @@
+package store
+
+// StreamingReadTimeout is the read timeout, in seconds, of routes that proxy
+// websockets or do not buffer and do not set one.
+const StreamingReadTimeout = 3600
+
+// ReadTimeoutOrDefault returns the read timeout of the route in seconds, or 0
+// for nginx's default.
+func (o *ProxyOptions) ReadTimeoutOrDefault() int32 {
+	if o.ReadTimeout == 0 && (o.Websocket || o.DisableBuffering) {
+		return StreamingReadTimeout
+	}
+	return o.ReadTimeout
+}
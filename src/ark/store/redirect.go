@@ -0,0 +1,39 @@
+package store
+
+// DefaultRedirectCode is the status of a redirect that does not set one.
+const DefaultRedirectCode = 301
+
+// HTTPPort is the port on which routes that force https redirect plain HTTP
+// requests.
+const HTTPPort = 80
+
+// StatusCode returns the status of the redirect, which is
+// DefaultRedirectCode when Code is not set.
+func (r *Redirect) StatusCode() int32 {
+	if r.Code == 0 {
+		return DefaultRedirectCode
+	}
+	return r.Code
+}
+
+// Ports returns every port that the route listens on, which includes
+// HTTPPort for a route that forces https.
+func (r *Route) Ports() []int32 {
+	if r.ForceHttps && r.Port != HTTPPort {
+		return []int32{r.Port, HTTPPort}
+	}
+	return []int32{r.Port}
+}
+
+// SharedPort returns a port on which both routes listen, or 0 if there is
+// none.
+func (r *Route) SharedPort(o *Route) int32 {
+	for _, a := range r.Ports() {
+		for _, b := range o.Ports() {
+			if a == b {
+				return a
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// SnapshotVersion is the version of the snapshot format written by this
+// version of ark. Version 2 added certificates.
+const SnapshotVersion = 2
+
+// Snapshot is a portable export of every route and certificate in a Store.
+type Snapshot struct {
+	Version int            `json:"version"`
+	Time    int64          `json:"time"`
+	Routes  []*Route       `json:"routes"`
+	Certs   []*Certificate `json:"certs,omitempty"`
+}
+
+// Change is a route that exists on both sides of a Diff with different values.
+type Change struct {
+	From *Route `json:"from"`
+	To   *Route `json:"to"`
+}
+
+// Diff describes the changes needed to go from one set of routes to another.
+type Diff struct {
+	Added   []*Route  `json:"added,omitempty"`
+	Removed []*Route  `json:"removed,omitempty"`
+	Changed []*Change `json:"changed,omitempty"`
+}
+
+// TakeSnapshot exports every route and certificate in s.
+func TakeSnapshot(s Store) (*Snapshot, error) {
+	rts, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if rts == nil {
+		rts = []*Route{}
+	}
+
+	certs, err := s.LoadCerts()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{
+		Version: SnapshotVersion,
+		Time:    time.Now().Unix(),
+		Routes:  rts,
+		Certs:   certs,
+	}, nil
+}
+
+// Check ensures that the snapshot can be read by this version of ark and
+// that it names each route and certificate only once.
+func (s *Snapshot) Check() error {
+	if s.Version < 1 || s.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version: %d", s.Version)
+	}
+
+	seen := map[string]bool{}
+	for _, rt := range s.Routes {
+		if seen[rt.Name] {
+			return fmt.Errorf("duplicate route: '%s'", rt.Name)
+		}
+		seen[rt.Name] = true
+	}
+
+	seen = map[string]bool{}
+	for _, c := range s.Certs {
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate certificate: '%s'", c.Name)
+		}
+		seen[c.Name] = true
+	}
+
+	return nil
+}
+
+func byName(rts []*Route) map[string]*Route {
+	m := make(map[string]*Route, len(rts))
+	for _, rt := range rts {
+		m[rt.Name] = rt
+	}
+	return m
+}
+
+func sortedNames(m map[string]*Route) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// equalRoutes compares two routes ignoring their versions.
+func equalRoutes(a, b *Route) bool {
+	a, b = proto.Clone(a).(*Route), proto.Clone(b).(*Route)
+	a.Version, b.Version = 0, 0
+	return proto.Equal(a, b)
+}
+
+// DiffRoutes computes the changes that turn from into to.
+func DiffRoutes(from, to []*Route) *Diff {
+	f, t := byName(from), byName(to)
+
+	d := &Diff{}
+	for _, name := range sortedNames(t) {
+		if fr := f[name]; fr == nil {
+			d.Added = append(d.Added, t[name])
+		} else if !equalRoutes(fr, t[name]) {
+			d.Changed = append(d.Changed, &Change{
+				From: fr,
+				To:   t[name],
+			})
+		}
+	}
+
+	for _, name := range sortedNames(f) {
+		if t[name] == nil {
+			d.Removed = append(d.Removed, f[name])
+		}
+	}
+
+	return d
+}
+
+// Empty indicates whether the diff has no changes.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Apply returns a batch that makes the changes described by d.
+func (d *Diff) Apply() *Batch {
+	var b Batch
+	for _, rt := range d.Removed {
+		b.Delete(rt.Name)
+	}
+
+	for _, c := range d.Changed {
+		b.Save(c.To)
+	}
+
+	for _, rt := range d.Added {
+		b.Save(rt)
+	}
+	return &b
+}
+
+// Undo returns a batch that reverts the changes described by d.
+func (d *Diff) Undo() *Batch {
+	var b Batch
+	for _, rt := range d.Added {
+		b.Delete(rt.Name)
+	}
+
+	for _, c := range d.Changed {
+		b.Save(c.From)
+	}
+
+	for _, rt := range d.Removed {
+		b.Save(rt)
+	}
+	return &b
+}
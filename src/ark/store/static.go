@@ -0,0 +1,18 @@
+package store
+
+import "path/filepath"
+
+// StaticRoot returns the directory in dir that holds the route's static
+// content, or "" if the route has none.
+func (r *Route) StaticRoot(dir string) string {
+	if r.Static == nil {
+		return ""
+	}
+	return filepath.Join(dir, r.Static.Digest)
+}
+
+// InMaintenance indicates whether the route answers every request with a
+// 503.
+func (r *Route) InMaintenance() bool {
+	return r.Maintenance != nil && r.Maintenance.Enabled
+}
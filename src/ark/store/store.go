@@ -1,6 +1,14 @@
 package store
 
 import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/golang/protobuf/proto"
 	"github.com/syndtr/goleveldb/leveldb"
 )
@@ -8,45 +16,285 @@ import (
 // ErrNotFound ...
 var ErrNotFound = leveldb.ErrNotFound
 
+// ErrConflict is returned when a write's expected version of a route does
+// not match the version in the store.
+var ErrConflict = errors.New("version conflict")
+
+// ErrInvalidName is returned when a write saves a route whose name is not
+// valid, see ValidName.
+var ErrInvalidName = errors.New("invalid route name")
+
+// Keys that begin with a zero byte are reserved for the store's own
+// bookkeeping. Routes live at their bare names.
+const (
+	keyRevision   = "\x00rev"
+	prefixLog     = "\x00log\x00"
+	prefixHistory = "\x00hist\x00"
+	keyAudit      = "\x00auditid"
+	prefixAudit   = "\x00audit\x00"
+	keySchema     = "\x00schema"
+
+	prefixQuarantine = "\x00quar\x00"
+	prefixCert       = "\x00cert\x00"
+	prefixSetting    = "\x00set\x00"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,252}$`)
+
+// ValidName indicates whether name can be used as the name of a route, e.g.
+// web or api.example.com. Names are used as keys, so they may never reach
+// the keys that are reserved for bookkeeping.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// reservedName indicates whether name could refer to a bookkeeping key or
+// into another route's history rather than to a route.
+func reservedName(name string) bool {
+	return strings.Contains(name, "\x00")
+}
+
 // Store ...
 type Store interface {
-	Save(*Route) error
-	Delete(string) error
+	Save(r *Route, user string) error
+	Delete(name, user string) error
 	Load(string, *Route) error
 	LoadAll() ([]*Route, error)
+	History(string) ([]*Revision, error)
+	Write(b *Batch, user string) error
+	Watch(rev int64) (*Watcher, error)
+	Audit(e *AuditEntry) error
+	AuditLog(before int64, limit int) ([]*AuditEntry, error)
+	Find(q *Query) ([]*Route, error)
+	SaveCert(c *Certificate) error
+	LoadCert(name string, c *Certificate) error
+	LoadCerts() ([]*Certificate, error)
+	DeleteCert(name string) error
+	SaveSetting(name string, val []byte) error
+	LoadSetting(name string) ([]byte, error)
 	Close() error
 }
 
 // Store ...
 type store struct {
-	db *leveldb.DB
+	db engine
+
+	lck   sync.Mutex
+	rev   int64
+	audit int64
+
+	ws watchers
+}
+
+func encodeRevision(rev int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(rev))
+	return b[:]
 }
 
-// Open ...
-func Open(path string) (Store, error) {
-	db, err := leveldb.OpenFile(path, nil)
+func decodeRevision(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func logKey(rev int64) []byte {
+	return append([]byte(prefixLog), encodeRevision(rev)...)
+}
+
+func historyPrefix(name string) []byte {
+	return []byte(prefixHistory + name + "\x00")
+}
+
+func historyKey(name string, rev int64) []byte {
+	return append(historyPrefix(name), encodeRevision(rev)...)
+}
+
+// Open opens the store described by the data URL. The scheme of the URL
+// selects the storage engine:
+//
+//	leveldb://path  a goleveldb database directory (also used for bare paths)
+//	bolt://path     a bbolt database file
+//	file://path     a single JSON file that can be edited by hand
+//	mem://          an in-memory store that is lost on Close
+func Open(url string) (Store, error) {
+	db, err := openEngine(url)
 	if err != nil {
 		return nil, err
 	}
 
+	if _, err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	rev, err := loadCounter(db, keyRevision)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	audit, err := loadCounter(db, keyAudit)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &store{
-		db: db,
+		db:    db,
+		rev:   rev,
+		audit: audit,
 	}, nil
 }
 
-// Save ...
-func (s *store) Save(r *Route) error {
-	b, err := proto.Marshal(r)
-	if err != nil {
+// loadCounter reads a counter that was written with encodeRevision, which
+// is 0 if it has never been written.
+func loadCounter(db engine, key string) (int64, error) {
+	b, err := db.Get([]byte(key))
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return decodeRevision(b), nil
+}
+
+// current returns the state of the named route as of the ops applied so far
+// in a commit, nil if it does not exist.
+func (s *store) current(live map[string]*Route, name string) (*Route, error) {
+	if rt, ok := live[name]; ok {
+		return rt, nil
+	}
+
+	rt := &Route{}
+	if err := s.Load(name, rt); err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+// commit assigns consecutive revisions to the ops in b and atomically writes
+// both the changes and their entries in the revision log. Each saved route is
+// given a Version equal to the revision that wrote it. Deleting a route that
+// does not exist fails the entire commit with ErrNotFound and a failed
+// version check fails it with ErrConflict. Watchers are notified of the
+// changes once they are written. The caller must hold s.lck.
+func (s *store) commit(b *Batch, user string) error {
+	var batch kvBatch
+	var revs []*Revision
+
+	// the state of each route as of the ops applied so far, nil if deleted.
+	live := map[string]*Route{}
+
+	if b.err != nil {
+		return b.err
+	}
+
+	rev := s.rev
+	now := time.Now().Unix()
+
+	for _, op := range b.ops {
+		cur, err := s.current(live, op.name)
+		if err != nil {
+			return err
+		}
+
+		if op.check {
+			var version int64
+			if cur != nil {
+				version = cur.Version
+			}
+
+			if version != op.version {
+				return ErrConflict
+			}
+		}
+
+		r := &Revision{
+			Revision: rev + 1,
+			Name:     op.name,
+			Op:       op.op,
+			Time:     now,
+			User:     user,
+		}
+
+		switch op.op {
+		case Revision_PUT:
+			rt := proto.Clone(op.route).(*Route)
+			rt.Version = r.Revision
+
+			b, err := proto.Marshal(rt)
+			if err != nil {
+				return err
+			}
+			batch.Put([]byte(op.name), b)
+			reindex(&batch, cur, rt)
+			live[op.name] = rt
+			r.Route = rt
+			r.Previous = cur
+		case Revision_DELETE:
+			if cur == nil {
+				return ErrNotFound
+			}
+
+			batch.Delete([]byte(op.name))
+			reindex(&batch, cur, nil)
+			live[op.name] = nil
+			r.Route = cur
+		}
+
+		b, err := proto.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		batch.Put(logKey(r.Revision), b)
+		batch.Put(historyKey(r.Name, r.Revision), nil)
+		rev = r.Revision
+		revs = append(revs, r)
+	}
+
+	if rev == s.rev {
+		return nil
+	}
+
+	batch.Put([]byte(keyRevision), encodeRevision(rev))
+
+	if err := s.db.Write(&batch); err != nil {
 		return err
 	}
 
-	return s.db.Put([]byte(r.Name), b, nil)
+	for i, op := range b.ops {
+		if op.op == Revision_PUT {
+			op.route.Version = revs[i].Revision
+		}
+	}
+
+	b.revs = revs
+	s.rev = rev
+	s.ws.notify(revs)
+	return nil
+}
+
+// Save ...
+func (s *store) Save(r *Route, user string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	var b Batch
+	b.Save(r)
+	return s.commit(&b, user)
 }
 
 // Load ...
 func (s *store) Load(name string, r *Route) error {
-	b, err := s.db.Get([]byte(name), nil)
+	if reservedName(name) {
+		return ErrNotFound
+	}
+
+	b, err := s.db.Get([]byte(name))
 	if err != nil {
 		return err
 	}
@@ -58,32 +306,116 @@ func (s *store) Load(name string, r *Route) error {
 func (s *store) LoadAll() ([]*Route, error) {
 	var rts []*Route
 
-	it := s.db.NewIterator(nil, nil)
-	defer it.Release()
-
-	for it.Next() {
+	if err := s.db.Iterate([]byte{1}, nil, func(k, v []byte) error {
 		r := &Route{}
 
-		if err := proto.Unmarshal(it.Value(), r); err != nil {
-			return nil, err
+		// a single bad record must not take down every route, so skip it
+		// until it is quarantined by arkd fsck.
+		if err := proto.Unmarshal(v, r); err != nil {
+			log.Printf("skipping unparseable route '%s': %s", k, err)
+			return nil
 		}
 
 		rts = append(rts, r)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return rts, nil
+}
+
+func (s *store) loadRevision(rev int64) (*Revision, error) {
+	b, err := s.db.Get(logKey(rev))
+	if err != nil {
+		return nil, err
 	}
 
-	if err := it.Error(); err != nil {
+	r := &Revision{}
+	if err := proto.Unmarshal(b, r); err != nil {
 		return nil, err
 	}
 
-	return rts, nil
+	return r, nil
+}
+
+// History returns every revision recorded for the named route, oldest first.
+func (s *store) History(name string) ([]*Revision, error) {
+	if reservedName(name) {
+		return []*Revision{}, nil
+	}
+
+	prefix := historyPrefix(name)
+
+	var ids []int64
+	if err := s.db.Iterate(prefix, prefixLimit(prefix), func(k, v []byte) error {
+		ids = append(ids, decodeRevision(k[len(k)-8:]))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	revs := make([]*Revision, 0, len(ids))
+	for _, id := range ids {
+		r, err := s.loadRevision(id)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, r)
+	}
+
+	return revs, nil
 }
 
 // Delete ...
-func (s *store) Delete(name string) error {
-	return s.db.Delete([]byte(name), nil)
+func (s *store) Delete(name, user string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	var b Batch
+	b.Delete(name)
+	return s.commit(&b, user)
+}
+
+// Write ...
+func (s *store) Write(b *Batch, user string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	return s.commit(b, user)
+}
+
+// Watch returns a Watcher that first replays every logged change after rev
+// and then delivers each new change as it is written.
+func (s *store) Watch(rev int64) (*Watcher, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	var revs []*Revision
+	if rev != Latest {
+		if err := s.db.Iterate(
+			logKey(rev+1),
+			prefixLimit([]byte(prefixLog)),
+			func(k, v []byte) error {
+				r := &Revision{}
+				if err := proto.Unmarshal(v, r); err != nil {
+					return err
+				}
+				revs = append(revs, r)
+				return nil
+			}); err != nil {
+			return nil, err
+		}
+	}
+
+	w := newWatcher(s.ws.remove)
+	w.push(revs)
+	s.ws.add(w)
+	return w, nil
 }
 
 // Close ...
 func (s *store) Close() error {
+	s.ws.closeAll()
 	return s.db.Close()
 }
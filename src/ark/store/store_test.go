@@ -73,7 +73,7 @@ func TestSaveLoad(t *testing.T) {
 		Hosts: []string{"a", "b"},
 	}
 
-	if err := s.Save(&a); err != nil {
+	if err := s.Save(&a, ""); err != nil {
 		t.Fatal(err)
 	}
 
@@ -112,7 +112,7 @@ func TestLoadAll(t *testing.T) {
 	}
 
 	for _, route := range routes {
-		if err := s.Save(route); err != nil {
+		if err := s.Save(route, ""); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -141,7 +141,7 @@ func TestDelete(t *testing.T) {
 		Name:  "foo",
 		Port:  80,
 		Hosts: []string{"foo"},
-	}); err != nil {
+	}, ""); err != nil {
 		t.Fatal(err)
 	}
 
@@ -154,7 +154,7 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("expected 1 route got %d", len(rts))
 	}
 
-	if err := s.Delete("foo"); err != nil {
+	if err := s.Delete("foo", ""); err != nil {
 		t.Fatal(err)
 	}
 
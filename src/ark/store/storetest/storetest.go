@@ -0,0 +1,725 @@
+// Package storetest is a conformance suite that every implementation of
+// store.Store must pass.
+package storetest
+
+import (
+	"testing"
+	"time"
+
+	"ark/store"
+)
+
+// Run runs the conformance suite. Each test is given a new, empty store from
+// open which is closed when the test completes.
+func Run(t *testing.T, open func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, store.Store)
+	}{
+		{"SaveLoad", testSaveLoad},
+		{"LoadAll", testLoadAll},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"Names", testNames},
+		{"History", testHistory},
+		{"Write", testWrite},
+		{"Watch", testWatch},
+		{"Versions", testVersions},
+		{"Audit", testAudit},
+		{"Find", testFind},
+		{"Certs", testCerts},
+		{"Settings", testSettings},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := open(t)
+			test.fn(t, s)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func sameStringArrays(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i, n := 0, len(a); i < n; i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sameRoute(a, b *store.Route) bool {
+	return a.Name == b.Name &&
+		a.Port == b.Port &&
+		sameStringArrays(a.Hosts, b.Hosts) &&
+		sameStringArrays(a.Backends, b.Backends)
+}
+
+func testSaveLoad(t *testing.T, s store.Store) {
+	a := store.Route{
+		Name:  "foo",
+		Port:  222,
+		Hosts: []string{"a", "b"},
+	}
+
+	if err := s.Save(&a, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var b store.Route
+	if err := s.Load("foo", &b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameRoute(&a, &b) {
+		t.Fatalf("expected %v got %v", &a, &b)
+	}
+}
+
+func testLoadAll(t *testing.T, s store.Store) {
+	routes := map[string]*store.Route{
+		"foo": &store.Route{
+			Name:  "foo",
+			Port:  2222,
+			Hosts: []string{"a"},
+		},
+
+		"bar": &store.Route{
+			Name:  "bar",
+			Port:  2228,
+			Hosts: []string{"z"},
+		},
+
+		"baz": &store.Route{
+			Name:  "baz",
+			Port:  80,
+			Hosts: []string{"y"},
+		},
+	}
+
+	for _, route := range routes {
+		if err := s.Save(route, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rts, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != len(routes) {
+		t.Fatalf("not enough results: expected %d got %d", len(routes), len(rts))
+	}
+
+	for _, rt := range rts {
+		if !sameRoute(rt, routes[rt.Name]) {
+			t.Fatalf("expected %v got %v", rt, routes[rt.Name])
+		}
+	}
+}
+
+func testDelete(t *testing.T, s store.Store) {
+	if err := s.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"foo"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rts, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 {
+		t.Fatalf("expected 1 route got %d", len(rts))
+	}
+
+	if err := s.Delete("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rts, err = s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 0 {
+		t.Fatalf("expected no routes got %d", len(rts))
+	}
+}
+
+func testDeleteMissing(t *testing.T, s store.Store) {
+	if err := s.Delete("foo", ""); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound got %v", err)
+	}
+}
+
+func testNames(t *testing.T, s store.Store) {
+	for _, name := range []string{"", "\x00schema", "\x00auditid", "a\x00b", "a/b", "-a", "a b"} {
+		if err := s.Save(&store.Route{
+			Name:  name,
+			Port:  80,
+			Hosts: []string{"a"},
+		}, ""); err != store.ErrInvalidName {
+			t.Fatalf("expected ErrInvalidName saving %q got %v", name, err)
+		}
+	}
+
+	// an invalid name fails the entire batch.
+	var b store.Batch
+	b.Save(&store.Route{Name: "foo", Port: 80, Hosts: []string{"a"}})
+	b.SaveIf(&store.Route{Name: "\x00rev", Port: 80, Hosts: []string{"a"}}, 0)
+	if err := s.Write(&b, ""); err != store.ErrInvalidName {
+		t.Fatalf("expected ErrInvalidName got %v", err)
+	}
+
+	if err := s.Load("foo", &store.Route{}); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound got %v", err)
+	}
+
+	// the reserved keys are never routes.
+	if err := s.Load("\x00schema", &store.Route{}); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound got %v", err)
+	}
+
+	if err := s.Delete("\x00schema", ""); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound got %v", err)
+	}
+
+	if err := s.Save(&store.Route{
+		Name:  "api.example_1-b",
+		Port:  80,
+		Hosts: []string{"a"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testHistory(t *testing.T, s store.Store) {
+	if err := s.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a"},
+	}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save(&store.Route{
+		Name:  "bar",
+		Port:  80,
+		Hosts: []string{"z"},
+	}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save(&store.Route{
+		Name:     "foo",
+		Port:     80,
+		Hosts:    []string{"a", "b"},
+		Backends: []string{"c:80"},
+	}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete("foo", "carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := s.History("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revs) != 3 {
+		t.Fatalf("expected 3 revisions got %d", len(revs))
+	}
+
+	expected := []struct {
+		rev  int64
+		op   store.Revision_Op
+		user string
+	}{
+		{1, store.Revision_PUT, "alice"},
+		{3, store.Revision_PUT, "bob"},
+		{4, store.Revision_DELETE, "carol"},
+	}
+
+	for i, e := range expected {
+		r := revs[i]
+		if r.Revision != e.rev || r.Op != e.op || r.User != e.user {
+			t.Fatalf("expected %v got %v", e, r)
+		}
+
+		if r.Name != "foo" || r.Route == nil || r.Route.Name != "foo" {
+			t.Fatalf("expected route foo got %v", r)
+		}
+	}
+
+	if !sameStringArrays(revs[2].Route.Hosts, []string{"a", "b"}) {
+		t.Fatalf("expected deleted route in revision, got %v", revs[2].Route)
+	}
+
+	revs, err = s.History("baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revs) != 0 {
+		t.Fatalf("expected no revisions got %d", len(revs))
+	}
+}
+
+func testWrite(t *testing.T, s store.Store) {
+	if err := s.Save(&store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var b store.Batch
+	b.Save(&store.Route{
+		Name:  "bar",
+		Port:  80,
+		Hosts: []string{"b"},
+	})
+	b.Delete("foo")
+
+	if err := s.Write(&b, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	rts, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 || rts[0].Name != "bar" {
+		t.Fatalf("expected only bar got %v", rts)
+	}
+
+	revs, err := s.History("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revs) != 2 || revs[1].Revision != 3 || revs[1].User != "alice" {
+		t.Fatalf("expected delete at revision 3 got %v", revs)
+	}
+
+	// a batch that fails leaves the store untouched.
+	b = store.Batch{}
+	b.Save(&store.Route{
+		Name:  "baz",
+		Port:  80,
+		Hosts: []string{"c"},
+	})
+	b.Delete("bar")
+	b.Delete("bar")
+
+	if err := s.Write(&b, ""); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound got %v", err)
+	}
+
+	var rt store.Route
+	if err := s.Load("baz", &rt); err != store.ErrNotFound {
+		t.Fatalf("expected baz to not exist, got %v", err)
+	}
+
+	if err := s.Load("bar", &rt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextRevision(t *testing.T, w *store.Watcher) *store.Revision {
+	select {
+	case r := <-w.C:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for revision")
+	}
+	return nil
+}
+
+func testWatch(t *testing.T, s store.Store) {
+	for _, name := range []string{"foo", "bar"} {
+		if err := s.Save(&store.Route{
+			Name:  name,
+			Port:  80,
+			Hosts: []string{name},
+		}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := s.Watch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+
+	latest, err := s.Watch(store.Latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer latest.Close()
+
+	if err := s.Delete("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		rev  int64
+		name string
+		op   store.Revision_Op
+	}{
+		{1, "foo", store.Revision_PUT},
+		{2, "bar", store.Revision_PUT},
+		{3, "foo", store.Revision_DELETE},
+	}
+
+	for _, e := range expected {
+		r := nextRevision(t, all)
+		if r.Revision != e.rev || r.Name != e.name || r.Op != e.op {
+			t.Fatalf("expected %v got %v", e, r)
+		}
+	}
+
+	if r := nextRevision(t, latest); r.Revision != 3 {
+		t.Fatalf("expected revision 3 got %v", r)
+	}
+
+	if err := latest.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-latest.C; ok {
+		t.Fatal("expected closed watcher to close its channel")
+	}
+}
+
+func testVersions(t *testing.T, s store.Store) {
+	a := store.Route{
+		Name:  "foo",
+		Port:  80,
+		Hosts: []string{"a"},
+	}
+
+	if err := s.Save(&a, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Version == 0 {
+		t.Fatal("expected save to assign a version")
+	}
+
+	var b store.Route
+	if err := s.Load("foo", &b); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Version != a.Version {
+		t.Fatalf("expected version %d got %d", a.Version, b.Version)
+	}
+
+	// a conditional save against a stale version fails.
+	var batch store.Batch
+	batch.SaveIf(&a, a.Version-1)
+	if err := s.Write(&batch, ""); err != store.ErrConflict {
+		t.Fatalf("expected ErrConflict got %v", err)
+	}
+
+	batch = store.Batch{}
+	batch.SaveIf(&a, a.Version)
+	if err := s.Write(&batch, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Version <= b.Version {
+		t.Fatalf("expected version to increase from %d, got %d", b.Version, a.Version)
+	}
+
+	// a version of 0 requires that the route not exist.
+	batch = store.Batch{}
+	batch.SaveIf(&a, 0)
+	if err := s.Write(&batch, ""); err != store.ErrConflict {
+		t.Fatalf("expected ErrConflict got %v", err)
+	}
+
+	batch = store.Batch{}
+	batch.SaveIf(&store.Route{
+		Name:  "bar",
+		Port:  80,
+		Hosts: []string{"b"},
+	}, 0)
+	if err := s.Write(&batch, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	batch = store.Batch{}
+	batch.DeleteIf("foo", b.Version)
+	if err := s.Write(&batch, ""); err != store.ErrConflict {
+		t.Fatalf("expected ErrConflict got %v", err)
+	}
+
+	batch = store.Batch{}
+	batch.DeleteIf("foo", a.Version)
+	if err := s.Write(&batch, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAudit(t *testing.T, s store.Store) {
+	es, err := s.AuditLog(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(es) != 0 {
+		t.Fatalf("expected empty audit log got %v", es)
+	}
+
+	for i := 0; i < 5; i++ {
+		e := store.AuditEntry{
+			User:   "alice",
+			Method: "POST",
+			Path:   "/api/v1/routes",
+			Status: 200,
+			Changes: []*store.AuditEntry_Change{
+				{
+					Name:  "foo",
+					After: &store.Route{Name: "foo", Port: int32(80 + i)},
+				},
+			},
+		}
+
+		if err := s.Audit(&e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Id != int64(i+1) || e.Time == 0 {
+			t.Fatalf("expected id %d and a time, got %v", i+1, &e)
+		}
+	}
+
+	es, err = s.AuditLog(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(es) != 2 || es[0].Id != 4 || es[1].Id != 5 {
+		t.Fatalf("expected entries 4 and 5 got %v", es)
+	}
+
+	if es[1].Changes[0].After.Port != 84 {
+		t.Fatalf("expected port 84 got %v", es[1].Changes[0])
+	}
+
+	es, err = s.AuditLog(4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(es) != 3 || es[0].Id != 1 || es[2].Id != 3 {
+		t.Fatalf("expected entries 1 through 3 got %v", es)
+	}
+}
+
+func names(rts []*store.Route) []string {
+	var ns []string
+	for _, rt := range rts {
+		ns = append(ns, rt.Name)
+	}
+	return ns
+}
+
+func expectFind(t *testing.T, s store.Store, q *store.Query, expected ...string) {
+	rts, err := s.Find(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameStringArrays(names(rts), expected) {
+		t.Fatalf("%v: expected %v got %v", q, expected, names(rts))
+	}
+}
+
+func testFind(t *testing.T, s store.Store) {
+	routes := []*store.Route{
+		{
+			Name:     "a",
+			Port:     80,
+			Hosts:    []string{"a.com", "www.a.com"},
+			Backends: []string{"10.0.0.1:80", "10.0.0.2:80"},
+			Labels:   map[string]string{"team": "web", "env": "prod"},
+		},
+		{
+			Name:     "b",
+			Port:     80,
+			Hosts:    []string{"b.com"},
+			Backends: []string{"10.0.0.2:8080"},
+		},
+		{
+			Name:   "c",
+			Port:   8080,
+			Hosts:  []string{"a.com"},
+			Labels: map[string]string{"team": "web", "env": "staging"},
+		},
+	}
+
+	for _, rt := range routes {
+		if err := s.Save(rt, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectFind(t, s, &store.Query{}, "a", "b", "c")
+	expectFind(t, s, &store.Query{Host: "a.com"}, "a", "c")
+	expectFind(t, s, &store.Query{Host: "www.a.com"}, "a")
+	expectFind(t, s, &store.Query{Host: "nope.com"})
+	expectFind(t, s, &store.Query{Backend: "10.0.0.2:80"}, "a")
+	expectFind(t, s, &store.Query{Backend: "10.0.0.2"}, "a", "b")
+	expectFind(t, s, &store.Query{Backend: "10.0.0.2", Host: "b.com"}, "b")
+	expectFind(t, s, &store.Query{Port: 8080}, "c")
+	expectFind(t, s, &store.Query{Port: 80, Host: "a.com"}, "a")
+	expectFind(t, s, &store.Query{Port: 443})
+
+	web, err := store.ParseSelector("team=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staging, err := store.ParseSelector("team=web,env!=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectFind(t, s, &store.Query{Selector: web}, "a", "c")
+	expectFind(t, s, &store.Query{Selector: staging}, "c")
+	expectFind(t, s, &store.Query{Selector: web, Host: "www.a.com"}, "a")
+
+	// indexes follow updates and deletes.
+	if err := s.Save(&store.Route{
+		Name:     "a",
+		Port:     80,
+		Hosts:    []string{"a.com"},
+		Backends: []string{"10.0.0.3:80"},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectFind(t, s, &store.Query{Host: "www.a.com"})
+	expectFind(t, s, &store.Query{Backend: "10.0.0.2"}, "b")
+	expectFind(t, s, &store.Query{Backend: "10.0.0.3"}, "a")
+
+	if err := s.Delete("c", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectFind(t, s, &store.Query{Host: "a.com"}, "a")
+
+	// backends in path rules are indexed too.
+	if err := s.Save(&store.Route{
+		Name:  "d",
+		Port:  80,
+		Hosts: []string{"d.com"},
+		Paths: []*store.PathRule{
+			{Path: "/api", Backends: []string{"10.0.0.4:80"}},
+		},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectFind(t, s, &store.Query{Backend: "10.0.0.4"}, "d")
+}
+
+func testCerts(t *testing.T, s store.Store) {
+	if err := s.Save(&store.Route{Name: "a", Port: 443, Cert: "a"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"b", "a"} {
+		if err := s.SaveCert(&store.Certificate{
+			Name:     name,
+			Cert:     []byte("cert " + name),
+			Key:      []byte("key " + name),
+			Hosts:    []string{name + ".com"},
+			NotAfter: 100,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var c store.Certificate
+	if err := s.LoadCert("a", &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(c.Key) != "key a" || !sameStringArrays(c.Hosts, []string{"a.com"}) {
+		t.Fatalf("unexpected certificate: %v", &c)
+	}
+
+	certs, err := s.LoadCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(certs) != 2 || certs[0].Name != "a" || certs[1].Name != "b" {
+		t.Fatalf("expected certificates a and b, got %v", certs)
+	}
+
+	// certificates are not routes.
+	rts, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rts) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(rts))
+	}
+
+	if err := s.DeleteCert("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.LoadCert("b", &c); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := s.DeleteCert("b"); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound deleting a missing certificate, got %v", err)
+	}
+}
+
+func testSettings(t *testing.T, s store.Store) {
+	if _, err := s.LoadSetting("a"); err != store.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	for _, v := range []string{"1", "2"} {
+		if err := s.SaveSetting("a", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := s.LoadSetting("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(v) != "2" {
+		t.Fatalf("expected 2, got %s", v)
+	}
+}
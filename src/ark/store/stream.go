@@ -0,0 +1,33 @@
+package store
+
+// The protocols that a route can serve.
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+)
+
+// ProtocolType returns the protocol that the route serves, which is
+// ProtocolHTTP when Protocol is not set.
+func (r *Route) ProtocolType() string {
+	if r.Protocol == "" {
+		return ProtocolHTTP
+	}
+	return r.Protocol
+}
+
+// IsStream indicates whether the route proxies raw TCP or UDP rather than
+// HTTP.
+func (r *Route) IsStream() bool {
+	p := r.ProtocolType()
+	return p == ProtocolTCP || p == ProtocolUDP
+}
+
+// Transport returns the transport protocol that the route listens on. Routes
+// that use the same transport cannot share a port unless both serve HTTP.
+func (r *Route) Transport() string {
+	if r.ProtocolType() == ProtocolUDP {
+		return ProtocolUDP
+	}
+	return ProtocolTCP
+}
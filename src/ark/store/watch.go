@@ -0,0 +1,145 @@
+package store
+
+import "sync"
+
+// Latest can be passed to Watch to receive only the changes that are made
+// after the call, skipping replay of the revision log.
+const Latest int64 = -1
+
+// Watcher delivers change events from a Store, in revision order, on C. C is
+// closed once the Watcher is closed. Events are queued without bound so a
+// slow reader never blocks writes to the store.
+type Watcher struct {
+	C <-chan *Revision
+
+	c    chan *Revision
+	done chan struct{}
+
+	lck    sync.Mutex
+	cnd    *sync.Cond
+	q      []*Revision
+	closed bool
+
+	unwatch func(*Watcher)
+}
+
+func newWatcher(unwatch func(*Watcher)) *Watcher {
+	c := make(chan *Revision)
+	w := &Watcher{
+		C:       c,
+		c:       c,
+		done:    make(chan struct{}),
+		unwatch: unwatch,
+	}
+	w.cnd = sync.NewCond(&w.lck)
+	go w.run()
+	return w
+}
+
+func (w *Watcher) push(revs []*Revision) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	w.q = append(w.q, revs...)
+	w.cnd.Signal()
+}
+
+func (w *Watcher) next() (*Revision, bool) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	for len(w.q) == 0 && !w.closed {
+		w.cnd.Wait()
+	}
+
+	if w.closed {
+		return nil, false
+	}
+
+	r := w.q[0]
+	w.q[0] = nil
+	w.q = w.q[1:]
+	return r, true
+}
+
+func (w *Watcher) run() {
+	defer close(w.c)
+
+	for {
+		r, ok := w.next()
+		if !ok {
+			return
+		}
+
+		select {
+		case w.c <- r:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close stops delivery of events and releases the Watcher.
+func (w *Watcher) Close() error {
+	w.unwatch(w)
+
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	w.q = nil
+	w.cnd.Signal()
+	close(w.done)
+	return nil
+}
+
+// watchers is a set of Watchers that are notified together.
+type watchers struct {
+	lck sync.Mutex
+	ws  map[*Watcher]bool
+}
+
+func (s *watchers) add(w *Watcher) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if s.ws == nil {
+		s.ws = map[*Watcher]bool{}
+	}
+	s.ws[w] = true
+}
+
+func (s *watchers) remove(w *Watcher) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	delete(s.ws, w)
+}
+
+func (s *watchers) notify(revs []*Revision) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	for w := range s.ws {
+		w.push(revs)
+	}
+}
+
+func (s *watchers) closeAll() {
+	s.lck.Lock()
+	ws := s.ws
+	s.ws = nil
+	s.lck.Unlock()
+
+	for w := range ws {
+		w.Close()
+	}
+}